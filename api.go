@@ -6,11 +6,12 @@
 package aiot
 
 import (
+	"context"
 	"encoding/json"
 	"io"
+	"sync"
 	"time"
 
-	"github.com/patrickmn/go-cache"
 	"github.com/thinkgos/x/lib/logger"
 
 	"github.com/thinkgos/aliyun-iot/infra"
@@ -18,8 +19,12 @@ import (
 
 // 缓存默认值
 const (
-	DefaultCacheExpiration      = time.Second * 10
+	// DefaultCacheExpiration 在途请求默认超时时间
+	DefaultCacheExpiration = time.Second * 10
+	// Deprecated: 在途请求表按请求独立超时,不再需要清理间隔
 	DefaultCacheCleanupInterval = time.Second * 30
+	// DefaultMaxInflight 默认在途请求数上限, 0 表示不限制
+	DefaultMaxInflight = 0
 )
 
 // DefaultVersion 平台通信版本
@@ -76,8 +81,34 @@ type Client struct {
 	requestID uint32
 	tetrad    infra.MetaTriad
 
-	cacheExpiration      time.Duration
-	cacheCleanupInterval time.Duration
+	pendingExpiration  time.Duration
+	maxInflight        int
+	unmatchedReplyHook UnmatchedReplyHook
+
+	// 重连恢复
+	restoreTimeout time.Duration
+	restoreCb      RestoreCallback
+	restoreMu      sync.Mutex
+	restorePairs   []infra.MetaPair
+
+	// 设备上线回调
+	hookMu       sync.RWMutex
+	connectHooks []ConnectHook
+
+	// 离线队列
+	offline      uint32
+	outbound     OutboundQueue
+	outboundHold time.Duration
+	replayMu     sync.Mutex // 串行重发
+	outboundMu   sync.Mutex // 保护离线队列的入队及重发出队
+	replaying    bool
+
+	// 限流
+	limiter *limiter
+
+	// 同步请求重试
+	retry           RetryPolicy
+	linkAttemptHook LinkAttemptHook
 
 	mode    Mode
 	version string
@@ -90,8 +121,19 @@ type Client struct {
 	hasExtRRPC  bool
 	hasOTA      bool
 
+	validator Validator
+	router    *ServiceRouter
+	propStore *PropertyStore
+	ota       *OtaManager
+	gwOta     *GatewayOta
+	modules   *ModuleRegistry
+	config    *ConfigManager
+	cloudLog  *CloudLogger
+	reporter  *Reporter
+
 	*DevMgr
-	msgCache *cache.Cache
+	devStore DevStore
+	pending  *pending
 	Conn
 	cb   Callback
 	gwCb GwCallback
@@ -107,8 +149,9 @@ func New(triad infra.MetaTriad, conn Conn, opts ...Option) *Client {
 		mode:    ModeMQTT,
 		version: DefaultVersion,
 
-		cacheExpiration:      DefaultCacheExpiration,
-		cacheCleanupInterval: DefaultCacheCleanupInterval,
+		pendingExpiration: DefaultCacheExpiration,
+		maxInflight:       DefaultMaxInflight,
+		restoreTimeout:    DefaultRestoreTimeout,
 
 		DevMgr: NewDevMgr(triad),
 		Conn:   conn,
@@ -119,21 +162,43 @@ func New(triad infra.MetaTriad, conn Conn, opts ...Option) *Client {
 	for _, opt := range opts {
 		opt(c)
 	}
+	if c.devStore != nil {
+		mgr, err := NewDevMgrWithStore(triad, c.devStore)
+		if err != nil {
+			c.Log.Warnf("load sub device from store, %+v", err)
+		}
+		c.DevMgr = mgr
+	}
 	if c.mode != ModeHTTP {
-		c.msgCache = cache.New(c.cacheExpiration, c.cacheCleanupInterval)
+		c.pending = newPending(c.pendingExpiration, c.maxInflight)
+	}
+	if c.ota != nil || c.modules != nil {
+		c.connectHooks = append(c.connectHooks, c.onOtaConnect)
+	}
+	if c.reporter != nil {
+		c.reporter.start()
+	}
+	if c.cloudLog != nil {
+		c.cloudLog.start(c)
 	}
 	return c
 }
 
-// Connect 将订阅所有相关主题,主题有config配置
+// Connect 将订阅所有相关主题,主题有config配置,重发离线队列中的消息,并执行设备上线回调
 func (sf *Client) Connect() error {
 	if sf.mode != ModeMQTT {
 		return nil
 	}
-	return sf.SubscribeAllTopic(sf.tetrad.ProductKey, sf.tetrad.DeviceName, false)
+	err := sf.SubscribeAllTopic(sf.tetrad.ProductKey, sf.tetrad.DeviceName, false)
+	if err != nil {
+		return err
+	}
+	sf.replayOutbound()
+	sf.runConnectHooks(sf.tetrad.ProductKey, sf.tetrad.DeviceName, false)
+	return nil
 }
 
-// AddSubDevice 增加一个一个子设备
+// AddSubDevice 增加一个一个子设备, 返回 *DevStoreError 时子设备已添加, 仅保存失败
 func (sf *Client) AddSubDevice(meta infra.MetaTriad) error {
 	if sf.isGateway {
 		return sf.Add(meta)
@@ -149,31 +214,50 @@ func (sf *Client) AddSubDevice(meta infra.MetaTriad) error {
 //      4. 子设备与物联网平台的数据上下行通信与直连设备的通信协议一致，协议上不需要露出网关信息
 //      5. 删除拓扑关系后,子设备不能再通过网关上线
 func (sf *Client) SubDeviceConnect(pk, dn string, cleanSession bool, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return sf.SubDeviceConnectContext(ctx, pk, dn, cleanSession)
+}
+
+// SubDeviceConnectContext 同SubDeviceConnect, 整个上线流程受ctx控制
+func (sf *Client) SubDeviceConnectContext(ctx context.Context, pk, dn string, cleanSession bool) error {
 	node, err := sf.SearchAvail(pk, dn)
 	if err != nil {
 		return err
 	}
 	if node.Status() < DevStatusRegistered || node.DeviceSecret() == "" { // 需要注册
 		// 子设备注册
-		if _, err := sf.LinkThingSubRegister(pk, dn, timeout); err != nil {
+		if _, err := sf.LinkThingSubRegisterContext(ctx, pk, dn); err != nil {
 			return err
 		}
 	}
 	// 子设备添加到拓扑
-	err = sf.LinkThingTopoAdd(pk, dn, timeout)
+	err = sf.LinkThingTopoAddContext(ctx, pk, dn)
 	if err != nil {
 		return err
 	}
 	// 上线
-	err = sf.LinkExtCombineLogin(CombinePair{pk, dn, cleanSession}, timeout)
+	err = sf.LinkExtCombineLoginContext(ctx, CombinePair{pk, dn, cleanSession})
 	if err != nil {
 		return err
 	}
-	// 订阅
-	err = sf.SubscribeAllTopic(pk, dn, true)
+	return sf.subDeviceOnline(pk, dn, false)
+}
+
+// subDeviceOnline 子设备已登录,订阅子设备所有主题并置为在线
+func (sf *Client) subDeviceOnline(pk, dn string, reconnect bool) error {
+	err := sf.SubscribeAllTopic(pk, dn, true)
 	if err != nil {
 		return err
 	}
-	sf.SetDeviceStatus(pk, dn, DevStatusOnline) // nolint: errcheck
+	sf.setDevicesStatus(DevStatusOnline, infra.MetaPair{ProductKey: pk, DeviceName: dn})
+	sf.runConnectHooks(pk, dn, reconnect)
 	return nil
 }
+
+// setDevicesStatus 批量设置设备的状态, 失败时记录日志
+func (sf *Client) setDevicesStatus(status DevStatus, pairs ...infra.MetaPair) {
+	if err := sf.SetDevicesStatus(pairs, status); err != nil {
+		sf.Log.Warnf("set sub device status %d, %+v", status, err)
+	}
+}
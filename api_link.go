@@ -5,21 +5,90 @@
 package aiot
 
 import (
+	"context"
 	"encoding/json"
 	"time"
 
+	"github.com/thinkgos/x/lib/logger"
+
 	"github.com/thinkgos/aliyun-iot/infra"
+	"github.com/thinkgos/aliyun-iot/uri"
 )
 
+// linkRequest 发送请求并等待应答,同步
+// ctx取消或超时时,移除消息缓存中的条目并返回ctx.Err().
+// 按重试策略(见 RetryPolicy)重试时,每次重试调用send以新的请求ID重新发送,
+// send 应使用传入的ctx发送, 在途请求数达到上限或限流时的等待随ctx取消
+func (sf *Client) linkRequest(ctx context.Context, send func(ctx context.Context) (*Token, error)) (Message, error) {
+	return sf.linkRequestLog(ctx, sf.Log, send)
+}
+
+// linkRequestLog 同 linkRequest, 重试过程的日志输出到log
+func (sf *Client) linkRequestLog(ctx context.Context, log logger.Logger, send func(ctx context.Context) (*Token, error)) (Message, error) {
+	p := sf.retryPolicy(ctx)
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return Message{}, err
+		}
+		msg, id, err := sf.linkAttempt(ctx, p.AttemptTimeout, send)
+		if err == context.DeadlineExceeded && ctx.Err() == nil { // 本次尝试超时
+			err = ErrWaitTimeout
+		}
+		a := LinkAttempt{Attempt: attempt, ID: id, Err: err}
+		if attempt < p.MaxAttempts && ctx.Err() == nil && p.retryable(err) {
+			a.Retry, a.Backoff = true, p.backoff(attempt)
+			log.Warnf("request @%d attempt %d/%d failed, retry after %s, %+v", id, attempt, p.MaxAttempts, a.Backoff, err)
+		} else if attempt > 1 {
+			log.Debugf("request @%d attempt %d/%d done, %v", id, attempt, p.MaxAttempts, err)
+		}
+		if sf.linkAttemptHook != nil {
+			sf.linkAttemptHook(sf, a)
+		}
+		if !a.Retry {
+			return msg, err
+		}
+
+		t := time.NewTimer(a.Backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return Message{}, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// linkBatch 依次执行total个批次的请求,聚合失败批次的错误
+func (sf *Client) linkBatch(total int, do func(i int) error) error {
+	var failed []ChunkError
+
+	for i := 0; i < total; i++ {
+		if err := do(i); err != nil {
+			sf.Log.Warnf("batch request chunk %d/%d failed, %+v", i+1, total, err)
+			failed = append(failed, ChunkError{i, err})
+		}
+	}
+	if len(failed) > 0 {
+		return &BatchError{total, failed}
+	}
+	return nil
+}
+
 /**************************************** config *****************************/
 
 // LinkThingConfigGet 获取配置参数,同步
 func (sf *Client) LinkThingConfigGet(pk, dn string, timeout time.Duration) (ConfigParamsData, error) {
-	token, err := sf.ThingConfigGet(pk, dn)
-	if err != nil {
-		return ConfigParamsData{}, err
-	}
-	msg, err := token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	data, err := sf.LinkThingConfigGetContext(ctx, pk, dn)
+	return data, waitError(err)
+}
+
+// LinkThingConfigGetContext 获取配置参数,同步
+func (sf *Client) LinkThingConfigGetContext(ctx context.Context, pk, dn string) (ConfigParamsData, error) {
+	msg, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.ThingConfigGetContext(ctx, pk, dn)
+	})
 	if err != nil {
 		return ConfigParamsData{}, err
 	}
@@ -30,54 +99,121 @@ func (sf *Client) LinkThingConfigGet(pk, dn string, timeout time.Duration) (Conf
 
 // LinkThingEventPropertyPost 设备上报属性数据,同步
 func (sf *Client) LinkThingEventPropertyPost(pk, dn string, params interface{}, timeout time.Duration) error {
-	token, err := sf.ThingEventPropertyPost(pk, dn, params)
-	if err != nil {
-		return err
-	}
-	_, err = token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return waitError(sf.LinkThingEventPropertyPostContext(ctx, pk, dn, params))
+}
+
+// LinkThingEventPropertyPostContext 设备上报属性数据,同步
+func (sf *Client) LinkThingEventPropertyPostContext(ctx context.Context, pk, dn string, params interface{}) error {
+	_, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.ThingEventPropertyPostContext(ctx, pk, dn, params)
+	})
 	return err
 }
 
 // LinkThingEventPost 设备事件上报,同步
 func (sf *Client) LinkThingEventPost(pk, dn, eventID string, params interface{}, timeout time.Duration) error {
-	token, err := sf.ThingEventPost(pk, dn, eventID, params)
-	if err != nil {
-		return err
-	}
-	_, err = token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return waitError(sf.LinkThingEventPostContext(ctx, pk, dn, eventID, params))
+}
+
+// LinkThingEventPostContext 设备事件上报,同步
+func (sf *Client) LinkThingEventPostContext(ctx context.Context, pk, dn, eventID string, params interface{}) error {
+	_, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.ThingEventPostContext(ctx, pk, dn, eventID, params)
+	})
 	return err
 }
 
 // LinkThingEventPropertyPackPost 网关批量上报数据,同步
 func (sf *Client) LinkThingEventPropertyPackPost(params interface{}, timeout time.Duration) error {
-	token, err := sf.ThingEventPropertyPackPost(params)
-	if err != nil {
-		return err
-	}
-	_, err = token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return waitError(sf.LinkThingEventPropertyPackPostContext(ctx, params))
+}
+
+// LinkThingEventPropertyPackPostContext 网关批量上报数据,同步
+func (sf *Client) LinkThingEventPropertyPackPostContext(ctx context.Context, params interface{}) error {
+	_, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.ThingEventPropertyPackPostContext(ctx, params)
+	})
 	return err
 }
 
+// LinkThingEventPropertyPackPostBatch 网关批量上报数据,按平台限制拆分批次后依次上报,同步
+// timeout: 每个批次的超时时间, 部分批次失败时返回 *BatchError
+func (sf *Client) LinkThingEventPropertyPackPostBatch(b *PackBuilder, timeout time.Duration) error {
+	chunks := b.Build()
+	return sf.linkBatch(len(chunks), func(i int) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return waitError(sf.LinkThingEventPropertyPackPostContext(ctx, chunks[i]))
+	})
+}
+
+// LinkThingEventPropertyPackPostBatchContext 网关批量上报数据,按平台限制拆分批次后依次上报,同步
+// 部分批次失败时返回 *BatchError, ctx取消后剩余批次均以ctx.Err()失败
+func (sf *Client) LinkThingEventPropertyPackPostBatchContext(ctx context.Context, b *PackBuilder) error {
+	chunks := b.Build()
+	return sf.linkBatch(len(chunks), func(i int) error {
+		return sf.LinkThingEventPropertyPackPostContext(ctx, chunks[i])
+	})
+}
+
 // LinkThingEventPropertyHistoryPost 物模型历史数据上报,同步
 func (sf *Client) LinkThingEventPropertyHistoryPost(params interface{}, timeout time.Duration) error {
-	token, err := sf.ThingEventPropertyHistoryPost(params)
-	if err != nil {
-		return err
-	}
-	_, err = token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return waitError(sf.LinkThingEventPropertyHistoryPostContext(ctx, params))
+}
+
+// LinkThingEventPropertyHistoryPostContext 物模型历史数据上报,同步
+func (sf *Client) LinkThingEventPropertyHistoryPostContext(ctx context.Context, params interface{}) error {
+	_, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.ThingEventPropertyHistoryPostContext(ctx, params)
+	})
 	return err
 }
 
+// LinkThingEventPropertyHistoryPostBatch 物模型历史数据上报,按平台限制拆分批次后依次上报,同步
+// timeout: 每个批次的超时时间, 部分批次失败时返回 *BatchError
+func (sf *Client) LinkThingEventPropertyHistoryPostBatch(b *HistoryBuilder, timeout time.Duration) error {
+	chunks := b.Build()
+	return sf.linkBatch(len(chunks), func(i int) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return waitError(sf.LinkThingEventPropertyHistoryPostContext(ctx, chunks[i]))
+	})
+}
+
+// LinkThingEventPropertyHistoryPostBatchContext 物模型历史数据上报,按平台限制拆分批次后依次上报,同步
+// 部分批次失败时返回 *BatchError, ctx取消后剩余批次均以ctx.Err()失败
+func (sf *Client) LinkThingEventPropertyHistoryPostBatchContext(ctx context.Context, b *HistoryBuilder) error {
+	chunks := b.Build()
+	return sf.linkBatch(len(chunks), func(i int) error {
+		return sf.LinkThingEventPropertyHistoryPostContext(ctx, chunks[i])
+	})
+}
+
 /**************************************** desired *****************************/
 
 // LinkThingDesiredPropertyGet 获取期望属性值,同步
 func (sf *Client) LinkThingDesiredPropertyGet(pk, dn string,
 	params []string, timeout time.Duration) (json.RawMessage, error) {
-	token, err := sf.ThingDesiredPropertyGet(pk, dn, params)
-	if err != nil {
-		return nil, err
-	}
-	msg, err := token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	data, err := sf.LinkThingDesiredPropertyGetContext(ctx, pk, dn, params)
+	return data, waitError(err)
+}
+
+// LinkThingDesiredPropertyGetContext 获取期望属性值,同步
+func (sf *Client) LinkThingDesiredPropertyGetContext(ctx context.Context,
+	pk, dn string, params []string) (json.RawMessage, error) {
+	msg, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.ThingDesiredPropertyGetContext(ctx, pk, dn, params)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -86,11 +222,16 @@ func (sf *Client) LinkThingDesiredPropertyGet(pk, dn string,
 
 // LinkThingDesiredPropertyDelete 清空期望属性值,同步
 func (sf *Client) LinkThingDesiredPropertyDelete(pk, dn string, params interface{}, timeout time.Duration) error {
-	token, err := sf.ThingDesiredPropertyDelete(pk, dn, params)
-	if err != nil {
-		return err
-	}
-	_, err = token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return waitError(sf.LinkThingDesiredPropertyDeleteContext(ctx, pk, dn, params))
+}
+
+// LinkThingDesiredPropertyDeleteContext 清空期望属性值,同步
+func (sf *Client) LinkThingDesiredPropertyDeleteContext(ctx context.Context, pk, dn string, params interface{}) error {
+	_, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.ThingDesiredPropertyDeleteContext(ctx, pk, dn, params)
+	})
 	return err
 }
 
@@ -98,21 +239,31 @@ func (sf *Client) LinkThingDesiredPropertyDelete(pk, dn string, params interface
 
 // LinkThingDeviceInfoUpdate 设备信息上传(如厂商,设备型号等,可以保存为设备标签),同步
 func (sf *Client) LinkThingDeviceInfoUpdate(pk, dn string, params []DeviceInfoLabel, timeout time.Duration) error {
-	token, err := sf.ThingDeviceInfoUpdate(pk, dn, params)
-	if err != nil {
-		return err
-	}
-	_, err = token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return waitError(sf.LinkThingDeviceInfoUpdateContext(ctx, pk, dn, params))
+}
+
+// LinkThingDeviceInfoUpdateContext 设备信息上传(如厂商,设备型号等,可以保存为设备标签),同步
+func (sf *Client) LinkThingDeviceInfoUpdateContext(ctx context.Context, pk, dn string, params []DeviceInfoLabel) error {
+	_, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.ThingDeviceInfoUpdateContext(ctx, pk, dn, params)
+	})
 	return err
 }
 
 // LinkThingDeviceInfoDelete 删除标签信息.同步
 func (sf *Client) LinkThingDeviceInfoDelete(pk, dn string, params []DeviceLabelKey, timeout time.Duration) error {
-	token, err := sf.ThingDeviceInfoDelete(pk, dn, params)
-	if err != nil {
-		return err
-	}
-	_, err = token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return waitError(sf.LinkThingDeviceInfoDeleteContext(ctx, pk, dn, params))
+}
+
+// LinkThingDeviceInfoDeleteContext 删除标签信息.同步
+func (sf *Client) LinkThingDeviceInfoDeleteContext(ctx context.Context, pk, dn string, params []DeviceLabelKey) error {
+	_, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.ThingDeviceInfoDeleteContext(ctx, pk, dn, params)
+	})
 	return err
 }
 
@@ -120,11 +271,17 @@ func (sf *Client) LinkThingDeviceInfoDelete(pk, dn string, params []DeviceLabelK
 
 // LinkThingDsltemplateGet 设备可以通过上行请求获取设备的TSL模板(包含属性、服务和事件的定义),同步
 func (sf *Client) LinkThingDsltemplateGet(pk, dn string, timeout time.Duration) (json.RawMessage, error) {
-	token, err := sf.ThingDsltemplateGet(pk, dn)
-	if err != nil {
-		return nil, err
-	}
-	msg, err := token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	data, err := sf.LinkThingDsltemplateGetContext(ctx, pk, dn)
+	return data, waitError(err)
+}
+
+// LinkThingDsltemplateGetContext 设备可以通过上行请求获取设备的TSL模板(包含属性、服务和事件的定义),同步
+func (sf *Client) LinkThingDsltemplateGetContext(ctx context.Context, pk, dn string) (json.RawMessage, error) {
+	msg, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.ThingDsltemplateGetContext(ctx, pk, dn)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -133,11 +290,17 @@ func (sf *Client) LinkThingDsltemplateGet(pk, dn string, timeout time.Duration)
 
 // LinkThingDynamictslGet 获取动态tsl,同步
 func (sf *Client) LinkThingDynamictslGet(pk, dn string, timeout time.Duration) (json.RawMessage, error) {
-	token, err := sf.ThingDynamictslGet(pk, dn)
-	if err != nil {
-		return nil, err
-	}
-	msg, err := token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	data, err := sf.LinkThingDynamictslGetContext(ctx, pk, dn)
+	return data, waitError(err)
+}
+
+// LinkThingDynamictslGetContext 获取动态tsl,同步
+func (sf *Client) LinkThingDynamictslGetContext(ctx context.Context, pk, dn string) (json.RawMessage, error) {
+	msg, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.ThingDynamictslGetContext(ctx, pk, dn)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -147,11 +310,18 @@ func (sf *Client) LinkThingDynamictslGet(pk, dn string, timeout time.Duration) (
 // LinkThingConfigLogGet 获取日志配置,同步
 func (sf *Client) LinkThingConfigLogGet(pk, dn string,
 	clp ConfigLogParam, timeout time.Duration) (ConfigLogParamData, error) {
-	token, err := sf.ThingConfigLogGet(pk, dn, clp)
-	if err != nil {
-		return ConfigLogParamData{}, err
-	}
-	msg, err := token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	data, err := sf.LinkThingConfigLogGetContext(ctx, pk, dn, clp)
+	return data, waitError(err)
+}
+
+// LinkThingConfigLogGetContext 获取日志配置,同步
+func (sf *Client) LinkThingConfigLogGetContext(ctx context.Context,
+	pk, dn string, clp ConfigLogParam) (ConfigLogParamData, error) {
+	msg, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.ThingConfigLogGetContext(ctx, pk, dn, clp)
+	})
 	if err != nil {
 		return ConfigLogParamData{}, err
 	}
@@ -160,11 +330,17 @@ func (sf *Client) LinkThingConfigLogGet(pk, dn string,
 
 // LinkThingLogPost 设备上报日志内容,同步
 func (sf *Client) LinkThingLogPost(pk, dn string, lp []LogParam, timeout time.Duration) error {
-	token, err := sf.ThingLogPost(pk, dn, lp)
-	if err != nil {
-		return err
-	}
-	_, err = token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return waitError(sf.LinkThingLogPostContext(ctx, pk, dn, lp))
+}
+
+// LinkThingLogPostContext 设备上报日志内容,同步
+func (sf *Client) LinkThingLogPostContext(ctx context.Context, pk, dn string, lp []LogParam) error {
+	log := sf.logFor(uri.URI(uri.SysPrefix, uri.ThingLogPost, pk, dn))
+	_, err := sf.linkRequestLog(ctx, log, func(ctx context.Context) (*Token, error) {
+		return sf.ThingLogPostContext(ctx, pk, dn, lp)
+	})
 	return err
 }
 
@@ -172,18 +348,23 @@ func (sf *Client) LinkThingLogPost(pk, dn string, lp []LogParam, timeout time.Du
 
 // LinkThingSubRegister 同步子设备注册,
 func (sf *Client) LinkThingSubRegister(pk, dn string, timeout time.Duration) ([]SubRegisterData, error) {
-	token, err := sf.thingSubRegister(pk, dn)
-	if err != nil {
-		return nil, err
-	}
-	msg, err := token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	data, err := sf.LinkThingSubRegisterContext(ctx, pk, dn)
+	return data, waitError(err)
+}
+
+// LinkThingSubRegisterContext 同步子设备注册,
+func (sf *Client) LinkThingSubRegisterContext(ctx context.Context, pk, dn string) ([]SubRegisterData, error) {
+	msg, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.thingSubRegister(ctx, pk, dn)
+	})
 	if err != nil {
 		return nil, err
 	}
 	data := msg.Data.([]SubRegisterData)
-	for _, v := range msg.Data.([]SubRegisterData) {
-		sf.SetDeviceSecret(v.ProductKey, v.DeviceName, v.DeviceSecret)      // nolint: errcheck
-		sf.SetDeviceStatus(v.ProductKey, v.DeviceName, DevStatusRegistered) // nolint: errcheck
+	if err = sf.setRegistered(data); err != nil {
+		sf.Log.Warnf("save registered sub device, %+v", err)
 	}
 	return data, nil
 }
@@ -192,56 +373,71 @@ func (sf *Client) LinkThingSubRegister(pk, dn string, timeout time.Duration) ([]
 
 // LinkThingTopoAdd 添加设备拓扑关系,同步
 func (sf *Client) LinkThingTopoAdd(pk, dn string, timeout time.Duration) error {
-	token, err := sf.thingTopoAdd(pk, dn)
-	if err != nil {
-		return err
-	}
-	msg, err := token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return waitError(sf.LinkThingTopoAddContext(ctx, pk, dn))
+}
+
+// LinkThingTopoAddContext 添加设备拓扑关系,同步
+func (sf *Client) LinkThingTopoAddContext(ctx context.Context, pk, dn string) error {
+	msg, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.thingTopoAdd(ctx, pk, dn)
+	})
 	if err != nil {
 		return err
 	}
-	for _, pair := range msg.Data.([]infra.MetaPair) {
-		sf.SetDeviceStatus(pair.ProductKey, pair.DeviceName, DevStatusAttached) // nolint: errcheck
-	}
+	sf.setDevicesStatus(DevStatusAttached, msg.Data.([]infra.MetaPair)...)
 	return nil
 }
 
 // LinkThingTopoDelete 删除网关与子设备的拓扑关系
 func (sf *Client) LinkThingTopoDelete(pk, dn string, timeout time.Duration) error {
-	token, err := sf.thingTopoDelete(pk, dn)
-	if err != nil {
-		return err
-	}
-	msg, err := token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return waitError(sf.LinkThingTopoDeleteContext(ctx, pk, dn))
+}
+
+// LinkThingTopoDeleteContext 删除网关与子设备的拓扑关系
+func (sf *Client) LinkThingTopoDeleteContext(ctx context.Context, pk, dn string) error {
+	msg, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.thingTopoDelete(ctx, pk, dn)
+	})
 	if err != nil {
 		return err
 	}
-	for _, pair := range msg.Data.([]infra.MetaPair) {
-		sf.SetDeviceStatus(pair.ProductKey, pair.DeviceName, DevStatusRegistered) // nolint: errcheck
-	}
+	sf.setDevicesStatus(DevStatusRegistered, msg.Data.([]infra.MetaPair)...)
 	return nil
 }
 
 // LinkThingTopoGet 获取该网关和子设备的拓扑关系,同步
 func (sf *Client) LinkThingTopoGet(timeout time.Duration) ([]infra.MetaPair, error) {
-	token, err := sf.ThingTopoGet()
-	if err != nil {
-		return nil, err
-	}
-	msg, err := token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	data, err := sf.LinkThingTopoGetContext(ctx)
+	return data, waitError(err)
+}
+
+// LinkThingTopoGetContext 获取该网关和子设备的拓扑关系,同步
+func (sf *Client) LinkThingTopoGetContext(ctx context.Context) ([]infra.MetaPair, error) {
+	msg, err := sf.linkRequest(ctx, sf.ThingTopoGetContext)
 	if err != nil {
 		return nil, err
 	}
-	return msg.Data.([]infra.MetaPair), err
+	return msg.Data.([]infra.MetaPair), nil
 }
 
 // LinkThingListFound 发现设备列表上报,同步
 func (sf *Client) LinkThingListFound(pairs []infra.MetaPair, timeout time.Duration) error {
-	token, err := sf.ThingListFound(pairs)
-	if err != nil {
-		return err
-	}
-	_, err = token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return waitError(sf.LinkThingListFoundContext(ctx, pairs))
+}
+
+// LinkThingListFoundContext 发现设备列表上报,同步
+func (sf *Client) LinkThingListFoundContext(ctx context.Context, pairs []infra.MetaPair) error {
+	_, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.ThingListFoundContext(ctx, pairs)
+	})
 	return err
 }
 
@@ -249,62 +445,81 @@ func (sf *Client) LinkThingListFound(pairs []infra.MetaPair, timeout time.Durati
 
 // LinkExtCombineLogin 子设备上线,同步
 func (sf *Client) LinkExtCombineLogin(cp CombinePair, timeout time.Duration) error {
-	token, err := sf.extCombineLogin(cp)
-	if err != nil {
-		return err
-	}
-	_, err = token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return waitError(sf.LinkExtCombineLoginContext(ctx, cp))
+}
+
+// LinkExtCombineLoginContext 子设备上线,同步
+func (sf *Client) LinkExtCombineLoginContext(ctx context.Context, cp CombinePair) error {
+	_, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.extCombineLogin(ctx, cp)
+	})
 	if err != nil {
 		return err
 	}
-	sf.SetDeviceStatus(cp.ProductKey, cp.DeviceName, DevStatusLogined) // nolint: errcheck
+	sf.setDevicesStatus(DevStatusLogined, infra.MetaPair{ProductKey: cp.ProductKey, DeviceName: cp.DeviceName})
 	return nil
 }
 
 // LinkExtCombineBatchLogin 子设备批量上线,同步
 func (sf *Client) LinkExtCombineBatchLogin(pairs []CombinePair, timeout time.Duration) error {
-	token, err := sf.extCombineBatchLogin(pairs)
-	if err != nil {
-		return err
-	}
-	_, err = token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return waitError(sf.LinkExtCombineBatchLoginContext(ctx, pairs))
+}
+
+// LinkExtCombineBatchLoginContext 子设备批量上线,同步
+func (sf *Client) LinkExtCombineBatchLoginContext(ctx context.Context, pairs []CombinePair) error {
+	_, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.extCombineBatchLogin(ctx, pairs)
+	})
 	if err != nil {
 		return err
 	}
-
+	mps := make([]infra.MetaPair, 0, len(pairs))
 	for _, cp := range pairs {
-		sf.SetDeviceStatus(cp.ProductKey, cp.DeviceName, DevStatusLogined) // nolint: errcheck
+		mps = append(mps, infra.MetaPair{ProductKey: cp.ProductKey, DeviceName: cp.DeviceName})
 	}
+	sf.setDevicesStatus(DevStatusLogined, mps...)
 	return nil
 }
 
 // LinkExtCombineLogout 子设备下线,同步
 func (sf *Client) LinkExtCombineLogout(pk, dn string, timeout time.Duration) error {
-	token, err := sf.extCombineLogout(pk, dn)
-	if err != nil {
-		return err
-	}
-	_, err = token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return waitError(sf.LinkExtCombineLogoutContext(ctx, pk, dn))
+}
+
+// LinkExtCombineLogoutContext 子设备下线,同步
+func (sf *Client) LinkExtCombineLogoutContext(ctx context.Context, pk, dn string) error {
+	_, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.extCombineLogout(ctx, pk, dn)
+	})
 	if err != nil {
 		return err
 	}
-	sf.SetDeviceStatus(pk, dn, DevStatusAttached) // nolint: errcheck
+	sf.setDevicesStatus(DevStatusAttached, infra.MetaPair{ProductKey: pk, DeviceName: dn})
 	return nil
 }
 
 // LinkExtCombineBatchLogout 子设备批量下线,同步
 func (sf *Client) LinkExtCombineBatchLogout(pairs []infra.MetaPair, timeout time.Duration) error {
-	token, err := sf.extCombineBatchLogout(pairs)
-	if err != nil {
-		return err
-	}
-	_, err = token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return waitError(sf.LinkExtCombineBatchLogoutContext(ctx, pairs))
+}
+
+// LinkExtCombineBatchLogoutContext 子设备批量下线,同步
+func (sf *Client) LinkExtCombineBatchLogoutContext(ctx context.Context, pairs []infra.MetaPair) error {
+	_, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.extCombineBatchLogout(ctx, pairs)
+	})
 	if err != nil {
 		return err
 	}
-	for _, cp := range pairs {
-		sf.SetDeviceStatus(cp.ProductKey, cp.DeviceName, DevStatusAttached) // nolint: errcheck
-	}
+	sf.setDevicesStatus(DevStatusAttached, pairs...)
 	return nil
 }
 
@@ -313,35 +528,71 @@ func (sf *Client) LinkExtCombineBatchLogout(pairs []infra.MetaPair, timeout time
 // LinkThingOtaFirmwareGet 请求固件信息,同步
 func (sf *Client) LinkThingOtaFirmwareGet(pk, dn string,
 	param OtaFirmwareParam, timeout time.Duration) (OtaFirmwareData, error) {
-	token, err := sf.ThingOtaFirmwareGet(pk, dn, param)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	data, err := sf.LinkThingOtaFirmwareGetContext(ctx, pk, dn, param)
+	return data, waitError(err)
+}
+
+// LinkThingOtaFirmwareGetContext 请求固件信息,同步
+func (sf *Client) LinkThingOtaFirmwareGetContext(ctx context.Context,
+	pk, dn string, param OtaFirmwareParam) (OtaFirmwareData, error) {
+	msg, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.ThingOtaFirmwareGetContext(ctx, pk, dn, param)
+	})
 	if err != nil {
 		return OtaFirmwareData{}, err
 	}
-	msg, err := token.Wait(timeout)
+	return msg.Data.(OtaFirmwareData), nil
+}
+
+// LinkThingFileDownload 通过MQTT请求文件分片,同步
+func (sf *Client) LinkThingFileDownload(pk, dn string, params FileDownloadParams, timeout time.Duration) (FileBlock, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	blk, err := sf.LinkThingFileDownloadContext(ctx, pk, dn, params)
+	return blk, waitError(err)
+}
+
+// LinkThingFileDownloadContext 通过MQTT请求文件分片,同步
+func (sf *Client) LinkThingFileDownloadContext(ctx context.Context, pk, dn string, params FileDownloadParams) (FileBlock, error) {
+	msg, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.ThingFileDownloadContext(ctx, pk, dn, params)
+	})
 	if err != nil {
-		return OtaFirmwareData{}, err
+		return FileBlock{}, err
 	}
-	return msg.Data.(OtaFirmwareData), nil
+	return msg.Data.(FileBlock), nil
 }
 
 /**************************************** diag *****************************/
 
 // LinkThingDiagPost 设备主动上报当前网络状态,同步
 func (sf *Client) LinkThingDiagPost(pk, dn string, p P, timeout time.Duration) error {
-	token, err := sf.ThingDiagPost(pk, dn, p)
-	if err != nil {
-		return err
-	}
-	_, err = token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return waitError(sf.LinkThingDiagPostContext(ctx, pk, dn, p))
+}
+
+// LinkThingDiagPostContext 设备主动上报当前网络状态,同步
+func (sf *Client) LinkThingDiagPostContext(ctx context.Context, pk, dn string, p P) error {
+	_, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.ThingDiagPostContext(ctx, pk, dn, p)
+	})
 	return err
 }
 
 // LinkThingDiagHistoryPost 设备主动上报历史网络状态,同步
 func (sf *Client) LinkThingDiagHistoryPost(pk, dn string, p []P, timeout time.Duration) error {
-	token, err := sf.ThingDiagHistoryPost(pk, dn, p)
-	if err != nil {
-		return err
-	}
-	_, err = token.Wait(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return waitError(sf.LinkThingDiagHistoryPostContext(ctx, pk, dn, p))
+}
+
+// LinkThingDiagHistoryPostContext 设备主动上报历史网络状态,同步
+func (sf *Client) LinkThingDiagHistoryPostContext(ctx context.Context, pk, dn string, p []P) error {
+	_, err := sf.linkRequest(ctx, func(ctx context.Context) (*Token, error) {
+		return sf.ThingDiagHistoryPostContext(ctx, pk, dn, p)
+	})
 	return err
 }
@@ -14,10 +14,33 @@ import (
 type Option func(*Client)
 
 // WithCache 设备消息缓存超时时间
-func WithCache(expiration, cleanupInterval time.Duration) Option {
+// Deprecated: use WithPendingExpiration, cleanupInterval 不再使用
+func WithCache(expiration, _ time.Duration) Option {
+	return WithPendingExpiration(expiration)
+}
+
+// WithPendingExpiration 在途请求默认超时时间,默认 DefaultCacheExpiration
+// 等待应答时若指定了超时时间,则以等待的超时时间为准
+func WithPendingExpiration(expiration time.Duration) Option {
+	return func(c *Client) {
+		if expiration > 0 {
+			c.pendingExpiration = expiration
+		}
+	}
+}
+
+// WithMaxInflight 在途请求数上限,达到上限后发送请求将阻塞直到有请求完成,
+// 默认不限制, n <= 0 表示不限制
+func WithMaxInflight(n int) Option {
 	return func(c *Client) {
-		c.cacheExpiration = expiration
-		c.cacheCleanupInterval = cleanupInterval
+		c.maxInflight = n
+	}
+}
+
+// WithUnmatchedReplyHook 设置收到迟到或未知应答时的回调
+func WithUnmatchedReplyHook(h UnmatchedReplyHook) Option {
+	return func(c *Client) {
+		c.unmatchedReplyHook = h
 	}
 }
 
@@ -84,6 +107,149 @@ func WithEnableDiag() Option {
 	}
 }
 
+// WithRestoreTimeout 重连后子设备批量上线的超时时间,默认 DefaultRestoreTimeout
+func WithRestoreTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		if timeout > 0 {
+			c.restoreTimeout = timeout
+		}
+	}
+}
+
+// WithRestoreCallback 设置重连恢复完成后的回调
+func WithRestoreCallback(cb RestoreCallback) Option {
+	return func(c *Client) {
+		c.restoreCb = cb
+	}
+}
+
+// WithOutboundQueue 设置离线队列,连接断开时QoS1的请求,透传数据及OTA进度上报将进入离线队列,重连后按序重发
+// hold: 离线期间请求等待应答的最长时间,应不小于队列中消息的最长保存时间
+func WithOutboundQueue(q OutboundQueue, hold time.Duration) Option {
+	return func(c *Client) {
+		c.outbound = q
+		c.outboundHold = hold
+	}
+}
+
+// WithRateLimit 设置客户端限流, 请求及应答发送前按设备及连接限流,
+// 收到平台限流应答时暂停该设备发送并退避重发, 见 RateLimit
+func WithRateLimit(rl RateLimit) Option {
+	return func(c *Client) {
+		c.limiter = newLimiter(rl)
+	}
+}
+
+// WithRetryPolicy 设置同步请求(Link*)的重试策略,默认不重试,
+// 单次调用可使用 WithRetryPolicyContext 覆盖
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(c *Client) {
+		c.retry = p
+	}
+}
+
+// WithLinkAttemptHook 设置同步请求(Link*)每次尝试完成后的回调
+func WithLinkAttemptHook(h LinkAttemptHook) Option {
+	return func(c *Client) {
+		c.linkAttemptHook = h
+	}
+}
+
+// WithDevStore 设置子设备信息持久化存储,创建时将从中加载子设备信息
+func WithDevStore(store DevStore) Option {
+	return func(c *Client) {
+		c.devStore = store
+	}
+}
+
+// WithValidator 设置物模型校验,属性上报,事件上报及服务应答发布前将进行校验
+func WithValidator(v Validator) Option {
+	return func(c *Client) {
+		c.validator = v
+	}
+}
+
+// WithServiceRouter 设置服务路由,设备服务调用将由路由分发处理并自动回复,
+// 属性设置仍由 Callback.ThingServicePropertySet 处理
+func WithServiceRouter(r *ServiceRouter) Option {
+	return func(c *Client) {
+		c.router = r
+	}
+}
+
+// WithPropertyStore 设置属性存储,已注册属性的设备的属性设置及属性获取由存储处理并自动回复
+func WithPropertyStore(s *PropertyStore) Option {
+	return func(c *Client) {
+		c.propStore = s
+	}
+}
+
+// WithOtaManager 设置OTA升级管理,平台推送的升级将由管理自动完成,不再交由 Callback.OtaUpgrade 处理,
+// 需同时使能ota功能
+func WithOtaManager(m *OtaManager) Option {
+	return func(c *Client) {
+		c.ota = m
+	}
+}
+
+// WithGatewayOta 设置网关子设备OTA升级,平台推送的子设备升级将由其自动完成,
+// 需同时使能网关及ota功能
+func WithGatewayOta(g *GatewayOta) Option {
+	return func(c *Client) {
+		c.gwOta = g
+	}
+}
+
+// WithModuleRegistry 设置模块固件版本注册表,设备上线后自动上报所有模块的固件版本,
+// 平台推送的升级优先交由注册表中该模块的处理函数处理
+func WithModuleRegistry(r *ModuleRegistry) Option {
+	return func(c *Client) {
+		c.modules = r
+	}
+}
+
+// WithConfigManager 设置远程配置管理,设备上线后自动获取配置,
+// 平台推送的配置将由管理自动完成,不再交由 Callback.ThingConfigPush 处理
+func WithConfigManager(m *ConfigManager) Option {
+	return func(c *Client) {
+		c.config = m
+		c.connectHooks = append(c.connectHooks, m.onConnect)
+	}
+}
+
+// WithCloudLogger 设置上报日志到云端的日志, 同时作为客户端的日志,
+// 设备上线后获取日志配置, 日志配置推送时更新上报模式
+func WithCloudLogger(l *CloudLogger) Option {
+	return func(c *Client) {
+		c.Log = l
+		c.cloudLog = l
+		c.connectHooks = append(c.connectHooks, l.onConnect)
+	}
+}
+
+// WithDesiredReconciler 设置期望属性调和,设备上线后自动应用期望属性值, 需同时使能期望属性
+func WithDesiredReconciler(r *DesiredReconciler) Option {
+	return func(c *Client) {
+		c.connectHooks = append(c.connectHooks, r.onConnect)
+	}
+}
+
+// WithReporter 设置属性变化上报,客户端创建完成后开始周期上报,设备上线后全量上报
+func WithReporter(r *Reporter) Option {
+	return func(c *Client) {
+		r.c = c
+		c.reporter = r
+		c.connectHooks = append(c.connectHooks, r.onConnect)
+	}
+}
+
+// WithConnectHook 添加设备上线回调, 见 ConnectHook
+func WithConnectHook(h ConnectHook) Option {
+	return func(c *Client) {
+		c.connectHooks = append(c.connectHooks, h)
+	}
+}
+
 // WithCallback 设置事件处理接口
 func WithCallback(cb Callback) Option {
 	return func(c *Client) {
@@ -0,0 +1,124 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+// Package bsdiff 实现bsdiff(BSDIFF40)格式差分包的还原
+// see http://www.daemonology.net/bsdiff/
+//
+// 差分包格式:
+//
+//	0   8  "BSDIFF40"
+//	8   8  bzip2压缩后的ctrl块长度
+//	16  8  bzip2压缩后的diff块长度
+//	24  8  新文件长度
+//	32  ?  bzip2压缩的ctrl块
+//	?   ?  bzip2压缩的diff块
+//	?   ?  bzip2压缩的extra块
+//
+// 数值均为8字节小端序,最高位为符号位.
+package bsdiff
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"errors"
+	"io"
+)
+
+// Magic 差分包头部标识
+const Magic = "BSDIFF40"
+
+const headerSize = 32
+
+// 错误相关定义
+var (
+	ErrInvalidMagic = errors.New("bsdiff: invalid magic")
+	ErrCorrupt      = errors.New("bsdiff: corrupt patch")
+	ErrTooLarge     = errors.New("bsdiff: new file too large")
+)
+
+// Patch 使用差分包patch及旧文件old还原新文件, maxSize 为新文件允许的最大长度, 超出时返回 ErrTooLarge
+func Patch(old, patch []byte, maxSize int64) ([]byte, error) {
+	if len(patch) < headerSize {
+		return nil, ErrCorrupt
+	}
+	if string(patch[:8]) != Magic {
+		return nil, ErrInvalidMagic
+	}
+	ctrlLen := offtin(patch[8:])
+	diffLen := offtin(patch[16:])
+	newSize := offtin(patch[24:])
+	body := patch[headerSize:]
+	if ctrlLen < 0 || ctrlLen > int64(len(body)) {
+		return nil, ErrCorrupt
+	}
+	if diffLen < 0 || diffLen > int64(len(body))-ctrlLen {
+		return nil, ErrCorrupt
+	}
+	if newSize < 0 {
+		return nil, ErrCorrupt
+	}
+	if newSize > maxSize {
+		return nil, ErrTooLarge
+	}
+
+	ctrl := bzip2.NewReader(bytes.NewReader(body[:ctrlLen]))
+	diff := bzip2.NewReader(bytes.NewReader(body[ctrlLen : ctrlLen+diffLen]))
+	extra := bzip2.NewReader(bytes.NewReader(body[ctrlLen+diffLen:]))
+
+	out := make([]byte, newSize)
+	oldSize := int64(len(old))
+	var oldPos, newPos int64
+	var buf [24]byte
+	for newPos < newSize {
+		if _, err := io.ReadFull(ctrl, buf[:]); err != nil {
+			return nil, corrupt(err)
+		}
+		x, y, z := offtin(buf[0:]), offtin(buf[8:]), offtin(buf[16:])
+		if x < 0 || y < 0 || x > newSize-newPos {
+			return nil, ErrCorrupt
+		}
+
+		// diff块与旧文件对应字节相加
+		if _, err := io.ReadFull(diff, out[newPos:newPos+x]); err != nil {
+			return nil, corrupt(err)
+		}
+		for i := int64(0); i < x; i++ {
+			if pos := oldPos + i; pos >= 0 && pos < oldSize {
+				out[newPos+i] += old[pos]
+			}
+		}
+		newPos += x
+		oldPos += x
+
+		// extra块直接复制
+		if y > newSize-newPos {
+			return nil, ErrCorrupt
+		}
+		if _, err := io.ReadFull(extra, out[newPos:newPos+y]); err != nil {
+			return nil, corrupt(err)
+		}
+		newPos += y
+		oldPos += z
+	}
+	return out, nil
+}
+
+// offtin 读取8字节小端序,最高位为符号位的数值
+func offtin(b []byte) int64 {
+	y := int64(b[7] & 0x7f)
+	for i := 6; i >= 0; i-- {
+		y = y<<8 | int64(b[i])
+	}
+	if b[7]&0x80 != 0 {
+		y = -y
+	}
+	return y
+}
+
+func corrupt(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrCorrupt
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package bsdiff
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatch(t *testing.T) {
+	old, err := ioutil.ReadFile("testdata/old.bin")
+	require.NoError(t, err)
+	want, err := ioutil.ReadFile("testdata/new.bin")
+	require.NoError(t, err)
+	patch, err := ioutil.ReadFile("testdata/patch.bin")
+	require.NoError(t, err)
+
+	got, err := Patch(old, patch, int64(len(want)))
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	_, err = Patch(old, patch, int64(len(want))-1)
+	assert.Equal(t, ErrTooLarge, err)
+}
+
+func TestPatch_Invalid(t *testing.T) {
+	patch, err := ioutil.ReadFile("testdata/patch.bin")
+	require.NoError(t, err)
+	old, err := ioutil.ReadFile("testdata/old.bin")
+	require.NoError(t, err)
+	ctrlLen, diffLen := offtin(patch[8:]), offtin(patch[16:])
+
+	header := func(ctrl, diff, size []byte) []byte {
+		bad := append([]byte{}, patch...)
+		copy(bad[8:], ctrl)
+		copy(bad[16:], diff)
+		copy(bad[24:], size)
+		return bad
+	}
+	huge := []byte{0, 0, 0, 0, 0, 0, 0, 0x40} // 2^62
+	neg := []byte{1, 0, 0, 0, 0, 0, 0, 0x80}  // -1
+
+	tests := []struct {
+		name  string
+		patch []byte
+		err   error
+	}{
+		{"short header", patch[:16], ErrCorrupt},
+		{"empty", nil, ErrCorrupt},
+		{"magic", append([]byte("BSDIFF41"), patch[8:]...), ErrInvalidMagic},
+		{"ctrl too long", header([]byte{0xff, 0xff}, nil, nil), ErrCorrupt},
+		{"ctrl and diff overflow", header(huge, huge, nil), ErrCorrupt},
+		{"diff too long", header(nil, huge, nil), ErrCorrupt},
+		{"negative ctrl", header(neg, nil, nil), ErrCorrupt},
+		{"negative diff", header(nil, neg, nil), ErrCorrupt},
+		{"negative size", header(nil, nil, neg), ErrCorrupt},
+		{"huge size", header(nil, nil, huge), ErrTooLarge},
+		{"truncated header body", patch[:headerSize], ErrCorrupt},
+		{"truncated ctrl", patch[:headerSize+ctrlLen-1], ErrCorrupt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Patch(old, tt.patch, 1<<20)
+			assert.Equal(t, tt.err, err)
+		})
+	}
+
+	// 截断extra块
+	n := headerSize + ctrlLen + diffLen
+	_, err = Patch(old, patch[:n+4], 1<<20)
+	assert.Error(t, err)
+}
+
+func TestOfftin(t *testing.T) {
+	assert.Equal(t, int64(0), offtin([]byte{0, 0, 0, 0, 0, 0, 0, 0}))
+	assert.Equal(t, int64(0x0201), offtin([]byte{1, 2, 0, 0, 0, 0, 0, 0}))
+	assert.Equal(t, int64(-3000), offtin([]byte{0xb8, 0x0b, 0, 0, 0, 0, 0, 0x80}))
+}
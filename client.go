@@ -5,6 +5,7 @@
 package aiot
 
 import (
+	"context"
 	"encoding/json"
 	"sync/atomic"
 
@@ -22,10 +23,21 @@ func (sf *Client) nextRequestID() uint {
 // method: 方法
 // params: 消息体Request的params
 func (sf *Client) Request(_uri string, requestID uint, method string, params interface{}) error {
+	return sf.RequestContext(context.Background(), _uri, requestID, method, params)
+}
+
+// RequestContext 同Request,配置限流时,等待限流令牌直到ctx完成
+func (sf *Client) RequestContext(ctx context.Context, _uri string, requestID uint, method string, params interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	out, err := json.Marshal(&Request{requestID, sf.version, params, method})
 	if err != nil {
 		return err
 	}
+	if err = sf.waitLimit(ctx, _uri); err != nil {
+		return err
+	}
 	return sf.Publish(_uri, 1, out)
 }
 
@@ -34,12 +46,25 @@ func (sf *Client) Request(_uri string, requestID uint, method string, params int
 // method: 方法
 // params: 消息体Request的params
 func (sf *Client) SendRequest(_uri, method string, params interface{}) (*Token, error) {
+	return sf.SendRequestContext(context.Background(), _uri, method, params)
+}
+
+// SendRequestContext 同SendRequest,ctx已取消时不再发送请求,直接返回ctx.Err(),
+// 配置限流时,等待限流令牌直到ctx完成
+func (sf *Client) SendRequestContext(ctx context.Context, _uri, method string, params interface{}) (*Token, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	id := sf.nextRequestID()
-	sf.Log.Debugf("%s @%d", method, id)
-	if err := sf.Request(_uri, id, method, params); err != nil {
+	out, err := json.Marshal(&Request{id, sf.version, params, method})
+	if err != nil {
 		return nil, err
 	}
-	return sf.putPending(id), nil
+	if err = sf.waitLimit(ctx, _uri); err != nil {
+		return nil, err
+	}
+	sf.logFor(_uri).Debugf("%s @%d", method, id)
+	return sf.sendPending(ctx, _uri, 1, id, out)
 }
 
 // Response 发送回复
@@ -47,10 +72,21 @@ func (sf *Client) SendRequest(_uri, method string, params interface{}) (*Token,
 // Response: 回复
 // API内部已实现json序列化
 func (sf *Client) Response(_uri string, rsp Response) error {
+	return sf.ResponseContext(context.Background(), _uri, rsp)
+}
+
+// ResponseContext 同Response,配置限流时,等待限流令牌直到ctx完成
+func (sf *Client) ResponseContext(ctx context.Context, _uri string, rsp Response) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	out, err := json.Marshal(rsp)
 	if err != nil {
 		return err
 	}
+	if err = sf.waitLimit(ctx, _uri); err != nil {
+		return err
+	}
 	return sf.Publish(_uri, 1, out)
 }
 
@@ -285,6 +321,12 @@ func (sf *Client) SubscribeAllTopic(productKey, deviceName string, isSub bool) e
 		if err = sf.Subscribe(_uri, ProcThingOtaFirmwareGetReply); err != nil {
 			sf.Log.Warnf(err.Error())
 		}
+
+		// 文件分片下载应答
+		_uri = uri.URI(uri.SysPrefix, uri.ThingFileDownloadReply, productKey, deviceName)
+		if err = sf.Subscribe(_uri, ProcThingFileDownloadReply); err != nil {
+			sf.Log.Warnf(err.Error())
+		}
 	}
 
 	return nil
@@ -386,6 +428,8 @@ func (sf *Client) UnSubscribeAllTopic(productKey, deviceName string, isSub bool)
 			uri.URI(uri.OtaDeviceUpgradePrefix, "", productKey, deviceName),
 			// OTA 固件版本查询应答
 			uri.URI(uri.SysPrefix, uri.ThingOtaFirmwareGetReply, productKey, deviceName),
+			// 文件分片下载应答
+			uri.URI(uri.SysPrefix, uri.ThingFileDownloadReply, productKey, deviceName),
 		)
 	}
 
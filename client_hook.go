@@ -0,0 +1,26 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+// ConnectHook 设备上线回调,网关或独立设备连接(Connect)及重连恢复后,子设备上线后调用,
+// reconnect 表示是否为重连后的恢复
+type ConnectHook func(c *Client, pk, dn string, reconnect bool)
+
+// AddConnectHook 添加设备上线回调,回调在独立的goroutine中执行
+func (sf *Client) AddConnectHook(h ConnectHook) {
+	sf.hookMu.Lock()
+	sf.connectHooks = append(sf.connectHooks, h)
+	sf.hookMu.Unlock()
+}
+
+// runConnectHooks 执行设备上线回调
+func (sf *Client) runConnectHooks(pk, dn string, reconnect bool) {
+	sf.hookMu.RLock()
+	hooks := sf.connectHooks
+	sf.hookMu.RUnlock()
+	for _, h := range hooks {
+		go h(sf, pk, dn, reconnect)
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+	"github.com/thinkgos/aliyun-iot/uri"
+)
+
+// 限流重试默认值
+const (
+	// DefaultThrottleRetry 被平台限流时默认最大重试次数
+	DefaultThrottleRetry = 3
+	// DefaultThrottleBackoff 被平台限流时默认首次退避时间
+	DefaultThrottleBackoff = time.Millisecond * 500
+	// DefaultThrottleMaxBackoff 被平台限流时默认最大退避时间
+	DefaultThrottleMaxBackoff = time.Second * 10
+)
+
+// RateLimit 客户端限流配置, 速率 <= 0 表示不限制.
+// 请求收到平台限流应答(infra.CodeRequestTooMany, infra.CodeDpScriptRequestTooMuch)时,
+// 该设备暂停发送一个退避时间, 并在退避后以相同ID重发请求, 退避时间按次数指数增长.
+// 重试期间限流应答仍会交由 Callback 相应的Reply处理
+type RateLimit struct {
+	ConnRate    float64 // 每个连接每秒请求数
+	ConnBurst   int     // 每个连接的突发请求数,默认为1
+	DeviceRate  float64 // 每个设备每秒请求数
+	DeviceBurst int     // 每个设备的突发请求数,默认为1
+
+	MaxRetry   int           // 被平台限流时最大重试次数, 0 使用 DefaultThrottleRetry, < 0 表示不重试
+	Backoff    time.Duration // 首次退避时间, 默认 DefaultThrottleBackoff
+	MaxBackoff time.Duration // 最大退避时间, 默认 DefaultThrottleMaxBackoff
+}
+
+// tokenBucket 令牌桶, rate <= 0 时仅在暂停期间等待
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time // 上次填充时间,暂停时为暂停结束的时间
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst <= 0 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve 取得一个令牌,返回需要等待的时间
+func (sf *tokenBucket) reserve(now time.Time) time.Duration {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if now.After(sf.last) {
+		if sf.rate > 0 {
+			sf.tokens += now.Sub(sf.last).Seconds() * sf.rate
+			if sf.tokens > sf.burst {
+				sf.tokens = sf.burst
+			}
+		}
+		sf.last = now
+	}
+	wait := sf.last.Sub(now)
+	if sf.rate > 0 {
+		sf.tokens--
+		if sf.tokens < 0 {
+			wait += time.Duration(-sf.tokens / sf.rate * float64(time.Second))
+		}
+	}
+	return wait
+}
+
+// cancel 归还未使用的令牌
+func (sf *tokenBucket) cancel() {
+	if sf.rate > 0 {
+		sf.mu.Lock()
+		sf.tokens++
+		sf.mu.Unlock()
+	}
+}
+
+// pause 暂停发放令牌d时间,之后从空桶开始填充
+func (sf *tokenBucket) pause(now time.Time, d time.Duration) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if until := now.Add(d); until.After(sf.last) {
+		sf.last = until
+	}
+	if sf.tokens > 0 {
+		sf.tokens = 0
+	}
+}
+
+// wait 等待一个令牌,直到ctx完成
+func (sf *tokenBucket) wait(ctx context.Context) error {
+	d := sf.reserve(time.Now())
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		sf.cancel()
+		return ctx.Err()
+	}
+}
+
+// limiter 连接及设备限流
+type limiter struct {
+	RateLimit
+	conn    *tokenBucket
+	mu      sync.Mutex
+	devices map[string]*tokenBucket
+}
+
+func newLimiter(rl RateLimit) *limiter {
+	if rl.MaxRetry == 0 {
+		rl.MaxRetry = DefaultThrottleRetry
+	}
+	if rl.Backoff <= 0 {
+		rl.Backoff = DefaultThrottleBackoff
+	}
+	if rl.MaxBackoff <= 0 {
+		rl.MaxBackoff = DefaultThrottleMaxBackoff
+	}
+	return &limiter{
+		RateLimit: rl,
+		conn:      newTokenBucket(rl.ConnRate, rl.ConnBurst),
+		devices:   make(map[string]*tokenBucket),
+	}
+}
+
+func (sf *limiter) device(key string) *tokenBucket {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	b, ok := sf.devices[key]
+	if !ok {
+		b = newTokenBucket(sf.DeviceRate, sf.DeviceBurst)
+		sf.devices[key] = b
+	}
+	return b
+}
+
+// wait 等待设备及连接的令牌, key 为空时仅等待连接的令牌
+func (sf *limiter) wait(ctx context.Context, key string) error {
+	if key != "" {
+		if err := sf.device(key).wait(ctx); err != nil {
+			return err
+		}
+	}
+	return sf.conn.wait(ctx)
+}
+
+// throttle 被平台限流,暂停设备发送d时间, key 为空时暂停连接发送
+func (sf *limiter) throttle(key string, d time.Duration) {
+	b := sf.conn
+	if key != "" {
+		b = sf.device(key)
+	}
+	b.pause(time.Now(), d)
+}
+
+// backoff 第attempt次重试的退避时间
+func (sf *limiter) backoff(attempt int) time.Duration {
+	d := sf.Backoff
+	for i := 1; i < attempt && d < sf.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > sf.MaxBackoff {
+		d = sf.MaxBackoff
+	}
+	return d
+}
+
+// limitKey 由uri获得设备的限流key, 无法识别设备时返回空
+func limitKey(_uri string) string {
+	s := uri.Spilt(_uri)
+	var i int
+	switch {
+	case len(s) > 0 && s[0] == "sys":
+		i = 1
+	case len(s) > 1 && s[0] == "ext" && (s[1] == "session" || s[1] == "ntp" || s[1] == "error"):
+		i = 2
+	case len(s) > 2 && s[0] == "ota" && s[1] == "device":
+		i = 3
+	default:
+		return ""
+	}
+	if len(s) < i+2 {
+		return ""
+	}
+	return FormatKey(s[i], s[i+1])
+}
+
+// isThrottled 是否为平台限流错误
+func isThrottled(err error) bool {
+	var ce *infra.CodeError
+	if !errors.As(err, &ce) {
+		return false
+	}
+	return ce.Code() == infra.CodeRequestTooMany || ce.Code() == infra.CodeDpScriptRequestTooMuch
+}
+
+// waitLimit 等待限流令牌, 未配置限流时直接返回
+func (sf *Client) waitLimit(ctx context.Context, _uri string) error {
+	if sf.limiter == nil {
+		return nil
+	}
+	return sf.limiter.wait(ctx, limitKey(_uri))
+}
+
+// retryThrottled 在途请求收到平台限流应答时,暂停该设备发送,并在退避后以相同ID重发,
+// 返回是否已安排重发
+func (sf *Client) retryThrottled(msg Message) bool {
+	if sf.limiter == nil || sf.limiter.MaxRetry < 0 || sf.pending == nil || !isThrottled(msg.err) {
+		return false
+	}
+	r, attempt, ok := sf.pending.retry(msg.ID, sf.limiter.MaxRetry)
+	if !ok {
+		return false
+	}
+	d := sf.limiter.backoff(attempt)
+	sf.limiter.throttle(limitKey(r.uri), d)
+	sf.logFor(r.uri).Warnf("request @%d throttled, retry %d/%d after %s, %+v", msg.ID, attempt, sf.limiter.MaxRetry, d, msg.err)
+	time.AfterFunc(d, func() { sf.resend(msg.ID, r) })
+	return true
+}
+
+// resend 以相同ID重发在途请求, 请求已结束时不再重发
+func (sf *Client) resend(id uint, r resendState) {
+	if !sf.pending.has(id) {
+		return
+	}
+	if err := sf.waitLimit(context.Background(), r.uri); err != nil {
+		sf.pending.signal(Message{ID: id, err: err})
+		return
+	}
+	if !sf.pending.has(id) {
+		return
+	}
+	queued, err := sf.publish(r.uri, r.qos, id, r.payload)
+	if err != nil {
+		sf.pending.signal(Message{ID: id, err: err})
+		return
+	}
+	if queued {
+		sf.pending.hold(id, sf.outboundHold)
+	}
+}
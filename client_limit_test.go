@@ -0,0 +1,117 @@
+package aiot
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+)
+
+func TestLimiter_Backoff(t *testing.T) {
+	l := newLimiter(RateLimit{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond})
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 10 * time.Millisecond},
+		{2, 20 * time.Millisecond},
+		{3, 40 * time.Millisecond},
+		{4, 50 * time.Millisecond},
+		{10, 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, l.backoff(tt.attempt), "attempt %d", tt.attempt)
+	}
+}
+
+// throttleCloud 前throttled次请求应答平台限流, 之后应答成功
+type throttleCloud struct {
+	mu        sync.Mutex
+	throttled int
+	ids       []uint
+	times     []time.Time
+}
+
+func (sf *throttleCloud) reply(_ string, req fakeRequest) (Response, bool) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.ids = append(sf.ids, req.ID)
+	sf.times = append(sf.times, time.Now())
+	if sf.throttled < 0 || len(sf.ids) <= sf.throttled {
+		return Response{ID: req.ID, Code: infra.CodeRequestTooMany, Message: "too many requests"}, true
+	}
+	return Response{ID: req.ID, Code: infra.CodeSuccess, Data: struct{}{}}, true
+}
+
+func (sf *throttleCloud) requests() ([]uint, []time.Time) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return append([]uint{}, sf.ids...), append([]time.Time{}, sf.times...)
+}
+
+func TestClient_RetryThrottled(t *testing.T) {
+	rl := RateLimit{MaxRetry: 2, Backoff: 20 * time.Millisecond, MaxBackoff: 30 * time.Millisecond}
+	post := func(c *Client) (*Token, error) {
+		token, err := c.ThingEventPropertyPostContext(context.Background(), "pk", "dn", map[string]int{"a": 1})
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = token.WaitContext(ctx)
+		return token, err
+	}
+
+	t.Run("resend with same id", func(t *testing.T) {
+		cloud := &throttleCloud{throttled: 2}
+		c, _ := newFakeClient(cloud.reply, WithRateLimit(rl))
+		token, err := post(c)
+		require.NoError(t, err)
+
+		ids, times := cloud.requests()
+		assert.Equal(t, []uint{token.id, token.id, token.id}, ids)
+		// 退避时间按次数指数增长, 不超过最大退避时间
+		require.Len(t, times, 3)
+		assert.GreaterOrEqual(t, int64(times[1].Sub(times[0])), int64(20*time.Millisecond))
+		assert.GreaterOrEqual(t, int64(times[2].Sub(times[1])), int64(30*time.Millisecond))
+		assert.Equal(t, 0, c.PendingLen())
+	})
+
+	t.Run("max retry exhausted", func(t *testing.T) {
+		cloud := &throttleCloud{throttled: -1}
+		c, _ := newFakeClient(cloud.reply, WithRateLimit(rl))
+		token, err := post(c)
+		// 等待者收到最后一次限流应答
+		var ce *infra.CodeError
+		require.True(t, errors.As(err, &ce), "got %v", err)
+		assert.Equal(t, infra.CodeRequestTooMany, ce.Code())
+
+		ids, _ := cloud.requests()
+		assert.Equal(t, []uint{token.id, token.id, token.id}, ids)
+		assert.Equal(t, 0, c.PendingLen())
+	})
+
+	t.Run("retry disabled", func(t *testing.T) {
+		cloud := &throttleCloud{throttled: -1}
+		c, _ := newFakeClient(cloud.reply, WithRateLimit(RateLimit{MaxRetry: -1}))
+		_, err := post(c)
+		assert.True(t, isThrottled(err), "got %v", err)
+		ids, _ := cloud.requests()
+		assert.Len(t, ids, 1)
+	})
+
+	t.Run("no rate limit", func(t *testing.T) {
+		cloud := &throttleCloud{throttled: -1}
+		c, _ := newFakeClient(cloud.reply)
+		_, err := post(c)
+		assert.True(t, isThrottled(err), "got %v", err)
+		ids, _ := cloud.requests()
+		assert.Len(t, ids, 1)
+	})
+}
@@ -6,6 +6,7 @@ package aiot
 
 import (
 	"log"
+	"sync/atomic"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 
@@ -14,7 +15,8 @@ import (
 
 // MQTTClient MQTT客户端
 type MQTTClient struct {
-	c mqtt.Client
+	c        mqtt.Client
+	connects uint32
 	*Client
 }
 
@@ -25,13 +27,66 @@ var _ Conn = (*MQTTClient)(nil)
 func NewWithMQTT(meta infra.MetaTriad, c mqtt.Client, opts ...Option) *MQTTClient {
 	m := New(meta, nil, opts...)
 	cli := &MQTTClient{
-		c,
-		m,
+		c:      c,
+		Client: m,
+	}
+	if c.IsConnected() {
+		cli.connects = 1
 	}
 	m.Conn = cli
 	return cli
 }
 
+// NewWithMQTTOptions 使用mqtt配置新建MQTTClient,
+// 将接管连接建立和连接丢失的通知(原有的处理函数仍会被调用),
+// 连接丢失时所有在途请求将以ErrConnLost结束,重连后自动恢复主题订阅及子设备上线.
+// 需自行调用 Underlying().Connect() 建立连接
+func NewWithMQTTOptions(meta infra.MetaTriad, mopts *mqtt.ClientOptions, opts ...Option) *MQTTClient {
+	cli := &MQTTClient{}
+	onConnect := mopts.OnConnect
+	mopts.SetOnConnectHandler(func(c mqtt.Client) {
+		cli.HandleConnect(c)
+		if onConnect != nil {
+			onConnect(c)
+		}
+	})
+	onLost := mopts.OnConnectionLost
+	mopts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		cli.HandleConnectionLost(c, err)
+		if onLost != nil {
+			onLost(c, err)
+		}
+	})
+	m := New(meta, nil, opts...)
+	cli.c = mqtt.NewClient(mopts)
+	cli.Client = m
+	m.Conn = cli
+	return cli
+}
+
+// HandleConnect 处理连接建立,首次连接不做处理,
+// 重连时恢复网关或独立设备的主题订阅,批量重新上线连接丢失前在线的子设备,重发离线队列中的消息,并执行设备上线回调.
+// 使用NewWithMQTT时,可在mqtt.ClientOptions.SetOnConnectHandler中调用
+func (sf *MQTTClient) HandleConnect(_ mqtt.Client) {
+	sf.setOffline(false)
+	if atomic.AddUint32(&sf.connects, 1) == 1 {
+		return
+	}
+	sf.restore()
+	sf.replayOutbound()
+	sf.runConnectHooks(sf.tetrad.ProductKey, sf.tetrad.DeviceName, true)
+}
+
+// HandleConnectionLost 处理连接丢失,已发送的在途请求将以ErrConnLost结束,离线队列中的请求保留至重发,
+// 在线的子设备置为 DevStatusAttached.
+// 使用NewWithMQTT时,可在mqtt.ClientOptions.SetConnectionLostHandler中调用
+func (sf *MQTTClient) HandleConnectionLost(_ mqtt.Client, err error) {
+	sf.Log.Warnf("mqtt connection lost, %+v", err)
+	sf.setOffline(true)
+	sf.failSentPending(ErrConnLost)
+	sf.offlineSubDevices()
+}
+
 // Underlying 获得底层的Client
 func (sf *MQTTClient) Underlying() mqtt.Client { return sf.c }
 
@@ -60,5 +115,6 @@ func (sf *MQTTClient) UnSubscribe(topic ...string) error {
 // Close 实现dm.Conn接口
 func (sf *MQTTClient) Close() error {
 	sf.c.Disconnect(500)
+	sf.failPending(ErrConnClosed)
 	return nil
 }
@@ -0,0 +1,98 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+import (
+	"context"
+	"time"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+)
+
+// DefaultRestoreTimeout 重连后子设备批量上线默认超时时间
+const DefaultRestoreTimeout = time.Second * 10
+
+// 子设备批量上线单个批次最大子设备数量
+const combineBatchMax = 5
+
+// RestoreResult 重连后的恢复结果
+type RestoreResult struct {
+	// 网关或独立设备的主题订阅错误
+	Err error
+	// 已重新上线并订阅主题的子设备,状态为 DevStatusOnline
+	Restored []infra.MetaPair
+	// 重新上线失败的子设备,状态为 DevStatusAttached,需用户自行调用SubDeviceConnect
+	Failed []infra.MetaPair
+}
+
+// RestoreCallback 重连恢复完成后的回调
+type RestoreCallback func(c *Client, r RestoreResult)
+
+// offlineSubDevices 连接丢失,平台已将子设备置为离线, 将在线的子设备置为 DevStatusAttached,
+// 并记录下来,以便重连后重新上线
+func (sf *Client) offlineSubDevices() {
+	if !sf.isGateway {
+		return
+	}
+	pairs := sf.SearchSubDevices(DevStatusOnline)
+	sf.setDevicesStatus(DevStatusAttached, pairs...)
+	sf.restoreMu.Lock()
+	sf.restorePairs = append(sf.restorePairs, pairs...)
+	sf.restoreMu.Unlock()
+}
+
+// restore 重连后恢复网关或独立设备的主题订阅,并批量重新上线连接丢失前在线的子设备
+func (sf *Client) restore() RestoreResult {
+	var r RestoreResult
+
+	r.Err = sf.SubscribeAllTopic(sf.tetrad.ProductKey, sf.tetrad.DeviceName, false)
+	if sf.isGateway {
+		sf.restoreMu.Lock()
+		pairs := sf.restorePairs
+		sf.restorePairs = nil
+		sf.restoreMu.Unlock()
+
+		for len(pairs) > 0 {
+			n := combineBatchMax
+			if len(pairs) < n {
+				n = len(pairs)
+			}
+			restored, failed := sf.restoreSubDevices(pairs[:n])
+			r.Restored = append(r.Restored, restored...)
+			r.Failed = append(r.Failed, failed...)
+			pairs = pairs[n:]
+		}
+	}
+	sf.Log.Infof("restore after reconnect, restored: %d, failed: %d", len(r.Restored), len(r.Failed))
+	if sf.restoreCb != nil {
+		sf.restoreCb(sf, r)
+	}
+	return r
+}
+
+// restoreSubDevices 批量上线子设备并订阅子设备主题
+func (sf *Client) restoreSubDevices(pairs []infra.MetaPair) (restored, failed []infra.MetaPair) {
+	cps := make([]CombinePair, 0, len(pairs))
+	for _, pair := range pairs {
+		// 不清理子设备离线时的消息
+		cps = append(cps, CombinePair{pair.ProductKey, pair.DeviceName, false})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sf.restoreTimeout)
+	defer cancel()
+	if err := sf.LinkExtCombineBatchLoginContext(ctx, cps); err != nil {
+		sf.Log.Warnf("restore sub device batch login, %+v", err)
+		return nil, pairs
+	}
+	for _, pair := range pairs {
+		if err := sf.subDeviceOnline(pair.ProductKey, pair.DeviceName, true); err != nil {
+			sf.Log.Warnf("restore sub device %s subscribe, %+v", FormatKey(pair.ProductKey, pair.DeviceName), err)
+			failed = append(failed, pair)
+			continue
+		}
+		restored = append(restored, pair)
+	}
+	return restored, failed
+}
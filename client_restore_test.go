@@ -0,0 +1,121 @@
+package aiot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+	"github.com/thinkgos/aliyun-iot/uri"
+)
+
+// restorePhase 将订阅及发布记录归并为阶段: 网关订阅, 批量上线请求, 各子设备订阅,
+// 与设备无关的订阅返回空
+func restorePhase(event string) string {
+	switch {
+	case strings.HasSuffix(event, uri.CombineBatchLogin):
+		return "login"
+	case strings.HasPrefix(event, "pub "):
+		return event
+	}
+	for _, s := range uri.Spilt(strings.TrimPrefix(event, "sub ")) {
+		if s == "dn" || strings.HasPrefix(s, "sub") || s == "bad" {
+			return s
+		}
+	}
+	return ""
+}
+
+func TestMQTTClient_Restore(t *testing.T) {
+	reply := func(topic string, req fakeRequest) (Response, bool) {
+		if strings.HasSuffix(topic, uri.CombineBatchLogin) {
+			// 包含bad的批次上线失败
+			if strings.Contains(string(req.Params), `"bad"`) {
+				return Response{ID: req.ID, Code: infra.CodeSystemUnknownException, Message: "login failed"}, true
+			}
+			return Response{ID: req.ID, Code: infra.CodeSuccess, Data: []infra.MetaPair{}}, true
+		}
+		return Response{ID: req.ID, Code: infra.CodeSuccess, Data: struct{}{}}, true
+	}
+	var results []RestoreResult
+	var traced []int // 回调时已记录的订阅及发布数
+	var conn *fakeConn
+	c, conn := newFakeClient(reply, WithEnableGateway(), WithRestoreCallback(func(_ *Client, r RestoreResult) {
+		conn.mu.Lock()
+		traced = append(traced, len(conn.trace))
+		conn.mu.Unlock()
+		results = append(results, r)
+	}))
+	mc := &MQTTClient{Client: c, connects: 1}
+
+	subs := []string{"bad"}
+	for i := 1; i <= combineBatchMax+1; i++ {
+		subs = append(subs, fmt.Sprintf("sub%d", i))
+	}
+	for _, dn := range subs {
+		require.NoError(t, c.AddSubDevice(infra.MetaTriad{ProductKey: "pk", DeviceName: dn, DeviceSecret: "ds"}))
+		require.NoError(t, c.SetDeviceStatus("pk", dn, DevStatusOnline))
+	}
+
+	// 连接丢失, 在线子设备置为 DevStatusAttached
+	mc.HandleConnectionLost(nil, errors.New("lost"))
+	assert.Empty(t, c.SearchSubDevices(DevStatusOnline))
+	assert.Len(t, c.SearchSubDevices(DevStatusAttached), len(subs))
+
+	conn.cleanSession()
+	mc.HandleConnect(nil)
+	trace := conn.takeTrace()
+	require.Len(t, results, 1)
+	assert.Equal(t, []int{len(trace)}, traced, "callback after restore")
+	r := results[0]
+	assert.NoError(t, r.Err)
+
+	// 包含bad的批次失败, 其余子设备恢复上线
+	var failed, restored []string
+	for _, p := range r.Failed {
+		failed = append(failed, p.DeviceName)
+	}
+	for _, p := range r.Restored {
+		restored = append(restored, p.DeviceName)
+	}
+	assert.Contains(t, failed, "bad")
+	assert.Len(t, append(failed, restored...), len(subs))
+	assert.ElementsMatch(t, r.Restored, c.SearchSubDevices(DevStatusOnline))
+	assert.ElementsMatch(t, r.Failed, c.SearchSubDevices(DevStatusAttached))
+
+	// 先恢复网关订阅, 再按批次上线, 每批上线成功后订阅该批子设备的主题
+	var phases []string
+	for _, event := range trace {
+		p := restorePhase(event)
+		if p != "" && (p == "login" || len(phases) == 0 || phases[len(phases)-1] != p) {
+			phases = append(phases, p)
+		}
+	}
+	require.True(t, len(phases) > 1 && phases[0] == "dn" && phases[1] == "login",
+		"gateway subscriptions first, got %v", phases)
+	var batches [][]string
+	for _, p := range phases[1:] {
+		if p == "login" {
+			batches = append(batches, []string{})
+			continue
+		}
+		batches[len(batches)-1] = append(batches[len(batches)-1], p)
+	}
+	// 失败的批次不订阅, 成功的批次订阅该批所有子设备
+	require.Len(t, batches, 2, "got %v", phases)
+	if len(batches[0]) == 0 {
+		batches[0], batches[1] = batches[1], batches[0]
+	}
+	assert.Empty(t, batches[1], "got %v", phases)
+	assert.ElementsMatch(t, restored, batches[0], "got %v", phases)
+
+	// 首次连接不做恢复
+	c2, conn2 := newFakeClient(reply, WithEnableGateway())
+	conn2.takeTrace()
+	(&MQTTClient{Client: c2}).HandleConnect(nil)
+	assert.Empty(t, conn2.takeTrace())
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+)
+
+// 重试策略默认值
+const (
+	// DefaultRetryBackoff 默认首次重试退避时间
+	DefaultRetryBackoff = time.Millisecond * 200
+	// DefaultRetryMaxBackoff 默认最大重试退避时间
+	DefaultRetryMaxBackoff = time.Second * 5
+)
+
+// RetryPolicy 同步请求(Link*)的重试策略, 每次重试使用新的请求ID重新发送请求.
+// 零值表示不重试
+type RetryPolicy struct {
+	MaxAttempts    int           // 最多尝试次数(含首次), <= 1 表示不重试
+	Backoff        time.Duration // 首次重试的退避时间,之后按次数翻倍, 默认 DefaultRetryBackoff
+	MaxBackoff     time.Duration // 最大退避时间, 默认 DefaultRetryMaxBackoff
+	Codes          []int         // 可重试的错误码, 如 infra.CodeSystemUnknownException
+	RetryTimeout   bool          // 等待应答超时是否重试
+	AttemptTimeout time.Duration // 每次尝试等待应答的超时时间, 0 表示以调用的ctx为准
+}
+
+// retryable 错误是否可重试
+func (sf RetryPolicy) retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrWaitTimeout) {
+		return sf.RetryTimeout
+	}
+	var ce *infra.CodeError
+	if errors.As(err, &ce) {
+		for _, code := range sf.Codes {
+			if ce.Code() == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// backoff 第attempt次尝试失败后的退避时间
+func (sf RetryPolicy) backoff(attempt int) time.Duration {
+	d, max := sf.Backoff, sf.MaxBackoff
+	if d <= 0 {
+		d = DefaultRetryBackoff
+	}
+	if max <= 0 {
+		max = DefaultRetryMaxBackoff
+	}
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// LinkAttempt 同步请求的一次尝试结果
+type LinkAttempt struct {
+	Attempt int           // 第几次尝试,从1开始
+	ID      uint          // 本次尝试的请求ID, 发送失败时为0
+	Err     error         // 本次尝试的错误
+	Retry   bool          // 是否将重试
+	Backoff time.Duration // 重试前的退避时间
+}
+
+// LinkAttemptHook 同步请求每次尝试完成后的回调
+type LinkAttemptHook func(c *Client, a LinkAttempt)
+
+type retryPolicyKey struct{}
+
+// WithRetryPolicyContext 返回携带重试策略的ctx, 用于 Link*Context 调用时覆盖客户端的重试策略
+func WithRetryPolicyContext(ctx context.Context, p RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryPolicyKey{}, p)
+}
+
+// retryPolicy 获得调用的重试策略, ctx未指定时使用客户端的重试策略
+func (sf *Client) retryPolicy(ctx context.Context) RetryPolicy {
+	if p, ok := ctx.Value(retryPolicyKey{}).(RetryPolicy); ok {
+		return p
+	}
+	return sf.retry
+}
+
+// linkAttempt 发送一次请求并等待应答, timeout > 0 时为本次尝试的超时时间
+func (sf *Client) linkAttempt(ctx context.Context, timeout time.Duration, send func(ctx context.Context) (*Token, error)) (Message, uint, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	token, err := send(ctx)
+	if err != nil {
+		return Message{}, 0, err
+	}
+	msg, err := token.WaitContext(ctx)
+	return msg, token.id, err
+}
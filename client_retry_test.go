@@ -0,0 +1,222 @@
+package aiot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+)
+
+const testRetryCode = 6100
+
+func TestRetryPolicy_Retryable(t *testing.T) {
+	p := RetryPolicy{Codes: []int{testRetryCode}}
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		err    error
+		want   bool
+	}{
+		{"nil", p, nil, false},
+		{"listed code", p, infra.NewCodeError(testRetryCode, "busy"), true},
+		{"wrapped code", p, fmt.Errorf("wrap: %w", infra.NewCodeError(testRetryCode, "busy")), true},
+		{"unlisted code", p, infra.NewCodeError(testRetryCode+1, "busy"), false},
+		{"timeout", p, ErrWaitTimeout, false},
+		{"timeout enabled", RetryPolicy{RetryTimeout: true}, ErrWaitTimeout, true},
+		{"other error", RetryPolicy{RetryTimeout: true}, errors.New("send failed"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.policy.retryable(tt.err))
+		})
+	}
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{"default", RetryPolicy{}, 1, DefaultRetryBackoff},
+		{"default max", RetryPolicy{}, 10, DefaultRetryMaxBackoff},
+		{"first", RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}, 1, 10 * time.Millisecond},
+		{"doubled", RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}, 3, 40 * time.Millisecond},
+		{"capped", RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}, 4, 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.policy.backoff(tt.attempt))
+		})
+	}
+}
+
+// scriptCloud 按请求次序应答codes中的错误码, 0表示不应答, 超出codes的请求应答成功
+type scriptCloud struct {
+	mu    sync.Mutex
+	codes []int
+	ids   []uint
+}
+
+func (sf *scriptCloud) reply(_ string, req fakeRequest) (Response, bool) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	code := infra.CodeSuccess
+	if n := len(sf.ids); n < len(sf.codes) {
+		code = sf.codes[n]
+	}
+	sf.ids = append(sf.ids, req.ID)
+	switch code {
+	case 0:
+		return Response{}, false
+	case infra.CodeSuccess:
+		return Response{ID: req.ID, Code: code, Data: struct{}{}}, true
+	}
+	return Response{ID: req.ID, Code: code, Message: "failed"}, true
+}
+
+func (sf *scriptCloud) requests() []uint {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return append([]uint{}, sf.ids...)
+}
+
+// attemptCode 尝试结果的错误码, 成功为 infra.CodeSuccess, 超时为0
+func attemptCode(t *testing.T, err error) int {
+	var ce *infra.CodeError
+	switch {
+	case err == nil:
+		return infra.CodeSuccess
+	case err == ErrWaitTimeout:
+		return 0
+	case errors.As(err, &ce):
+		return ce.Code()
+	}
+	t.Fatalf("unexpected error %v", err)
+	return -1
+}
+
+func TestClient_LinkRequest(t *testing.T) {
+	type attempt struct {
+		code    int
+		retry   bool
+		backoff time.Duration
+	}
+	backoff := 5 * time.Millisecond
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		codes  []int
+		want   []attempt
+	}{
+		{
+			"no retry by default",
+			RetryPolicy{},
+			[]int{testRetryCode},
+			[]attempt{{testRetryCode, false, 0}},
+		},
+		{
+			"retry listed code",
+			RetryPolicy{MaxAttempts: 3, Backoff: backoff, Codes: []int{testRetryCode}},
+			[]int{testRetryCode, testRetryCode},
+			[]attempt{{testRetryCode, true, backoff}, {testRetryCode, true, 2 * backoff}, {infra.CodeSuccess, false, 0}},
+		},
+		{
+			"unlisted code",
+			RetryPolicy{MaxAttempts: 3, Backoff: backoff, Codes: []int{testRetryCode}},
+			[]int{testRetryCode + 1},
+			[]attempt{{testRetryCode + 1, false, 0}},
+		},
+		{
+			"max attempts",
+			RetryPolicy{MaxAttempts: 2, Backoff: backoff, Codes: []int{testRetryCode}},
+			[]int{testRetryCode, testRetryCode, testRetryCode},
+			[]attempt{{testRetryCode, true, backoff}, {testRetryCode, false, 0}},
+		},
+		{
+			"attempt timeout retried",
+			RetryPolicy{MaxAttempts: 2, Backoff: backoff, RetryTimeout: true, AttemptTimeout: 20 * time.Millisecond},
+			[]int{0},
+			[]attempt{{0, true, backoff}, {infra.CodeSuccess, false, 0}},
+		},
+		{
+			"attempt timeout not retried",
+			RetryPolicy{MaxAttempts: 2, Backoff: backoff, AttemptTimeout: 20 * time.Millisecond},
+			[]int{0},
+			[]attempt{{0, false, 0}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts []LinkAttempt
+			cloud := &scriptCloud{codes: tt.codes}
+			c, _ := newFakeClient(cloud.reply,
+				WithRetryPolicy(tt.policy),
+				WithLinkAttemptHook(func(_ *Client, a LinkAttempt) {
+					attempts = append(attempts, a)
+				}))
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err := c.LinkThingEventPropertyPostContext(ctx, "pk", "dn", map[string]int{"a": 1})
+
+			ids := cloud.requests()
+			require.Len(t, attempts, len(tt.want))
+			require.Len(t, ids, len(tt.want))
+			for i, a := range attempts {
+				assert.Equal(t, i+1, a.Attempt)
+				// 每次尝试使用新的请求ID
+				assert.Equal(t, ids[i], a.ID)
+				assert.Equal(t, tt.want[i], attempt{attemptCode(t, a.Err), a.Retry, a.Backoff}, "attempt %d", i+1)
+			}
+			assert.Len(t, uniqueIDs(ids), len(ids))
+			// 最后一次尝试的错误返回给调用者
+			assert.Equal(t, attempts[len(attempts)-1].Err, err)
+			assert.Equal(t, 0, c.PendingLen())
+		})
+	}
+}
+
+func TestClient_LinkRequestContext(t *testing.T) {
+	t.Run("policy from context", func(t *testing.T) {
+		cloud := &scriptCloud{codes: []int{testRetryCode}}
+		c, _ := newFakeClient(cloud.reply)
+		ctx := WithRetryPolicyContext(context.Background(),
+			RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond, Codes: []int{testRetryCode}})
+		require.NoError(t, c.LinkThingEventPropertyPostContext(ctx, "pk", "dn", map[string]int{"a": 1}))
+		assert.Len(t, cloud.requests(), 2)
+	})
+
+	t.Run("cancel during backoff", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cloud := &scriptCloud{codes: []int{testRetryCode}}
+		c, _ := newFakeClient(cloud.reply,
+			WithRetryPolicy(RetryPolicy{MaxAttempts: 3, Backoff: time.Minute, Codes: []int{testRetryCode}}),
+			WithLinkAttemptHook(func(_ *Client, a LinkAttempt) {
+				if a.Retry {
+					time.AfterFunc(20*time.Millisecond, cancel)
+				}
+			}))
+		start := time.Now()
+		err := c.LinkThingEventPropertyPostContext(ctx, "pk", "dn", map[string]int{"a": 1})
+		assert.Equal(t, context.Canceled, err)
+		assert.Less(t, int64(time.Since(start)), int64(time.Second))
+		assert.Len(t, cloud.requests(), 1)
+	})
+}
+
+func uniqueIDs(ids []uint) map[uint]struct{} {
+	m := make(map[uint]struct{}, len(ids))
+	for _, id := range ids {
+		m[id] = struct{}{}
+	}
+	return m
+}
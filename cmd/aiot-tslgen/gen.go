@@ -0,0 +1,430 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/thinkgos/aliyun-iot/tsl"
+)
+
+type field struct {
+	Name    string
+	Type    string
+	Tag     string
+	Comment string
+}
+
+type typeDef struct {
+	Name    string
+	Comment string
+	Fields  []field
+}
+
+type eventDef struct {
+	Const      string
+	Identifier string
+	Name       string
+	Func       string
+	Type       string
+}
+
+type serviceDef struct {
+	Const      string
+	Identifier string
+	Name       string
+	Method     string
+	Request    string
+	Response   string
+}
+
+type fileDef struct {
+	Package     string
+	ProductKey  string
+	Version     string
+	Imports     []string
+	Properties  typeDef
+	PostFunc    string
+	HasWritable bool
+	Events      []eventDef
+	Services    []serviceDef
+	Types       []typeDef
+}
+
+// generator 根据物模型生成go代码
+type generator struct {
+	names map[string]bool // 包级别已使用的名称
+	types []typeDef       // 属性,事件,服务的参数类型及结构体类型
+}
+
+// Generate 根据物模型生成go代码
+func Generate(thing *tsl.Thing, pkg string) ([]byte, error) {
+	g := &generator{
+		names: map[string]bool{
+			"ProductKey":  true,
+			"Properties":  true,
+			"Handler":     true,
+			"Callback":    true,
+			"NewCallback": true,
+		},
+	}
+	f := fileDef{
+		Package:    pkg,
+		ProductKey: thing.Profile.ProductKey,
+		Version:    thing.Profile.Version,
+	}
+
+	// 属性, 指针类型, 以支持部分属性上报及设置
+	f.Properties = typeDef{Name: "Properties", Comment: "属性"}
+	fieldNames := make(map[string]bool)
+	for i := range thing.Properties {
+		p := &thing.Properties[i]
+		name := uniqueName(fieldNames, goName(p.Identifier))
+		typ := g.goType(name, p.Name, &p.DataType)
+		if !strings.HasPrefix(typ, "[]") {
+			typ = "*" + typ
+		}
+		comment := describe(p.Name, &p.DataType)
+		if !p.Writable() {
+			comment += ", 只读"
+		}
+		f.Properties.Fields = append(f.Properties.Fields, field{
+			name, typ, jsonTag(p.Identifier, true), comment,
+		})
+		if p.Writable() {
+			f.HasWritable = true
+		}
+	}
+	f.PostFunc = g.unique("PostProperties")
+
+	for i := range thing.Events {
+		e := &thing.Events[i]
+		if e.Identifier == tsl.IdentifierPropertyPost {
+			continue
+		}
+		name := goName(e.Identifier)
+		ev := eventDef{
+			Const:      g.unique("Event" + name),
+			Identifier: e.Identifier,
+			Name:       oneLine(e.Name),
+			Func:       g.unique("Post" + name + "Event"),
+		}
+		ev.Type = g.paramsType(name+"Event", ev.Name+"事件", e.OutputData)
+		f.Events = append(f.Events, ev)
+	}
+
+	methods := map[string]bool{"SetProperties": true}
+	for i := range thing.Services {
+		s := &thing.Services[i]
+		if s.Identifier == tsl.IdentifierPropertySet || s.Identifier == tsl.IdentifierPropertyGet {
+			continue
+		}
+		name := goName(s.Identifier)
+		sv := serviceDef{
+			Const:      g.unique("Service" + name),
+			Identifier: s.Identifier,
+			Name:       oneLine(s.Name),
+			Method:     uniqueName(methods, name),
+		}
+		sv.Request = g.paramsType(name+"Request", sv.Name+"服务请求参数", s.InputData)
+		sv.Response = g.paramsType(name+"Response", sv.Name+"服务应答数据", s.OutputData)
+		f.Services = append(f.Services, sv)
+	}
+	f.Types = g.types
+
+	f.Imports = []string{`"encoding/json"`, `"strings"`, "", `aiot "github.com/thinkgos/aliyun-iot"`}
+	if f.HasWritable {
+		f.Imports = append(f.Imports, `"github.com/thinkgos/aliyun-iot/uri"`)
+	}
+
+	buf := bytes.Buffer{}
+	if err := fileTemplate.Execute(&buf, f); err != nil {
+		return nil, err
+	}
+	out, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("format source, %w", err)
+	}
+	return out, nil
+}
+
+// unique 生成包级别唯一的名称
+func (sf *generator) unique(name string) string {
+	return uniqueName(sf.names, name)
+}
+
+// paramsType 生成参数结构体类型, 返回类型名
+func (sf *generator) paramsType(name, comment string, params []tsl.Param) string {
+	name = sf.unique(name)
+	idx := len(sf.types)
+	sf.types = append(sf.types, typeDef{Name: name, Comment: comment})
+
+	var fields []field
+	fieldNames := make(map[string]bool)
+	for i := range params {
+		p := &params[i]
+		fname := uniqueName(fieldNames, goName(p.Identifier))
+		fields = append(fields, field{
+			fname,
+			sf.goType(name+fname, p.Name, &p.DataType),
+			jsonTag(p.Identifier, false),
+			describe(p.Name, &p.DataType),
+		})
+	}
+	sf.types[idx].Fields = fields
+	return name
+}
+
+// goType 数据类型对应的go类型, 结构体将生成新的类型
+func (sf *generator) goType(name, desc string, dt *tsl.DataType) string {
+	switch dt.Type {
+	case tsl.TypeInt, tsl.TypeEnum, tsl.TypeBool:
+		return "int32"
+	case tsl.TypeFloat:
+		return "float32"
+	case tsl.TypeDouble:
+		return "float64"
+	case tsl.TypeText, tsl.TypeDate:
+		return "string"
+	case tsl.TypeStruct:
+		return sf.paramsType(name+"Struct", oneLine(desc)+"结构体", dt.Struct)
+	case tsl.TypeArray:
+		if dt.Array == nil {
+			return "[]json.RawMessage"
+		}
+		return "[]" + sf.goType(name+"Item", desc, &dt.Array.Item)
+	default:
+		return "json.RawMessage"
+	}
+}
+
+// describe 生成字段的注释
+func describe(name string, dt *tsl.DataType) string {
+	s := []string{oneLine(name), dt.Type}
+	if n := dt.Number; n != nil {
+		if n.Min != nil && n.Max != nil {
+			s = append(s, fmt.Sprintf("范围[%v, %v]", *n.Min, *n.Max))
+		}
+		if n.Step != nil {
+			s = append(s, fmt.Sprintf("步长%v", *n.Step))
+		}
+		if n.Unit != "" {
+			s = append(s, "单位"+n.Unit)
+		}
+	}
+	if len(dt.Enum) > 0 {
+		keys := make([]int, 0, len(dt.Enum))
+		for k := range dt.Enum {
+			if v, err := strconv.Atoi(k); err == nil {
+				keys = append(keys, v)
+			}
+		}
+		sort.Ints(keys)
+		enums := make([]string, 0, len(keys))
+		for _, k := range keys {
+			enums = append(enums, fmt.Sprintf("%d:%s", k, dt.Enum[strconv.Itoa(k)]))
+		}
+		s = append(s, strings.Join(enums, " "))
+	}
+	if dt.Text != nil && dt.Text.Length > 0 {
+		s = append(s, fmt.Sprintf("长度%d", dt.Text.Length))
+	}
+	if dt.Array != nil && dt.Array.Size > 0 {
+		s = append(s, fmt.Sprintf("元素个数%d", dt.Array.Size))
+	}
+	return strings.Join(s, ", ")
+}
+
+// oneLine 去除换行,用于生成注释
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func jsonTag(identifier string, omitempty bool) string {
+	if omitempty {
+		return "`json:\"" + identifier + ",omitempty\"`"
+	}
+	return "`json:\"" + identifier + "\"`"
+}
+
+// goName 标识符转换为导出的go名称, 如 cpu_usage --> CpuUsage
+func goName(identifier string) string {
+	b := strings.Builder{}
+	upper := true
+	for _, r := range identifier {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	name := b.String()
+	if name == "" || !unicode.IsUpper([]rune(name)[0]) {
+		name = "X" + name
+	}
+	return name
+}
+
+// uniqueName 名称已存在时增加数字后缀
+func uniqueName(names map[string]bool, name string) string {
+	s := name
+	for i := 2; names[s]; i++ {
+		s = name + strconv.Itoa(i)
+	}
+	names[s] = true
+	return s
+}
+
+var fileTemplate = template.Must(template.New("file").Parse(`// Code generated by aiot-tslgen. DO NOT EDIT.
+// productKey: {{.ProductKey}}{{if .Version}}, version: {{.Version}}{{end}}
+
+package {{.Package}}
+
+import (
+{{- range .Imports}}
+	{{.}}
+{{- end}}
+)
+
+// ProductKey 产品key
+const ProductKey = {{printf "%q" .ProductKey}}
+{{if .Events}}
+// 事件标识符
+const (
+{{- range .Events}}
+	{{.Const}} = {{printf "%q" .Identifier}} // {{.Name}}
+{{- end}}
+)
+{{end}}
+{{- if .Services}}
+// 服务标识符
+const (
+{{- range .Services}}
+	{{.Const}} = {{printf "%q" .Identifier}} // {{.Name}}
+{{- end}}
+)
+{{end}}
+// {{.Properties.Name}} {{.Properties.Comment}}, 字段为nil表示不上报或未设置
+type {{.Properties.Name}} struct {
+{{- range .Properties.Fields}}
+	{{.Name}} {{.Type}} {{.Tag}} // {{.Comment}}
+{{- end}}
+}
+{{range .Types}}
+// {{.Name}} {{.Comment}}
+type {{.Name}} struct {
+{{- range .Fields}}
+	{{.Name}} {{.Type}} {{.Tag}} // {{.Comment}}
+{{- end}}
+}
+{{end}}
+// {{.PostFunc}} 上报属性
+func {{.PostFunc}}(c *aiot.Client, pk, dn string, props *Properties) (*aiot.Token, error) {
+	return c.ThingEventPropertyPost(pk, dn, props)
+}
+{{range .Events}}
+// {{.Func}} 上报{{.Name}}事件
+func {{.Func}}(c *aiot.Client, pk, dn string, params *{{.Type}}) (*aiot.Token, error) {
+	return c.ThingEventPost(pk, dn, {{.Const}}, params)
+}
+{{end}}
+// Handler 服务处理接口,返回的错误按 aiot.NewServiceResponse 生成应答
+type Handler interface {
+{{- if .HasWritable}}
+	// SetProperties 设置属性,仅包含下发的属性
+	SetProperties(c *aiot.Client, pk, dn string, props *Properties) error
+{{- end}}
+{{- range .Services}}
+	// {{.Method}} {{.Name}}
+	{{.Method}}(c *aiot.Client, pk, dn string, req *{{.Request}}) (*{{.Response}}, error)
+{{- end}}
+}
+
+// Callback 将 Handler 适配为 aiot.Callback, 服务调用(含同步服务的RRPC调用)解码后交给 Handler 处理并自动回复,
+// 未定义的服务及其它事件交由内嵌的 aiot.Callback 处理
+type Callback struct {
+	aiot.Callback
+	Handler Handler
+}
+
+// NewCallback 新建回调适配, cb为nil时使用 aiot.NopCb
+func NewCallback(h Handler, cb aiot.Callback) *Callback {
+	if cb == nil {
+		cb = aiot.NopCb{}
+	}
+	return &Callback{cb, h}
+}
+{{if .HasWritable}}
+// ThingServicePropertySet see interface aiot.Callback
+func (sf *Callback) ThingServicePropertySet(c *aiot.Client, pk, dn string, payload []byte) error {
+	_uri := uri.URI(uri.SysPrefix, uri.ThingServicePropertySetReply, pk, dn)
+	req := aiot.Request{Params: &Properties{}}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return c.Response(_uri, aiot.NewServiceResponse(aiot.ServiceRequestID(payload), nil, aiot.ErrInvalidParameter))
+	}
+	err := sf.Handler.SetProperties(c, pk, dn, req.Params.(*Properties))
+	return c.Response(_uri, aiot.NewServiceResponse(req.ID, nil, err))
+}
+{{end}}
+// ThingServiceRequest see interface aiot.Callback
+func (sf *Callback) ThingServiceRequest(c *aiot.Client, srvID, pk, dn string, payload []byte) error {
+	rsp, handled, err := sf.serve(c, srvID, pk, dn, payload)
+	if !handled {
+		return sf.Callback.ThingServiceRequest(c, srvID, pk, dn, payload)
+	}
+	if err != nil {
+		return err
+	}
+	return c.ThingServiceResponse(pk, dn, srvID, rsp)
+}
+
+// RRPCRequest see interface aiot.Callback
+func (sf *Callback) RRPCRequest(c *aiot.Client, messageID, pk, dn string, payload []byte) error {
+	req := aiot.Request{}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return err
+	}
+	srvID := strings.TrimPrefix(req.Method, "thing.service.")
+	rsp, handled, err := sf.serve(c, srvID, pk, dn, payload)
+	if !handled {
+		return sf.Callback.RRPCRequest(c, messageID, pk, dn, payload)
+	}
+	if err != nil {
+		return err
+	}
+	return c.RRPCResponse(pk, dn, messageID, rsp)
+}
+
+// serve 处理服务调用,未定义的服务 handled 为 false, 请求解码失败时回复参数错误
+func (sf *Callback) serve(c *aiot.Client, srvID, pk, dn string, payload []byte) (rsp aiot.Response, handled bool, err error) {
+	switch srvID {
+{{- range .Services}}
+	case {{.Const}}:
+		req := aiot.Request{Params: &{{.Request}}{}}
+		if err = json.Unmarshal(payload, &req); err != nil {
+			return aiot.NewServiceResponse(aiot.ServiceRequestID(payload), nil, aiot.ErrInvalidParameter), true, nil
+		}
+		out, e := sf.Handler.{{.Method}}(c, pk, dn, req.Params.(*{{.Request}}))
+		var data interface{}
+		if out != nil {
+			data = out
+		}
+		return aiot.NewServiceResponse(req.ID, data, e), true, nil
+{{- end}}
+	}
+	return rsp, false, nil
+}
+`))
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thinkgos/aliyun-iot/tsl"
+)
+
+func TestGoName(t *testing.T) {
+	assert.Equal(t, "CpuUsage", goName("cpu_usage"))
+	assert.Equal(t, "CurrentTemperature", goName("CurrentTemperature"))
+	assert.Equal(t, "X1switch", goName("1switch"))
+	assert.Equal(t, "X", goName("_"))
+}
+
+func TestUniqueName(t *testing.T) {
+	names := map[string]bool{}
+	assert.Equal(t, "A", uniqueName(names, "A"))
+	assert.Equal(t, "A2", uniqueName(names, "A"))
+	assert.Equal(t, "A3", uniqueName(names, "A"))
+}
+
+func TestGenerate(t *testing.T) {
+	thing, err := tsl.LoadFile("../../tsl/testdata/thing.json")
+	require.NoError(t, err)
+
+	out, err := Generate(thing, "model")
+	require.NoError(t, err)
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "thing_gen.go", out, parser.ParseComments)
+	require.NoError(t, err)
+
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	pkg, err := conf.Check("model", fset, []*ast.File{file}, nil)
+	require.NoError(t, err)
+
+	scope := pkg.Scope()
+	for _, name := range []string{
+		"ProductKey", "EventError", "ServiceReboot",
+		"Properties", "LocationStruct", "ErrorEvent", "RebootRequest", "RebootResponse",
+		"PostProperties", "PostErrorEvent", "Handler", "Callback", "NewCallback",
+	} {
+		assert.NotNil(t, scope.Lookup(name), name)
+	}
+
+	handler := scope.Lookup("Handler").Type().Underlying().(*types.Interface)
+	assert.Equal(t, 2, handler.NumMethods())
+
+	// 请求解码失败时回复参数错误, 不直接返回错误
+	serve := funcSource(t, fset, file, out, "serve")
+	assert.Contains(t, serve, "aiot.NewServiceResponse(aiot.ServiceRequestID(payload), nil, aiot.ErrInvalidParameter), true, nil")
+	assert.NotContains(t, serve, "return rsp, true, err")
+	assert.Contains(t, funcSource(t, fset, file, out, "ThingServicePropertySet"),
+		"c.Response(_uri, aiot.NewServiceResponse(aiot.ServiceRequestID(payload), nil, aiot.ErrInvalidParameter))")
+
+	aiotPkg := importPackage(t, conf.Importer, "github.com/thinkgos/aliyun-iot")
+	cb := aiotPkg.Scope().Lookup("Callback").Type().Underlying().(*types.Interface)
+	assert.True(t, types.Implements(types.NewPointer(scope.Lookup("Callback").Type()), cb))
+}
+
+func TestGenerate_Minimal(t *testing.T) {
+	thing, err := tsl.Parse([]byte(`{"profile":{"productKey":"pk"},"properties":[{"identifier":"a-b","accessMode":"r","dataType":{"type":"int"}}]}`))
+	require.NoError(t, err)
+
+	out, err := Generate(thing, "model")
+	require.NoError(t, err)
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "thing_gen.go", out, 0)
+	require.NoError(t, err)
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	pkg, err := conf.Check("model", fset, []*ast.File{file}, nil)
+	require.NoError(t, err)
+
+	handler := pkg.Scope().Lookup("Handler").Type().Underlying().(*types.Interface)
+	assert.Equal(t, 0, handler.NumMethods())
+	st := pkg.Scope().Lookup("Properties").Type().Underlying().(*types.Struct)
+	assert.Equal(t, "AB", st.Field(0).Name())
+}
+
+// funcSource 生成代码中指定函数的源码
+func funcSource(t *testing.T, fset *token.FileSet, file *ast.File, src []byte, name string) string {
+	for _, decl := range file.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Name.Name == name {
+			return string(src[fset.Position(fn.Pos()).Offset:fset.Position(fn.End()).Offset])
+		}
+	}
+	t.Fatalf("func %s not found", name)
+	return ""
+}
+
+func importPackage(t *testing.T, imp types.Importer, path string) *types.Package {
+	pkg, err := imp.Import(path)
+	require.NoError(t, err)
+	return pkg
+}
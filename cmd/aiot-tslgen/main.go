@@ -0,0 +1,136 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+// aiot-tslgen 根据物模型(TSL)生成设备端go代码,
+// 包括属性,事件结构体,服务请求及应答结构体, 服务处理接口 Handler 及适配 aiot.Callback 的 Callback.
+//
+// 从本地文件生成:
+//
+//	aiot-tslgen -f thing.json -pkg model -o model/thing_gen.go
+//
+// 从云端获取设备的TSL模板生成:
+//
+//	aiot-tslgen -pk a1QR3GD1Db3 -dn mydevice -ds xxx -pkg model -o model/thing_gen.go
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	aiot "github.com/thinkgos/aliyun-iot"
+	"github.com/thinkgos/aliyun-iot/infra"
+	"github.com/thinkgos/aliyun-iot/sign"
+	"github.com/thinkgos/aliyun-iot/tsl"
+)
+
+var regions = map[string]infra.CloudRegion{
+	"shanghai":  infra.CloudRegionShangHai,
+	"singapore": infra.CloudRegionSingapore,
+	"japan":     infra.CloudRegionJapan,
+	"america":   infra.CloudRegionAmerica,
+	"germany":   infra.CloudRegionGermany,
+}
+
+func main() {
+	var (
+		file    = flag.String("f", "", "TSL json file")
+		pkg     = flag.String("pkg", "model", "generated package name")
+		output  = flag.String("o", "", "output file, default stdout")
+		pk      = flag.String("pk", "", "product key, fetch TSL from cloud when -f is empty")
+		dn      = flag.String("dn", "", "device name")
+		ds      = flag.String("ds", "", "device secret")
+		region  = flag.String("region", "shanghai", "cloud region: shanghai, singapore, japan, america, germany")
+		domain  = flag.String("domain", "", "custom domain address:port, override -region")
+		dump    = flag.String("dump", "", "save the fetched TSL json to file")
+		timeout = flag.Duration("timeout", 10*time.Second, "fetch timeout")
+	)
+	flag.Parse()
+
+	thing, err := load(*file, *pk, *dn, *ds, *region, *domain, *dump, *timeout)
+	if err != nil {
+		fatal(err)
+	}
+	out, err := Generate(thing, *pkg)
+	if err != nil {
+		fatal(err)
+	}
+	if *output == "" {
+		_, err = os.Stdout.Write(out)
+	} else {
+		err = ioutil.WriteFile(*output, out, 0644)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func load(file, pk, dn, ds, region, domain, dump string, timeout time.Duration) (*tsl.Thing, error) {
+	if file != "" {
+		return tsl.LoadFile(file)
+	}
+	if pk == "" || dn == "" || ds == "" {
+		return nil, errors.New("either -f or -pk, -dn, -ds required")
+	}
+
+	crd := infra.CloudRegionDomain{Region: infra.CloudRegionCustom, CustomDomain: domain}
+	if domain == "" {
+		r, ok := regions[strings.ToLower(region)]
+		if !ok {
+			return nil, fmt.Errorf("unknown region %q", region)
+		}
+		crd = infra.CloudRegionDomain{Region: r}
+	}
+	data, err := fetch(infra.MetaTriad{ProductKey: pk, DeviceName: dn, DeviceSecret: ds}, crd, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if dump != "" {
+		if err = ioutil.WriteFile(dump, data, 0644); err != nil {
+			return nil, err
+		}
+	}
+	return tsl.Parse(data)
+}
+
+// fetch 通过mqtt连接获取设备的TSL模板
+func fetch(triad infra.MetaTriad, crd infra.CloudRegionDomain, timeout time.Duration) ([]byte, error) {
+	signs, err := sign.Generate(triad, crd, sign.WithTimestamp())
+	if err != nil {
+		return nil, err
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(signs.Addr).
+		SetClientID(signs.ClientIDWithExt()).
+		SetUsername(signs.UserName).
+		SetPassword(signs.Password).
+		SetCleanSession(true)
+	mqc := mqtt.NewClient(opts)
+	if token := mqc.Connect(); !token.WaitTimeout(timeout) {
+		return nil, errors.New("mqtt connect timeout")
+	} else if token.Error() != nil {
+		return nil, token.Error()
+	}
+
+	client := aiot.NewWithMQTT(triad, mqc)
+	defer client.Close()
+	if err = client.Connect(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return client.LinkThingDsltemplateGetContext(ctx, triad.ProductKey, triad.DeviceName)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "aiot-tslgen:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,199 @@
+package aiot
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+)
+
+var errFakeOffline = errors.New("fake conn offline")
+
+// fakeReply 构造请求的应答, ok为false表示不应答
+type fakeReply func(topic string, req fakeRequest) (rsp Response, ok bool)
+
+type fakeRequest struct {
+	ID     uint            `json:"id,string"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type fakePublish struct {
+	topic   string
+	payload []byte
+}
+
+// fakeConn 模拟MQTT连接, 请求经reply构造应答后, 异步投递到订阅了 {topic}_reply 的回调
+type fakeConn struct {
+	mu        sync.Mutex
+	c         *Client
+	offline   bool
+	onPublish func(topic string) // 发布前调用
+	reply     fakeReply
+	subs      map[string]ProcDownStream
+	published []fakePublish
+	trace     []string // 按序记录的订阅(sub)及发布(pub)主题
+}
+
+func newFakeConn(reply fakeReply) *fakeConn {
+	return &fakeConn{reply: reply, subs: make(map[string]ProcDownStream)}
+}
+
+// newFakeClient 新建使用fakeConn的客户端并订阅所有主题
+func newFakeClient(reply fakeReply, opts ...Option) (*Client, *fakeConn) {
+	conn := newFakeConn(reply)
+	c := New(infra.MetaTriad{ProductKey: "pk", DeviceName: "dn", DeviceSecret: "ds"}, conn, opts...)
+	conn.mu.Lock()
+	conn.c = c
+	conn.mu.Unlock()
+	_ = c.SubscribeAllTopic("pk", "dn", false)
+	return c, conn
+}
+
+func (sf *fakeConn) Publish(topic string, _ byte, payload interface{}) error {
+	var b []byte
+	switch v := payload.(type) {
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		var err error
+		if b, err = json.Marshal(v); err != nil {
+			return err
+		}
+	}
+
+	sf.mu.Lock()
+	if sf.offline {
+		sf.mu.Unlock()
+		return errFakeOffline
+	}
+	onPublish := sf.onPublish
+	sf.mu.Unlock()
+	if onPublish != nil {
+		onPublish(topic)
+	}
+
+	sf.mu.Lock()
+	sf.published = append(sf.published, fakePublish{topic, b})
+	sf.trace = append(sf.trace, "pub "+topic)
+	c, reply, cb := sf.c, sf.reply, sf.lookupLocked(topic+"_reply")
+	sf.mu.Unlock()
+
+	if reply == nil || cb == nil || strings.HasSuffix(topic, "_reply") {
+		return nil
+	}
+	req := fakeRequest{}
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil
+	}
+	rsp, ok := reply(topic, req)
+	if !ok {
+		return nil
+	}
+	out, err := json.Marshal(rsp)
+	if err != nil {
+		return err
+	}
+	go cb(c, topic+"_reply", out) // nolint: errcheck
+	return nil
+}
+
+func (sf *fakeConn) Subscribe(topic string, callback ProcDownStream) error {
+	sf.mu.Lock()
+	sf.subs[topic] = callback
+	sf.trace = append(sf.trace, "sub "+topic)
+	sf.mu.Unlock()
+	return nil
+}
+
+func (sf *fakeConn) UnSubscribe(topic ...string) error {
+	sf.mu.Lock()
+	for _, t := range topic {
+		delete(sf.subs, t)
+	}
+	sf.mu.Unlock()
+	return nil
+}
+
+func (sf *fakeConn) Close() error { return nil }
+
+func (sf *fakeConn) setOnPublish(f func(topic string)) {
+	sf.mu.Lock()
+	sf.onPublish = f
+	sf.mu.Unlock()
+}
+
+func (sf *fakeConn) setOffline(offline bool) {
+	sf.mu.Lock()
+	sf.offline = offline
+	sf.mu.Unlock()
+}
+
+// cleanSession 模拟以clean session重连, 丢失所有订阅并清空记录
+func (sf *fakeConn) cleanSession() {
+	sf.mu.Lock()
+	sf.subs = make(map[string]ProcDownStream)
+	sf.trace = nil
+	sf.mu.Unlock()
+}
+
+// takeTrace 取出按序记录的订阅及发布
+func (sf *fakeConn) takeTrace() []string {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	trace := sf.trace
+	sf.trace = nil
+	return trace
+}
+
+// deliver 投递一条下行消息到订阅回调
+func (sf *fakeConn) deliver(topic string, payload []byte) error {
+	sf.mu.Lock()
+	c, cb := sf.c, sf.lookupLocked(topic)
+	sf.mu.Unlock()
+	if cb == nil {
+		return errors.New("topic not subscribed: " + topic)
+	}
+	return cb(c, topic, payload)
+}
+
+// lookupLocked 查找匹配主题的订阅回调, 支持 + 及 # 通配符
+func (sf *fakeConn) lookupLocked(topic string) ProcDownStream {
+	if cb, ok := sf.subs[topic]; ok {
+		return cb
+	}
+	for filter, cb := range sf.subs {
+		if topicMatch(filter, topic) {
+			return cb
+		}
+	}
+	return nil
+}
+
+func topicMatch(filter, topic string) bool {
+	fs, ts := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) || (f != "+" && f != ts[i]) {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+// topics 已发布消息的主题
+func (sf *fakeConn) topics() []string {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	ts := make([]string, 0, len(sf.published))
+	for _, p := range sf.published {
+		ts = append(ts, p.topic)
+	}
+	return ts
+}
@@ -6,6 +6,10 @@ package aiot
 
 import (
 	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/thinkgos/aliyun-iot/infra"
 )
 
 // 错误相关定义
@@ -20,4 +24,68 @@ var (
 	ErrNotPermit         = errors.New("not permit")
 	ErrNotActive         = errors.New("device not active")
 	ErrNotAvail          = errors.New("device not avail")
+	ErrConnClosed        = errors.New("connection closed")
+	ErrConnLost          = errors.New("connection lost")
+	ErrRequestIDInUse    = errors.New("request id in use")
+)
+
+// 属性存储相关错误,将以 infra.CodeRequestParamsError 回复
+var (
+	ErrPropertyNotFound = infra.NewCodeError(infra.CodeRequestParamsError, "property not found")
+	ErrPropertyReadOnly = infra.NewCodeError(infra.CodeRequestParamsError, "property read only")
+	ErrPropertyNoGetter = infra.NewCodeError(infra.CodeRequestParamsError, "property not readable")
+)
+
+// OTA相关错误
+var (
+	ErrOtaVerifyFailed    = errors.New("ota firmware verify failed")
+	ErrOtaSignMethod      = errors.New("ota unsupported sign method")
+	ErrOtaNoPatcher       = errors.New("ota diff firmware without patcher")
+	ErrOtaImageUnverified = errors.New("ota diff image without digest or verifier")
+	ErrOtaNoFlasher       = errors.New("ota sub device without flasher")
+	ErrFileBlockCorrupt   = errors.New("file block corrupt")
+	ErrConfigVerifyFailed = errors.New("config verify failed")
+	ErrDesiredConflict    = errors.New("desired property version conflict")
 )
+
+// DevStoreError 子设备信息保存到 DevStore 失败, 内存中的变更已生效, 下次变更或调用 DevMgr.Save 时重新保存
+type DevStoreError struct {
+	Err error
+}
+
+// Error 实现error接口
+func (sf *DevStoreError) Error() string {
+	return "save sub device store, " + sf.Err.Error()
+}
+
+// Unwrap 返回保存的错误
+func (sf *DevStoreError) Unwrap() error { return sf.Err }
+
+// ChunkError 分批请求中单个批次的错误
+type ChunkError struct {
+	Index int // 批次序号,从0开始
+	Err   error
+}
+
+// BatchError 分批请求的聚合错误
+type BatchError struct {
+	Total  int // 总批次数
+	Failed []ChunkError
+}
+
+// Error 实现error接口
+func (sf *BatchError) Error() string {
+	s := make([]string, 0, len(sf.Failed))
+	for _, f := range sf.Failed {
+		s = append(s, fmt.Sprintf("#%d: %v", f.Index, f.Err))
+	}
+	return fmt.Sprintf("%d/%d chunks failed, %s", len(sf.Failed), sf.Total, strings.Join(s, "; "))
+}
+
+// Unwrap 返回首个失败批次的错误
+func (sf *BatchError) Unwrap() error {
+	if len(sf.Failed) == 0 {
+		return nil
+	}
+	return sf.Failed[0].Err
+}
@@ -5,7 +5,9 @@
 package aiot
 
 import (
+	"context"
 	"encoding/json"
+	"strconv"
 
 	"github.com/thinkgos/aliyun-iot/infra"
 	uri "github.com/thinkgos/aliyun-iot/uri"
@@ -75,14 +77,27 @@ func (sf *Client) OtaProgress(pk, dn string, params OtaProgressParams) error {
 	}
 	sf.Log.Debugf("ota.device.process @%d", id)
 	_uri := uri.URI(uri.OtaDeviceProcessPrefix, "", pk, dn)
-	return sf.Publish(_uri, 1, req)
+	_, err = sf.publish(_uri, 1, 0, req)
+	return err
 }
 
+// OtaProtocolMQTT 固件通过MQTT下载
+const OtaProtocolMQTT = "mqtt"
+
 // OtaFirmwareParam 请求固件信息参数域
 type OtaFirmwareParam struct {
 	Module string `json:"module"`
 }
 
+// OtaFile 多文件升级包中的文件
+type OtaFile struct {
+	Name string `json:"fileName"`
+	Size int64  `json:"fileSize"`
+	URL  string `json:"fileUrl"`
+	MD5  string `json:"fileMd5"`
+	Sign string `json:"fileSign"` // 文件签名, 签名方法同 OtaFirmwareData.SignMethod
+}
+
 // OtaFirmwareData 请求固件信息回复数据域
 type OtaFirmwareData struct {
 	Size       int64  `json:"size"`
@@ -93,6 +108,16 @@ type OtaFirmwareData struct {
 	SignMethod string `json:"signMethod"`
 	MD5        string `json:"md5"`
 	Module     string `json:"module"`
+	// 通过MQTT下载时有效, DProtocol 为 OtaProtocolMQTT
+	DProtocol    string `json:"dProtocol,omitempty"`
+	StreamID     int64  `json:"streamId,omitempty"`
+	StreamFileID int    `json:"streamFileId,omitempty"`
+	// 多文件升级包时有效, 此时 Size,URL,MD5,Sign 为空
+	Files []OtaFile `json:"files,omitempty"`
+	// 升级包的自定义推送信息
+	ExtData map[string]interface{} `json:"extData,omitempty"`
+	// 升级包的摘要签名, 需配置 DigestVerifier 校验
+	DigestSign string `json:"digestsign,omitempty"`
 }
 
 // OtaFirmwareResponse ota firmware response
@@ -103,11 +128,45 @@ type OtaFirmwareResponse struct {
 	Message string          `json:"message"`
 }
 
+// UnmarshalJSON 实现 json.Unmarshaler 接口, 平台推送的升级id及code可能为数值或字符串
+func (sf *OtaFirmwareResponse) UnmarshalJSON(b []byte) error {
+	rsp := struct {
+		ID      json.Number     `json:"id"`
+		Code    json.Number     `json:"code"`
+		Data    OtaFirmwareData `json:"data"`
+		Message string          `json:"message"`
+	}{}
+	if err := json.Unmarshal(b, &rsp); err != nil {
+		return err
+	}
+	if rsp.ID != "" {
+		id, err := strconv.ParseUint(rsp.ID.String(), 10, 0)
+		if err != nil {
+			return err
+		}
+		sf.ID = uint(id)
+	}
+	if rsp.Code != "" {
+		code, err := strconv.Atoi(rsp.Code.String())
+		if err != nil {
+			return err
+		}
+		sf.Code = code
+	}
+	sf.Data, sf.Message = rsp.Data, rsp.Message
+	return nil
+}
+
 // ThingOtaFirmwareGet 请求固件信息
 // module: 不指定则表示请求默认（default）模块的固件信息
 // request： /sys/{productKey}/{deviceName}/thing/ota/firmware/get
 // response：/sys/{productKey}/{deviceName}/thing/ota/firmware/get_reply
 func (sf *Client) ThingOtaFirmwareGet(pk, dn string, param OtaFirmwareParam) (*Token, error) {
+	return sf.ThingOtaFirmwareGetContext(context.Background(), pk, dn, param)
+}
+
+// ThingOtaFirmwareGetContext 同 ThingOtaFirmwareGet, 带ctx
+func (sf *Client) ThingOtaFirmwareGetContext(ctx context.Context, pk, dn string, param OtaFirmwareParam) (*Token, error) {
 	if !sf.hasOTA {
 		return nil, ErrNotSupportFeature
 	}
@@ -115,7 +174,7 @@ func (sf *Client) ThingOtaFirmwareGet(pk, dn string, param OtaFirmwareParam) (*T
 		return nil, ErrNotActive
 	}
 	_uri := uri.URI(uri.SysPrefix, uri.ThingOtaFirmwareGet, pk, dn)
-	return sf.SendRequest(_uri, infra.MethodOtaFirmwareGet, param)
+	return sf.SendRequestContext(ctx, _uri, infra.MethodOtaFirmwareGet, param)
 }
 
 // ProcThingOtaFirmwareGetReply 处理请求固件信息应答
@@ -156,5 +215,16 @@ func ProcOtaUpgrade(c *Client, rawURI string, payload []byte) error {
 	}
 	c.Log.Debugf("thing.device.upgrade")
 	pk, dn := uris[3], uris[4]
+	if c.modules != nil {
+		if h, ok := c.modules.Lookup(pk, dn, rsp.Data.Module); ok {
+			return h(c, pk, dn, rsp.Data)
+		}
+	}
+	if c.gwOta != nil && (pk != c.tetrad.ProductKey || dn != c.tetrad.DeviceName) {
+		return c.gwOta.HandleUpgrade(c, pk, dn, rsp.Data)
+	}
+	if c.ota != nil {
+		return c.ota.HandleUpgrade(c, pk, dn, rsp.Data)
+	}
 	return c.cb.OtaUpgrade(c, pk, dn, rsp)
 }
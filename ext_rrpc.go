@@ -39,6 +39,14 @@ func ProcRRPCRequest(c *Client, rawURI string, payload []byte) error {
 	pk, dn := uris[1], uris[2]
 	messageID := uris[5]
 	c.Log.Debugf("rrpc.request.%s", messageID)
+	if handled, err := c.serveRRPCProperty(messageID, pk, dn, payload); handled {
+		return err
+	}
+	if c.router != nil {
+		if handled, err := c.serveRRPCService(messageID, pk, dn, payload); handled {
+			return err
+		}
+	}
 	return c.cb.RRPCRequest(c, messageID, pk, dn, payload)
 }
 
@@ -5,6 +5,7 @@
 package aiot
 
 import (
+	"context"
 	"encoding/json"
 	"time"
 
@@ -55,7 +56,7 @@ type CombineLoginResponse struct {
 // 	如果取值是false，则不清理子设备离线时的消息
 // request： /ext/session/${productKey}/${deviceName}/combine/login
 // response：/ext/session/${productKey}/${deviceName}/combine/login_reply
-func (sf *Client) extCombineLogin(cp CombinePair) (*Token, error) {
+func (sf *Client) extCombineLogin(ctx context.Context, cp CombinePair) (*Token, error) {
 	if !sf.isGateway {
 		return nil, ErrNotSupportFeature
 	}
@@ -91,12 +92,8 @@ func (sf *Client) extCombineLogin(cp CombinePair) (*Token, error) {
 		return nil, err
 	}
 	_uri := sf.URIGateway(uri.ExtSessionPrefix, uri.CombineLogin)
-	err = sf.Publish(_uri, 0, req)
-	if err != nil {
-		return nil, err
-	}
 	sf.Log.Debugf("ext.session.combine.login @%d", id)
-	return sf.putPending(id), nil
+	return sf.sendPending(ctx, _uri, 0, id, req)
 }
 
 // CombineBatchLoginParams 子设备上线请求参数域
@@ -116,7 +113,7 @@ type CombineBatchLoginResponse struct {
 // NOTE: topic 应使用网关的productKey和deviceName,且只支持qos = 0
 // request： /ext/session/${productKey}/${deviceName}/combine/batch_login
 // response：/ext/session/${productKey}/${deviceName}/combine/batch_login_reply
-func (sf *Client) extCombineBatchLogin(pairs []CombinePair) (*Token, error) {
+func (sf *Client) extCombineBatchLogin(ctx context.Context, pairs []CombinePair) (*Token, error) {
 	if !sf.isGateway {
 		return nil, ErrNotSupportFeature
 	}
@@ -158,12 +155,8 @@ func (sf *Client) extCombineBatchLogin(pairs []CombinePair) (*Token, error) {
 		return nil, err
 	}
 	_uri := sf.URIGateway(uri.ExtSessionPrefix, uri.CombineBatchLogin)
-	err = sf.Publish(_uri, 0, req)
-	if err != nil {
-		return nil, err
-	}
 	sf.Log.Debugf("ext.session.combine.batch.login @%d", id)
-	return sf.putPending(id), nil
+	return sf.sendPending(ctx, _uri, 0, id, req)
 }
 
 // CombineLogoutResponse 子设备上线回复
@@ -178,7 +171,7 @@ type CombineLogoutResponse struct {
 // NOTE: topic 应使用网关的productKey和deviceName,且只支持qos = 0
 // request:   /ext/session/{productKey}/{deviceName}/combine/logout
 // response:  /ext/session/{productKey}/{deviceName}/combine/logout_reply
-func (sf *Client) extCombineLogout(pk, dn string) (*Token, error) {
+func (sf *Client) extCombineLogout(ctx context.Context, pk, dn string) (*Token, error) {
 	if !sf.isGateway {
 		return nil, ErrNotSupportFeature
 	}
@@ -195,12 +188,8 @@ func (sf *Client) extCombineLogout(pk, dn string) (*Token, error) {
 	}
 
 	_uri := sf.URIGateway(uri.ExtSessionPrefix, uri.CombineLogout)
-	err = sf.Publish(_uri, 0, req)
-	if err != nil {
-		return nil, err
-	}
 	sf.Log.Debugf("ext.session.combine.logout @%d", id)
-	return sf.putPending(id), nil
+	return sf.sendPending(ctx, _uri, 0, id, req)
 }
 
 // CombineBatchLogoutResponse 子设备批量下线回复
@@ -215,7 +204,7 @@ type CombineBatchLogoutResponse struct {
 // NOTE: topic 应使用网关的productKey和deviceName,且只支持qos = 0
 // request:   /ext/session/{productKey}/{deviceName}/combine/batch_logout
 // response:  /ext/session/{productKey}/{deviceName}/combine/batch_logout_reply
-func (sf *Client) extCombineBatchLogout(pairs []infra.MetaPair) (*Token, error) {
+func (sf *Client) extCombineBatchLogout(ctx context.Context, pairs []infra.MetaPair) (*Token, error) {
 	if !sf.isGateway {
 		return nil, ErrNotSupportFeature
 	}
@@ -235,12 +224,8 @@ func (sf *Client) extCombineBatchLogout(pairs []infra.MetaPair) (*Token, error)
 	}
 
 	_uri := sf.URIGateway(uri.ExtSessionPrefix, uri.CombineBatchLogout)
-	err = sf.Publish(_uri, 0, req)
-	if err != nil {
-		return nil, err
-	}
 	sf.Log.Debugf("ext.session.combine.batch.login @%d", id)
-	return sf.putPending(id), nil
+	return sf.sendPending(ctx, _uri, 0, id, req)
 }
 
 // ProcExtCombineLoginReply 处理子设备上线应答
@@ -5,7 +5,6 @@ go 1.15
 require (
 	github.com/eclipse/paho.mqtt.golang v1.3.1
 	github.com/go-ocf/go-coap v0.0.0-20200420092245-1fa077b7846f
-	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/pion/dtls/v2 v2.0.4 // indirect
 	github.com/pion/transport v0.12.2 // indirect
 	github.com/stretchr/testify v1.6.1
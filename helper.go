@@ -6,6 +6,11 @@ package aiot
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
 
 	"github.com/thinkgos/aliyun-iot/uri"
 )
@@ -20,3 +25,77 @@ func dupJSONRawMessage(d json.RawMessage) json.RawMessage {
 	copy(v, d)
 	return v
 }
+
+// writeFileAtomic 先写入临时文件并落盘,再重命名覆盖目标文件,最后同步所在目录,
+// 掉电时目标文件要么是旧内容,要么是完整的新内容
+func writeFileAtomic(path string, b []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp) // nolint: errcheck
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir 同步目录,使目录项(新建,重命名)落盘, windows不支持目录同步
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if e := d.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// jsonFile 以json格式保存的文件, 各json文件存储共用
+type jsonFile struct {
+	mu   sync.Mutex
+	path string
+}
+
+// load 读取并解码到v, 文件不存在时不修改v
+func (sf *jsonFile) load(v interface{}) error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	b, err := ioutil.ReadFile(sf.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// save 编码v并原子写入文件
+func (sf *jsonFile) save(v interface{}) error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(sf.path, b, 0600)
+}
@@ -27,6 +27,11 @@ const (
 	CodeTimeout                       = 100000
 )
 
+// 设备端自定义错误码, 设备回复平台下行请求时使用, 范围 100000 ~ 110000
+const (
+	CodeServiceNotFound = 100001 // 设备未实现该服务
+)
+
 // 数据解析公共错误码
 const (
 	CodeDpScriptEmpty          = 26001 // 执行数据解析时，获取的脚本内容为空
@@ -194,3 +199,8 @@ func (sf *CodeError) Error() string {
 func (sf *CodeError) Code() int {
 	return sf.code
 }
+
+// Message unwrap then got message
+func (sf *CodeError) Message() string {
+	return sf.message
+}
@@ -15,6 +15,7 @@ const (
 	MethodDesiredPropertyGet       = "thing.property.desired.get"
 	MethodDesiredPropertyDelete    = "thing.property.desired.delete"
 	MethodOtaFirmwareGet           = "thing.ota.firmware.get"
+	MethodFileDownload             = "thing.file.download"
 	MethodDslTemplateGet           = "thing.dsltemplate.get"
 	MethodDynamicTslGet            = "thing.dynamicTsl.get"
 	MethodConfigGet                = "thing.config.get"
@@ -28,6 +28,8 @@ type DevMgr struct {
 	root  DevNode // 网关设备节点或独立设备节点信息
 	rw    sync.RWMutex
 	nodes map[string]*DevNode
+	store DevStore // 子设备信息持久化存储,可为nil
+	dirty bool     // 上次保存失败,内存中的变更尚未保存
 }
 
 // DevNode 设备节点
@@ -74,14 +76,91 @@ func NewDevMgr(root infra.MetaTriad) *DevMgr {
 	}
 }
 
+// NewDevMgrWithStore 创建带持久化存储的设备管理,并从store中加载子设备信息,
+// 子设备的添加,删除,密钥,avail及状态变更都将保存到store中.
+// 重启后子设备会话已失效, 已登录或在线的子设备状态保存为 DevStatusAttached,
+// 这几个状态之间的变更不写入store.
+// 保存失败时返回 *DevStoreError, 内存中的变更保留, 下次变更或调用 Save 时重新保存.
+// 加载失败时仍返回可用的设备管理.
+func NewDevMgrWithStore(root infra.MetaTriad, store DevStore) (*DevMgr, error) {
+	sf := NewDevMgr(root)
+	sf.store = store
+	records, err := store.Load()
+	if err != nil {
+		return sf, err
+	}
+	for _, r := range records {
+		if r.ProductKey == "" || r.DeviceName == "" ||
+			(r.ProductKey == root.ProductKey && r.DeviceName == root.DeviceName) {
+			continue
+		}
+		sf.nodes[FormatKey(r.ProductKey, r.DeviceName)] = &DevNode{
+			r.ProductKey,
+			r.DeviceName,
+			r.DeviceSecret,
+			r.Avail,
+			storedStatus(r.Status),
+			nil,
+		}
+	}
+	return sf, nil
+}
+
+// saveLocked 保存所有子设备信息到store, 失败时标记待保存并返回 *DevStoreError
+func (sf *DevMgr) saveLocked() error {
+	if sf.store == nil {
+		return nil
+	}
+	records := make([]DevRecord, 0, len(sf.nodes))
+	for _, node := range sf.nodes {
+		records = append(records, DevRecord{
+			node.productKey,
+			node.deviceName,
+			node.deviceSecret,
+			node.avail,
+			storedStatus(node.status),
+		})
+	}
+	err := sf.store.Save(records)
+	sf.dirty = err != nil
+	if err != nil {
+		return &DevStoreError{err}
+	}
+	return nil
+}
+
+// Save 保存上次保存失败后尚未保存的变更, 无待保存的变更时返回nil
+func (sf *DevMgr) Save() error {
+	sf.rw.Lock()
+	defer sf.rw.Unlock()
+	if !sf.dirty {
+		return nil
+	}
+	return sf.saveLocked()
+}
+
+// storedStatus 保存到store的状态, 会话相关的状态保存为 DevStatusAttached
+func storedStatus(status DevStatus) DevStatus {
+	if status > DevStatusAttached {
+		return DevStatusAttached
+	}
+	return status
+}
+
+// isRoot 是否为root设备
+func (sf *DevMgr) isRoot(node *DevNode) bool {
+	return node == &sf.root
+}
+
 // Len 设备个数,含root设备
 func (sf *DevMgr) Len() int {
 	sf.rw.RLock()
-	defer sf.rw.Unlock()
+	defer sf.rw.RUnlock()
 	return len(sf.nodes) + 1
 }
 
-// Add 增加一个子设备,子设备处于 DevStatusUnauthorized
+// Add 增加一个子设备,子设备处于 DevStatusUnauthorized,
+// 返回 *DevStoreError 时设备已添加, 仅保存失败
 func (sf *DevMgr) Add(meta infra.MetaTriad) error {
 	if meta.ProductKey == "" || meta.DeviceName == "" {
 		return ErrInvalidParameter
@@ -105,14 +184,24 @@ func (sf *DevMgr) Add(meta infra.MetaTriad) error {
 		DevStatusUnauthorized,
 		nil,
 	}
-	return nil
+	return sf.saveLocked()
 }
 
-// Delete 删除一个子设备
+// Delete 删除一个子设备, 保存失败时可通过 Save 重新保存
 func (sf *DevMgr) Delete(pk, dn string) {
+	sf.remove(pk, dn) // nolint: errcheck
+}
+
+// remove 删除一个子设备, 返回保存的错误
+func (sf *DevMgr) remove(pk, dn string) error {
 	sf.rw.Lock()
 	defer sf.rw.Unlock()
-	delete(sf.nodes, FormatKey(pk, dn))
+	key := FormatKey(pk, dn)
+	if _, ok := sf.nodes[key]; ok {
+		delete(sf.nodes, key)
+		return sf.saveLocked()
+	}
+	return nil
 }
 
 func (sf *DevMgr) searchLocked(pk, dn string) (*DevNode, error) {
@@ -159,6 +248,19 @@ func (sf *DevMgr) Search(pk, dn string) (*DevNode, error) {
 	return sf.searchLocked(pk, dn)
 }
 
+// SearchSubDevices 查找所有处于指定状态且avail = true的子设备
+func (sf *DevMgr) SearchSubDevices(status DevStatus) []infra.MetaPair {
+	sf.rw.RLock()
+	defer sf.rw.RUnlock()
+	pairs := make([]infra.MetaPair, 0, len(sf.nodes))
+	for _, node := range sf.nodes {
+		if node.avail && node.status == status {
+			pairs = append(pairs, infra.MetaPair{ProductKey: node.productKey, DeviceName: node.deviceName})
+		}
+	}
+	return pairs
+}
+
 // SetDeviceSecret 设置设备的密钥
 func (sf *DevMgr) SetDeviceSecret(pk, dn, ds string) error {
 	sf.rw.Lock()
@@ -167,8 +269,14 @@ func (sf *DevMgr) SetDeviceSecret(pk, dn, ds string) error {
 	if err != nil {
 		return err
 	}
+	if node.deviceSecret == ds {
+		return nil
+	}
 	node.deviceSecret = ds
-	return nil
+	if sf.isRoot(node) {
+		return nil
+	}
+	return sf.saveLocked()
 }
 
 // DeviceSecret 设备DeviceSecret
@@ -192,8 +300,14 @@ func (sf *DevMgr) SetDeviceAvail(pk, dn string, enable bool) error {
 	if err != nil {
 		return err
 	}
+	if node.avail == enable {
+		return nil
+	}
 	node.avail = enable
-	return nil
+	if sf.isRoot(node) {
+		return nil
+	}
+	return sf.saveLocked()
 }
 
 // DeviceAvail 获取avail
@@ -217,7 +331,66 @@ func (sf *DevMgr) SetDeviceStatus(pk, dn string, status DevStatus) error {
 	if err != nil {
 		return err
 	}
+	if node.status == status {
+		return nil
+	}
+	changed := !sf.isRoot(node) && storedStatus(node.status) != storedStatus(status)
 	node.status = status
+	if changed || sf.dirty {
+		return sf.saveLocked()
+	}
+	return nil
+}
+
+// SetDevicesStatus 批量设置设备的状态, 所有变更只保存一次.
+// 返回首个未找到的设备错误或保存到store的错误
+func (sf *DevMgr) SetDevicesStatus(pairs []infra.MetaPair, status DevStatus) error {
+	sf.rw.Lock()
+	defer sf.rw.Unlock()
+
+	var firstErr error
+	changed := false
+	for _, pair := range pairs {
+		node, err := sf.searchLocked(pair.ProductKey, pair.DeviceName)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if !sf.isRoot(node) && storedStatus(node.status) != storedStatus(status) {
+			changed = true
+		}
+		node.status = status
+	}
+	if changed || sf.dirty {
+		if err := sf.saveLocked(); err != nil {
+			return err
+		}
+	}
+	return firstErr
+}
+
+// setRegistered 子设备注册成功, 批量设置设备的密钥并置为 DevStatusRegistered, 所有变更只保存一次
+func (sf *DevMgr) setRegistered(data []SubRegisterData) error {
+	sf.rw.Lock()
+	defer sf.rw.Unlock()
+
+	changed := false
+	for _, v := range data {
+		node, err := sf.searchLocked(v.ProductKey, v.DeviceName)
+		if err != nil || sf.isRoot(node) {
+			continue
+		}
+		if node.deviceSecret != v.DeviceSecret || storedStatus(node.status) != DevStatusRegistered {
+			changed = true
+		}
+		node.deviceSecret = v.DeviceSecret
+		node.status = DevStatusRegistered
+	}
+	if changed || sf.dirty {
+		return sf.saveLocked()
+	}
 	return nil
 }
 
@@ -0,0 +1,48 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+// DevRecord 子设备持久化记录
+type DevRecord struct {
+	ProductKey   string    `json:"productKey"`
+	DeviceName   string    `json:"deviceName"`
+	DeviceSecret string    `json:"deviceSecret"`
+	Avail        bool      `json:"avail"`
+	Status       DevStatus `json:"status"`
+}
+
+// DevStore 子设备信息持久化存储
+type DevStore interface {
+	// Load 加载所有子设备记录,无记录时返回空
+	Load() ([]DevRecord, error)
+	// Save 保存所有子设备记录
+	Save(records []DevRecord) error
+}
+
+// JSONFileStore 基于json文件的子设备信息存储
+type JSONFileStore struct {
+	file jsonFile
+}
+
+var _ DevStore = (*JSONFileStore)(nil)
+
+// NewJSONFileStore 新建json文件存储
+func NewJSONFileStore(path string) *JSONFileStore {
+	return &JSONFileStore{jsonFile{path: path}}
+}
+
+// Load 实现 DevStore 接口
+func (sf *JSONFileStore) Load() ([]DevRecord, error) {
+	var records []DevRecord
+	if err := sf.file.load(&records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Save 实现 DevStore 接口, 原子替换文件, 防止写入过程中掉电损坏文件
+func (sf *JSONFileStore) Save(records []DevRecord) error {
+	return sf.file.save(records)
+}
@@ -0,0 +1,89 @@
+package aiot
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+)
+
+// memDevStore 内存中的 DevStore, fail为true时保存失败
+type memDevStore struct {
+	mu      sync.Mutex
+	fail    bool
+	saves   int
+	records []DevRecord
+}
+
+func (sf *memDevStore) Load() ([]DevRecord, error) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return append([]DevRecord{}, sf.records...), nil
+}
+
+func (sf *memDevStore) Save(records []DevRecord) error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.saves++
+	if sf.fail {
+		return errors.New("disk full")
+	}
+	sf.records = append([]DevRecord{}, records...)
+	return nil
+}
+
+func (sf *memDevStore) setFail(fail bool) {
+	sf.mu.Lock()
+	sf.fail = fail
+	sf.mu.Unlock()
+}
+
+func TestDevMgr_StoreError(t *testing.T) {
+	root := infra.MetaTriad{ProductKey: "pk", DeviceName: "gw", DeviceSecret: "ds"}
+	sub := infra.MetaTriad{ProductKey: "pk", DeviceName: "sub", DeviceSecret: "ds"}
+	store := &memDevStore{}
+	mgr, err := NewDevMgrWithStore(root, store)
+	require.NoError(t, err)
+
+	// 保存失败, 设备已添加
+	store.setFail(true)
+	err = mgr.Add(sub)
+	var se *DevStoreError
+	require.True(t, errors.As(err, &se), "got %v", err)
+	_, err = mgr.Search("pk", "sub")
+	assert.NoError(t, err)
+	assert.Equal(t, ErrDeviceHasExist, mgr.Add(sub))
+
+	// 恢复后重新保存
+	store.setFail(false)
+	require.NoError(t, mgr.Save())
+	assert.Len(t, store.records, 1)
+	saves := store.saves
+	require.NoError(t, mgr.Save())
+	assert.Equal(t, saves, store.saves, "nothing to save")
+
+	// 会话状态变更不写入store
+	require.NoError(t, mgr.SetDeviceStatus("pk", "sub", DevStatusAttached))
+	saves = store.saves
+	require.NoError(t, mgr.SetDevicesStatus([]infra.MetaPair{{ProductKey: "pk", DeviceName: "sub"}}, DevStatusOnline))
+	assert.Equal(t, saves, store.saves)
+
+	// 删除保存失败时, 通过Save重新保存
+	store.setFail(true)
+	mgr.Delete("pk", "sub")
+	_, err = mgr.Search("pk", "sub")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Error(t, mgr.Save())
+	store.setFail(false)
+	require.NoError(t, mgr.Save())
+	assert.Empty(t, store.records)
+
+	// 重新加载
+	mgr, err = NewDevMgrWithStore(root, store)
+	require.NoError(t, err)
+	assert.Equal(t, 1, mgr.Len())
+}
@@ -0,0 +1,185 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 固件签名方法
+const (
+	OtaSignMethodMD5    = "Md5"
+	OtaSignMethodSHA256 = "SHA256"
+)
+
+// httpDownload 下载url到文件path,文件已存在时使用HTTP Range从文件末尾续传,
+// 服务器不支持Range时从头下载. size > 0 时为文件的总大小.
+// progress 在每次写入后调用, 参数为已下载的大小及总大小(未知时为0)
+func httpDownload(ctx context.Context, client *http.Client, url, path string, size int64, progress func(done, total int64)) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size > 0 && offset >= size {
+		if offset == size { // 已下载完成
+			return nil
+		}
+		if err = f.Truncate(0); err != nil {
+			return err
+		}
+		offset = 0
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	switch rsp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK: // 不支持续传, 从头下载
+		if offset > 0 {
+			if err = f.Truncate(0); err != nil {
+				return err
+			}
+			offset = 0
+		}
+	default:
+		return fmt.Errorf("http download, unexpected status %s", rsp.Status)
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	total := size
+	if total <= 0 && rsp.ContentLength > 0 {
+		total = offset + rsp.ContentLength
+	}
+
+	buf := make([]byte, 32*1024)
+	done := offset
+	for {
+		n, rerr := rsp.Body.Read(buf)
+		if n > 0 {
+			if _, err = f.Write(buf[:n]); err != nil {
+				return err
+			}
+			done += int64(n)
+			if progress != nil {
+				progress(done, total)
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+	if size > 0 && done != size {
+		return fmt.Errorf("http download, size %d mismatch, want %d", done, size)
+	}
+	return nil
+}
+
+// newSignHash 根据签名方法创建hash, 不支持的签名方法返回 ErrOtaSignMethod
+func newSignHash(signMethod string) (hash.Hash, error) {
+	switch {
+	case strings.EqualFold(signMethod, OtaSignMethodMD5):
+		return md5.New(), nil
+	case strings.EqualFold(signMethod, OtaSignMethodSHA256):
+		return sha256.New(), nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrOtaSignMethod, signMethod)
+}
+
+// verifyFirmware 校验固件文件的大小,md5及签名
+func verifyFirmware(path string, fw *OtaFirmwareData) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	md5Hash := md5.New()
+	writers := []io.Writer{md5Hash}
+	var signHash hash.Hash
+	if fw.Sign != "" {
+		if signHash, err = newSignHash(fw.SignMethod); err != nil {
+			return err
+		}
+		writers = append(writers, signHash)
+	}
+	n, err := io.Copy(io.MultiWriter(writers...), f)
+	if err != nil {
+		return err
+	}
+	if fw.Size > 0 && n != fw.Size {
+		return fmt.Errorf("%w, size %d, want %d", ErrOtaVerifyFailed, n, fw.Size)
+	}
+	if fw.MD5 != "" {
+		if sum := hex.EncodeToString(md5Hash.Sum(nil)); !strings.EqualFold(sum, fw.MD5) {
+			return fmt.Errorf("%w, md5 %s, want %s", ErrOtaVerifyFailed, sum, fw.MD5)
+		}
+	}
+	if signHash != nil {
+		if sum := hex.EncodeToString(signHash.Sum(nil)); !strings.EqualFold(sum, fw.Sign) {
+			return fmt.Errorf("%w, %s sign %s, want %s", ErrOtaVerifyFailed, fw.SignMethod, sum, fw.Sign)
+		}
+	}
+	return nil
+}
+
+// otaSigned 固件或其中任一文件是否带签名
+func otaSigned(fw OtaFirmwareData) bool {
+	if fw.Sign != "" {
+		return true
+	}
+	for _, f := range fw.Files {
+		if f.Sign != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// otaFileFirmware 多文件升级包中单个文件的下载及校验信息
+func otaFileFirmware(fw OtaFirmwareData, f OtaFile) OtaFirmwareData {
+	fw.Size, fw.URL, fw.MD5, fw.Sign = f.Size, f.URL, f.MD5, f.Sign
+	fw.DProtocol, fw.StreamID, fw.StreamFileID = "", 0, 0
+	fw.Files = nil
+	return fw
+}
+
+// otaPackagePath 固件的存放路径, 多文件升级包为目录
+func otaPackagePath(path string, fw OtaFirmwareData) string {
+	if len(fw.Files) > 0 {
+		return strings.TrimSuffix(path, filepath.Ext(path)) + ".d"
+	}
+	return path
+}
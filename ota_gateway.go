@@ -0,0 +1,332 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+)
+
+// 网关子设备OTA升级默认值
+const (
+	// DefaultGatewayOtaConcurrency 网关默认同时烧录的子设备数
+	DefaultGatewayOtaConcurrency = 1
+	// DefaultGatewayOtaCacheTTL 默认下载校验通过的固件在无子设备使用后的缓存时间
+	DefaultGatewayOtaCacheTTL = 30 * time.Minute
+)
+
+// WithOtaCacheTTL 设置网关子设备升级中, 下载校验通过的固件在无子设备使用后的缓存时间,
+// 缓存期间相同固件的升级不再下载, 默认 DefaultGatewayOtaCacheTTL, <= 0 表示不缓存. 仅用于 GatewayOta
+func WithOtaCacheTTL(d time.Duration) OtaOption {
+	return func(m *OtaManager) {
+		m.cacheTTL = d
+	}
+}
+
+// SubDeviceFlasher 子设备固件烧录接口
+type SubDeviceFlasher interface {
+	// Flash 将已校验通过的固件文件file烧录到子设备, 多文件升级包时file为存放所有文件的目录, 文件在所有使用该固件的子设备烧录完成前不会删除
+	Flash(ctx context.Context, pk, dn string, fw OtaFirmwareData, file string) error
+}
+
+// SubDeviceFlasherFunc 子设备固件烧录函数, 实现 SubDeviceFlasher 接口
+type SubDeviceFlasherFunc func(ctx context.Context, pk, dn string, fw OtaFirmwareData, file string) error
+
+// Flash 实现 SubDeviceFlasher 接口
+func (sf SubDeviceFlasherFunc) Flash(ctx context.Context, pk, dn string, fw OtaFirmwareData, file string) error {
+	return sf(ctx, pk, dn, fw, file)
+}
+
+// gatewayDownload 多个子设备共享的固件下载
+type gatewayDownload struct {
+	key    string
+	file   string
+	cancel context.CancelFunc
+	done   chan struct{}
+	step   int   // 失败时的进度码
+	err    error // 下载或校验的错误, done关闭后有效
+
+	// 以下由 GatewayOta.mu 保护
+	refs  int
+	idle  int         // 进入空闲缓存的次数, 用于识别过期的定时器
+	timer *time.Timer // 空闲缓存的过期定时器
+
+	mu   sync.Mutex
+	subs []gatewaySub // 使用该下载的子设备, 用于上报下载进度及MQTT分片下载
+}
+
+// gatewaySub 使用共享下载的子设备及其收到的升级信息
+type gatewaySub struct {
+	dev infra.MetaPair
+	fw  OtaFirmwareData
+}
+
+// GatewayOta 网关子设备OTA升级,协程安全.
+// 相同的固件(按md5,签名,大小及版本识别)只下载及校验一次,多个子设备共享,
+// 无子设备使用后缓存一段时间(见 WithOtaCacheTTL), 可通过 Cleanup 立即删除,
+// 校验通过后交由 SubDeviceFlasher 按并发数限制烧录,
+// 并以子设备的productKey,deviceName上报各自的升级进度及新的固件版本
+type GatewayOta struct {
+	m       *OtaManager
+	flasher SubDeviceFlasher
+	slots   chan struct{}
+
+	mu        sync.Mutex
+	downloads map[string]*gatewayDownload
+}
+
+// NewGatewayOta 新建网关子设备OTA升级
+// concurrency: 同时烧录的子设备数, <= 0 使用 DefaultGatewayOtaConcurrency
+// opts: 下载及校验的选项, 同 OtaManager
+func NewGatewayOta(flasher SubDeviceFlasher, concurrency int, opts ...OtaOption) *GatewayOta {
+	if concurrency <= 0 {
+		concurrency = DefaultGatewayOtaConcurrency
+	}
+	return &GatewayOta{
+		m:         NewOtaManager(nil, opts...),
+		flasher:   flasher,
+		slots:     make(chan struct{}, concurrency),
+		downloads: make(map[string]*gatewayDownload),
+	}
+}
+
+// HandleUpgrade 处理平台推送的子设备升级,异步, 可作为 OtaUpgradeHandler 注册到 ModuleRegistry
+func (sf *GatewayOta) HandleUpgrade(c *Client, pk, dn string, fw OtaFirmwareData) error {
+	go func() {
+		if err := sf.Upgrade(context.Background(), c, pk, dn, fw); err != nil {
+			c.Log.Errorf("gateway ota upgrade %s module %s to %s failed, %+v", FormatKey(pk, dn), fw.Module, fw.Version, err)
+		}
+	}()
+	return nil
+}
+
+// Upgrade 执行一次子设备升级, 同步
+func (sf *GatewayOta) Upgrade(ctx context.Context, c *Client, pk, dn string, fw OtaFirmwareData) error {
+	if sf.flasher == nil {
+		return sf.m.fail(c, pk, dn, fw.Module, OtaProgressStepUpgradeFailed, ErrOtaNoFlasher)
+	}
+	if otaSigned(fw) {
+		if _, err := newSignHash(fw.SignMethod); err != nil {
+			return sf.m.fail(c, pk, dn, fw.Module, OtaProgressStepVerifyFailed, err)
+		}
+	}
+
+	dl := sf.acquire(c, pk, dn, fw)
+	defer sf.release(dl, pk, dn)
+	select {
+	case <-dl.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if dl.err != nil {
+		return sf.m.fail(c, pk, dn, fw.Module, dl.step, dl.err)
+	}
+
+	file := dl.file
+	if fw.IsDiff != 0 { // 差分包按子设备当前镜像分别还原
+		image := dl.file + "." + hex.EncodeToString([]byte(FormatKey(pk, dn))) + ".img"
+		err := sf.m.patch(ctx, pk, dn, fw, dl.file, image)
+		if err != nil {
+			return sf.m.fail(c, pk, dn, fw.Module, OtaProgressStepUpgradeFailed, err)
+		}
+		defer os.Remove(image) // nolint: errcheck
+		file = image
+	}
+	if err := sf.m.verifyImage(pk, dn, fw, file); err != nil {
+		return sf.m.fail(c, pk, dn, fw.Module, OtaProgressStepVerifyFailed, err)
+	}
+
+	select {
+	case sf.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	err := sf.flasher.Flash(ctx, pk, dn, fw, file)
+	<-sf.slots
+	if err != nil {
+		return sf.m.fail(c, pk, dn, fw.Module, OtaProgressStepProgramFailed, err)
+	}
+	return otaInstalled(c, pk, dn, fw)
+}
+
+// Cleanup 删除所有无子设备使用的缓存固件
+func (sf *GatewayOta) Cleanup() {
+	var idles []*gatewayDownload
+	sf.mu.Lock()
+	for key, dl := range sf.downloads {
+		if dl.refs == 0 {
+			if dl.timer != nil {
+				dl.timer.Stop()
+			}
+			delete(sf.downloads, key)
+			idles = append(idles, dl)
+		}
+	}
+	sf.mu.Unlock()
+	for _, dl := range idles {
+		os.RemoveAll(dl.file) // nolint: errcheck
+	}
+}
+
+// acquire 获得固件的共享下载,不存在时新建并开始下载
+func (sf *GatewayOta) acquire(c *Client, pk, dn string, fw OtaFirmwareData) *gatewayDownload {
+	key := gatewayFirmwareKey(fw)
+	sub := gatewaySub{infra.MetaPair{ProductKey: pk, DeviceName: dn}, fw}
+
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if dl, ok := sf.downloads[key]; ok {
+		if dl.refs == 0 && dl.timer != nil {
+			dl.timer.Stop()
+		}
+		dl.refs++
+		dl.mu.Lock()
+		dl.subs = append(dl.subs, sub)
+		dl.mu.Unlock()
+		return dl
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	dl := &gatewayDownload{
+		key:    key,
+		file:   otaPackagePath(filepath.Join(sf.m.dir, fmt.Sprintf("gw_%x.bin", md5.Sum([]byte(key)))), fw),
+		cancel: cancel,
+		done:   make(chan struct{}),
+		refs:   1,
+		subs:   []gatewaySub{sub},
+	}
+	sf.downloads[key] = dl
+	go sf.download(ctx, c, sub, dl)
+	return dl
+}
+
+// release 子设备不再使用共享下载, 无子设备使用时, 下载校验通过的固件进入缓存,
+// 否则取消下载并删除文件
+func (sf *GatewayOta) release(dl *gatewayDownload, pk, dn string) {
+	dl.mu.Lock()
+	for i, sub := range dl.subs {
+		if sub.dev.ProductKey == pk && sub.dev.DeviceName == dn {
+			dl.subs = append(dl.subs[:i], dl.subs[i+1:]...)
+			break
+		}
+	}
+	dl.mu.Unlock()
+
+	sf.mu.Lock()
+	dl.refs--
+	if dl.refs > 0 {
+		sf.mu.Unlock()
+		return
+	}
+	cached := false
+	select {
+	case <-dl.done:
+		cached = dl.err == nil && sf.m.cacheTTL > 0
+	default:
+	}
+	if cached {
+		dl.idle++
+		idle := dl.idle
+		dl.timer = time.AfterFunc(sf.m.cacheTTL, func() { sf.expire(dl, idle) })
+		sf.mu.Unlock()
+		return
+	}
+	if sf.downloads[dl.key] == dl {
+		delete(sf.downloads, dl.key)
+	}
+	sf.mu.Unlock()
+	dl.cancel()
+	<-dl.done
+	os.RemoveAll(dl.file) // nolint: errcheck
+}
+
+// expire 缓存过期, 期间无子设备再使用时删除
+func (sf *GatewayOta) expire(dl *gatewayDownload, idle int) {
+	sf.mu.Lock()
+	if dl.refs > 0 || dl.idle != idle || sf.downloads[dl.key] != dl {
+		sf.mu.Unlock()
+		return
+	}
+	delete(sf.downloads, dl.key)
+	sf.mu.Unlock()
+	os.RemoveAll(dl.file) // nolint: errcheck
+}
+
+// download 下载并校验共享的固件, 下载进度上报给所有使用的子设备.
+// 通过MQTT分片下载时, 文件流属于各子设备的升级任务, 先使用发起下载的子设备的文件流,
+// 失败时依次使用其它仍在等待的子设备的文件流续传
+func (sf *GatewayOta) download(ctx context.Context, c *Client, sub gatewaySub, dl *gatewayDownload) {
+	defer close(dl.done)
+	defer dl.cancel()
+
+	c.Log.Debugf("gateway ota download %s", dl.key)
+	report := func(step int) {
+		dl.mu.Lock()
+		subs := append([]gatewaySub{}, dl.subs...)
+		dl.mu.Unlock()
+		for _, s := range subs {
+			sf.m.progress(c, s.dev.ProductKey, s.dev.DeviceName, s.fw.Module, step, "downloading")
+		}
+	}
+	tried := make(map[infra.MetaPair]bool)
+	for {
+		tried[sub.dev] = true
+		dl.step, dl.err = sf.m.obtain(ctx, c, sub.dev.ProductKey, sub.dev.DeviceName, sub.fw, dl.file, report)
+		if dl.err == nil || ctx.Err() != nil || !isStreamFirmware(sub.fw) ||
+			dl.step != OtaProgressStepDownloadFailed {
+			return
+		}
+		next, ok := dl.nextSub(tried)
+		if !ok {
+			return
+		}
+		c.Log.Warnf("gateway ota stream download %s via %s failed, continue via %s, %+v",
+			dl.key, FormatKey(sub.dev.ProductKey, sub.dev.DeviceName), FormatKey(next.dev.ProductKey, next.dev.DeviceName), dl.err)
+		sub = next
+	}
+}
+
+// nextSub 获得未尝试过的等待中的子设备
+func (sf *gatewayDownload) nextSub(tried map[infra.MetaPair]bool) (gatewaySub, bool) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	for _, sub := range sf.subs {
+		if !tried[sub.dev] {
+			return sub, true
+		}
+	}
+	return gatewaySub{}, false
+}
+
+// gatewayFirmwareKey 固件的标识
+func gatewayFirmwareKey(fw OtaFirmwareData) string {
+	id := fw.MD5
+	if id == "" {
+		id = fw.Sign
+	}
+	if id == "" {
+		id = fw.URL
+	}
+	if id == "" && len(fw.Files) > 0 {
+		ids := make([]string, 0, len(fw.Files))
+		for _, f := range fw.Files {
+			ids = append(ids, f.Name+":"+f.MD5+f.Sign)
+		}
+		id = strings.Join(ids, ",")
+	}
+	if id == "" {
+		id = fmt.Sprintf("%d_%d", fw.StreamID, fw.StreamFileID)
+	}
+	return fmt.Sprintf("%s_%s_%d_%s", moduleName(fw.Module), fw.Version, fw.Size, id)
+}
@@ -0,0 +1,231 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+)
+
+// RollbackInstaller 支持A/B分区的固件安装接口.
+// Install 将固件写入备用分区并切换启动分区(通常随后重启),
+// 设备重新上线后通过 RunningVersion 确认运行的版本, 与目标版本一致时调用 Confirm 标记新分区有效,
+// 否则调用 Rollback 回滚到升级前的分区
+type RollbackInstaller interface {
+	Installer
+	// RunningVersion 获得设备模块当前运行的固件版本
+	RunningVersion(pk, dn, module string) (string, error)
+	// Confirm 确认新固件运行正常
+	Confirm(ctx context.Context, pk, dn string, fw OtaFirmwareData) error
+	// Rollback 回滚到升级前的固件
+	Rollback(ctx context.Context, pk, dn string, fw OtaFirmwareData) error
+}
+
+// OtaInstallState 正在进行的安装的持久化记录
+type OtaInstallState struct {
+	ProductKey string          `json:"productKey"`
+	DeviceName string          `json:"deviceName"`
+	Firmware   OtaFirmwareData `json:"firmware"`
+	Timestamp  int64           `json:"timestamp"` // 开始安装的时间, 毫秒
+}
+
+// OtaStateStore 安装状态持久化存储
+type OtaStateStore interface {
+	// Load 加载所有安装状态,无记录时返回空
+	Load() ([]OtaInstallState, error)
+	// Save 保存所有安装状态
+	Save(states []OtaInstallState) error
+}
+
+// JSONOtaStateStore 基于json文件的安装状态存储
+type JSONOtaStateStore struct {
+	file jsonFile
+}
+
+var _ OtaStateStore = (*JSONOtaStateStore)(nil)
+
+// NewJSONOtaStateStore 新建json文件存储
+func NewJSONOtaStateStore(path string) *JSONOtaStateStore {
+	return &JSONOtaStateStore{jsonFile{path: path}}
+}
+
+// Load 实现 OtaStateStore 接口
+func (sf *JSONOtaStateStore) Load() ([]OtaInstallState, error) {
+	var states []OtaInstallState
+	if err := sf.file.load(&states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// Save 实现 OtaStateStore 接口, 原子替换文件, 防止写入过程中掉电损坏文件
+func (sf *JSONOtaStateStore) Save(states []OtaInstallState) error {
+	return sf.file.save(states)
+}
+
+// WithOtaStateStore 设置安装状态存储, 安装接口实现了 RollbackInstaller 时,
+// 安装前记录目标版本, 重启后设备上线时确认或回滚
+func WithOtaStateStore(s OtaStateStore) OtaOption {
+	return func(m *OtaManager) {
+		m.stateStore = s
+	}
+}
+
+// otaInstallEntry 安装状态, boot表示记录来自上次运行, 需在设备上线时确认,
+// busy表示正在确认或回滚
+type otaInstallEntry struct {
+	state OtaInstallState
+	boot  bool
+	busy  bool
+}
+
+// rollbackInstaller 使用A/B分区安装流程时返回 RollbackInstaller
+func (sf *OtaManager) rollbackInstaller() (RollbackInstaller, bool) {
+	if sf.stateStore == nil {
+		return nil, false
+	}
+	ri, ok := sf.installer.(RollbackInstaller)
+	return ri, ok
+}
+
+// installAB 记录目标版本后安装, 安装后运行的版本已是目标版本时直接确认, 否则等待重启后上线时确认
+func (sf *OtaManager) installAB(ctx context.Context, c *Client, ri RollbackInstaller, pk, dn string, fw OtaFirmwareData, file string) error {
+	key := otaTaskKey(pk, dn, fw.Module)
+	err := sf.putState(c, key, OtaInstallState{pk, dn, fw, infra.Millisecond(time.Now())})
+	if err != nil {
+		return sf.fail(c, pk, dn, fw.Module, OtaProgressStepUpgradeFailed, err)
+	}
+	if err = ri.Install(ctx, pk, dn, fw, file); err != nil {
+		sf.removeState(c, key)
+		return sf.fail(c, pk, dn, fw.Module, OtaProgressStepProgramFailed, err)
+	}
+	os.RemoveAll(file) // nolint: errcheck
+
+	if running, err := ri.RunningVersion(pk, dn, fw.Module); err != nil || running != fw.Version {
+		c.Log.Infof("ota %s module %s installed %s, waiting for reboot", FormatKey(pk, dn), fw.Module, fw.Version)
+		return nil
+	}
+	return sf.confirm(ctx, c, ri, key, pk, dn, fw)
+}
+
+// onConnect 设备上线, 确认上次运行时安装的固件, 确认或回滚成功后才删除安装状态,
+// 均失败时保留, 下次上线时重试
+func (sf *OtaManager) onConnect(c *Client, pk, dn string, _ bool) {
+	ri, ok := sf.rollbackInstaller()
+	if !ok {
+		return
+	}
+	boots := make(map[string]OtaInstallState)
+	sf.mu.Lock()
+	sf.loadStatesLocked(c)
+	for key, e := range sf.states {
+		if e.boot && !e.busy && e.state.ProductKey == pk && e.state.DeviceName == dn {
+			e.busy = true
+			boots[key] = e.state
+		}
+	}
+	sf.mu.Unlock()
+
+	ctx := context.Background()
+	for key, st := range boots {
+		fw := st.Firmware
+		running, err := ri.RunningVersion(pk, dn, fw.Module)
+		if err == nil && running == fw.Version {
+			if err = sf.confirm(ctx, c, ri, key, pk, dn, fw); err != nil {
+				c.Log.Errorf("ota confirm %s module %s version %s failed, %+v", FormatKey(pk, dn), fw.Module, fw.Version, err)
+			}
+			continue
+		}
+
+		desc := fmt.Sprintf("running version %s, expect %s", running, fw.Version)
+		if err != nil {
+			desc = fmt.Sprintf("get running version, %v", err)
+		}
+		if err = ri.Rollback(ctx, pk, dn, fw); err != nil {
+			desc += fmt.Sprintf(", rollback failed, %v", err)
+			sf.releaseState(key)
+		} else {
+			desc += ", rolled back"
+			sf.removeState(c, key)
+		}
+		c.Log.Errorf("ota %s module %s upgrade to %s failed, %s", FormatKey(pk, dn), fw.Module, fw.Version, desc)
+		sf.progress(c, pk, dn, fw.Module, OtaProgressStepProgramFailed, desc)
+	}
+}
+
+// confirm 确认新固件, 失败时回滚, 确认或回滚成功后删除安装状态
+func (sf *OtaManager) confirm(ctx context.Context, c *Client, ri RollbackInstaller, key, pk, dn string, fw OtaFirmwareData) error {
+	if err := ri.Confirm(ctx, pk, dn, fw); err != nil {
+		if e := ri.Rollback(ctx, pk, dn, fw); e != nil {
+			c.Log.Errorf("ota rollback %s module %s failed, %+v", FormatKey(pk, dn), fw.Module, e)
+			sf.releaseState(key)
+		} else {
+			sf.removeState(c, key)
+		}
+		return sf.fail(c, pk, dn, fw.Module, OtaProgressStepProgramFailed, err)
+	}
+	sf.removeState(c, key)
+	return otaInstalled(c, pk, dn, fw)
+}
+
+func (sf *OtaManager) putState(c *Client, key string, st OtaInstallState) error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.loadStatesLocked(c)
+	sf.states[key] = &otaInstallEntry{state: st}
+	return sf.saveStatesLocked(c)
+}
+
+func (sf *OtaManager) removeState(c *Client, key string) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.loadStatesLocked(c)
+	if _, ok := sf.states[key]; ok {
+		delete(sf.states, key)
+		sf.saveStatesLocked(c) // nolint: errcheck
+	}
+}
+
+// releaseState 确认及回滚均失败, 保留安装状态待下次上线重试
+func (sf *OtaManager) releaseState(key string) {
+	sf.mu.Lock()
+	if e, ok := sf.states[key]; ok {
+		e.busy = false
+	}
+	sf.mu.Unlock()
+}
+
+// loadStatesLocked 首次使用时加载上次运行的安装状态
+func (sf *OtaManager) loadStatesLocked(c *Client) {
+	if sf.states != nil {
+		return
+	}
+	sf.states = make(map[string]*otaInstallEntry)
+	states, err := sf.stateStore.Load()
+	if err != nil {
+		c.Log.Warnf("ota load install states, %+v", err)
+	}
+	for _, st := range states {
+		sf.states[otaTaskKey(st.ProductKey, st.DeviceName, st.Firmware.Module)] = &otaInstallEntry{state: st, boot: true}
+	}
+}
+
+func (sf *OtaManager) saveStatesLocked(c *Client) error {
+	states := make([]OtaInstallState, 0, len(sf.states))
+	for _, e := range sf.states {
+		states = append(states, e.state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Timestamp < states[j].Timestamp })
+	err := sf.stateStore.Save(states)
+	if err != nil {
+		c.Log.Warnf("ota save install states, %+v", err)
+	}
+	return err
+}
@@ -0,0 +1,197 @@
+package aiot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thinkgos/aliyun-iot/uri"
+)
+
+// abInstaller 模拟A/B分区安装, 安装后重启时bootOK为true则运行新版本, 否则仍运行旧版本
+type abInstaller struct {
+	mu         sync.Mutex
+	running    string
+	installed  string
+	bootOK     bool
+	confirmErr error
+	calls      []string
+}
+
+func (sf *abInstaller) Install(_ context.Context, _, _ string, fw OtaFirmwareData, _ string) error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.calls = append(sf.calls, "install "+fw.Version)
+	sf.installed = fw.Version
+	return nil
+}
+
+func (sf *abInstaller) RunningVersion(_, _, _ string) (string, error) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return sf.running, nil
+}
+
+func (sf *abInstaller) Confirm(_ context.Context, _, _ string, fw OtaFirmwareData) error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.calls = append(sf.calls, "confirm "+fw.Version)
+	return sf.confirmErr
+}
+
+func (sf *abInstaller) Rollback(_ context.Context, _, _ string, fw OtaFirmwareData) error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.calls = append(sf.calls, "rollback "+fw.Version)
+	return nil
+}
+
+// reboot 重启, 启动成功时运行已安装的版本
+func (sf *abInstaller) reboot() {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if sf.bootOK {
+		sf.running = sf.installed
+	}
+}
+
+func (sf *abInstaller) takeCalls() []string {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	calls := sf.calls
+	sf.calls = nil
+	return calls
+}
+
+// otaPublished 已发布的OTA版本及进度上报
+func otaPublished(t *testing.T, conn *fakeConn) (informs []OtaInformParams, progress []OtaProgressParams) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	for _, p := range conn.published {
+		switch p.topic {
+		case uri.URI(uri.OtaDeviceInformPrefix, "", "pk", "dn"):
+			var req struct{ Params OtaInformParams }
+			require.NoError(t, json.Unmarshal(p.payload, &req))
+			informs = append(informs, req.Params)
+		case uri.URI(uri.OtaDeviceProcessPrefix, "", "pk", "dn"):
+			var req struct{ Params OtaProgressParams }
+			require.NoError(t, json.Unmarshal(p.payload, &req))
+			progress = append(progress, req.Params)
+		}
+	}
+	return informs, progress
+}
+
+func TestOtaManager_InstallAB(t *testing.T) {
+	fw := OtaFirmwareData{Version: "v2", Module: "default"}
+	// install 安装后模拟重启, 返回重启后新的管理
+	install := func(t *testing.T, store OtaStateStore, inst *abInstaller) (*Client, *fakeConn, *OtaManager) {
+		c, conn := newFakeClient(nil, WithEnableOTA())
+		m := NewOtaManager(inst, WithOtaStateStore(store))
+		require.NoError(t, m.installAB(context.Background(), c, inst, "pk", "dn", fw, filepath.Join(t.TempDir(), "fw.bin")))
+		assert.Equal(t, []string{"install v2"}, inst.takeCalls())
+		// 等待重启, 安装状态已持久化
+		states, err := store.Load()
+		require.NoError(t, err)
+		require.Len(t, states, 1)
+		assert.Equal(t, fw, states[0].Firmware)
+
+		inst.reboot()
+		return c, conn, NewOtaManager(inst, WithOtaStateStore(store))
+	}
+
+	t.Run("reboot then confirm", func(t *testing.T) {
+		store := NewJSONOtaStateStore(filepath.Join(t.TempDir(), "ota.json"))
+		inst := &abInstaller{running: "v1", bootOK: true}
+		c, conn, m := install(t, store, inst)
+
+		m.onConnect(c, "pk", "dn", false)
+		assert.Equal(t, []string{"confirm v2"}, inst.takeCalls())
+		informs, progress := otaPublished(t, conn)
+		assert.Equal(t, []OtaInformParams{{Version: "v2", Module: "default"}}, informs)
+		assert.Empty(t, progress)
+		states, err := store.Load()
+		require.NoError(t, err)
+		assert.Empty(t, states)
+
+		// 已确认, 再次上线不再处理
+		m.onConnect(c, "pk", "dn", true)
+		assert.Empty(t, inst.takeCalls())
+	})
+
+	t.Run("failed boot then rollback", func(t *testing.T) {
+		store := NewJSONOtaStateStore(filepath.Join(t.TempDir(), "ota.json"))
+		inst := &abInstaller{running: "v1"}
+		c, conn, m := install(t, store, inst)
+
+		m.onConnect(c, "pk", "dn", false)
+		assert.Equal(t, []string{"rollback v2"}, inst.takeCalls())
+		informs, progress := otaPublished(t, conn)
+		assert.Empty(t, informs)
+		require.Len(t, progress, 1)
+		assert.Equal(t, OtaProgressStepProgramFailed, progress[0].Step)
+		assert.Contains(t, progress[0].Desc, "rolled back")
+		states, err := store.Load()
+		require.NoError(t, err)
+		assert.Empty(t, states)
+	})
+
+	t.Run("confirm failed then rollback", func(t *testing.T) {
+		store := NewJSONOtaStateStore(filepath.Join(t.TempDir(), "ota.json"))
+		inst := &abInstaller{running: "v1", bootOK: true, confirmErr: errors.New("confirm failed")}
+		c, conn, m := install(t, store, inst)
+
+		m.onConnect(c, "pk", "dn", false)
+		assert.Equal(t, []string{"confirm v2", "rollback v2"}, inst.takeCalls())
+		informs, progress := otaPublished(t, conn)
+		assert.Empty(t, informs)
+		require.Len(t, progress, 1)
+		assert.Equal(t, OtaProgressStepProgramFailed, progress[0].Step)
+		states, err := store.Load()
+		require.NoError(t, err)
+		assert.Empty(t, states)
+	})
+
+	t.Run("running target after install", func(t *testing.T) {
+		// 无需重启的安装直接确认
+		store := NewJSONOtaStateStore(filepath.Join(t.TempDir(), "ota.json"))
+		inst := &abInstaller{running: "v2"}
+		c, conn := newFakeClient(nil, WithEnableOTA())
+		m := NewOtaManager(inst, WithOtaStateStore(store))
+		require.NoError(t, m.installAB(context.Background(), c, inst, "pk", "dn", fw, filepath.Join(t.TempDir(), "fw.bin")))
+		assert.Equal(t, []string{"install v2", "confirm v2"}, inst.takeCalls())
+		informs, _ := otaPublished(t, conn)
+		assert.Len(t, informs, 1)
+		states, err := store.Load()
+		require.NoError(t, err)
+		assert.Empty(t, states)
+	})
+
+	t.Run("corrupt state file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "ota.json")
+		require.NoError(t, ioutil.WriteFile(path, []byte(`[{"productKey":`), 0600))
+		store := NewJSONOtaStateStore(path)
+		_, err := store.Load()
+		require.Error(t, err)
+
+		// 无法加载的状态忽略, 上线时不确认也不回滚
+		inst := &abInstaller{running: "v1", bootOK: true}
+		c, _ := newFakeClient(nil, WithEnableOTA())
+		NewOtaManager(inst, WithOtaStateStore(store)).onConnect(c, "pk", "dn", false)
+		assert.Empty(t, inst.takeCalls())
+
+		// 之后的安装覆盖损坏的文件, 重启后可正常确认
+		c, conn, m := install(t, store, inst)
+		m.onConnect(c, "pk", "dn", false)
+		assert.Equal(t, []string{"confirm v2"}, inst.takeCalls())
+		informs, _ := otaPublished(t, conn)
+		assert.Len(t, informs, 1)
+	})
+}
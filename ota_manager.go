@@ -0,0 +1,420 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTA管理默认值
+const (
+	// DefaultOtaProgressStep 默认下载进度上报的间隔百分比
+	DefaultOtaProgressStep = 10
+	// DefaultOtaDownloadRetry 默认下载失败后的重试(续传)次数
+	DefaultOtaDownloadRetry = 3
+)
+
+// Installer 固件安装接口
+type Installer interface {
+	// Install 安装已校验通过的固件文件file, 多文件升级包时file为存放所有文件的目录
+	Install(ctx context.Context, pk, dn string, fw OtaFirmwareData, file string) error
+}
+
+// InstallerFunc 固件安装函数, 实现 Installer 接口
+type InstallerFunc func(ctx context.Context, pk, dn string, fw OtaFirmwareData, file string) error
+
+// Install 实现 Installer 接口
+func (sf InstallerFunc) Install(ctx context.Context, pk, dn string, fw OtaFirmwareData, file string) error {
+	return sf(ctx, pk, dn, fw, file)
+}
+
+// OtaOption OTA管理选项
+type OtaOption func(*OtaManager)
+
+// WithOtaDir 设置固件下载目录,默认为系统临时目录
+func WithOtaDir(dir string) OtaOption {
+	return func(m *OtaManager) {
+		m.dir = dir
+	}
+}
+
+// WithOtaHTTPClient 设置下载固件使用的http client,默认 http.DefaultClient
+func WithOtaHTTPClient(c *http.Client) OtaOption {
+	return func(m *OtaManager) {
+		m.httpClient = c
+	}
+}
+
+// WithOtaProgressStep 设置下载进度上报的间隔百分比,默认 DefaultOtaProgressStep
+func WithOtaProgressStep(step int) OtaOption {
+	return func(m *OtaManager) {
+		if step > 0 {
+			m.progressStep = step
+		}
+	}
+}
+
+// WithOtaDownloadRetry 设置下载失败后的重试(续传)次数,默认 DefaultOtaDownloadRetry
+func WithOtaDownloadRetry(n int) OtaOption {
+	return func(m *OtaManager) {
+		m.downloadRetry = n
+	}
+}
+
+// WithOtaPatcher 设置差分包还原,固件为差分包时使用, 未设置时差分包升级失败
+func WithOtaPatcher(p Patcher) OtaOption {
+	return func(m *OtaManager) {
+		m.patcher = p
+	}
+}
+
+// WithOtaImageVerifier 设置安装前镜像(差分包还原后的镜像或完整固件)的校验,
+// 差分包还原后的镜像默认按extData中的镜像校验值(OtaExtImageMD5, OtaExtImageSign)校验,
+// 无镜像校验值时须设置此校验, 否则差分包升级失败
+func WithOtaImageVerifier(v ImageVerifier) OtaOption {
+	return func(m *OtaManager) {
+		m.imageVerifier = v
+	}
+}
+
+// DigestVerifier 升级包摘要签名(OtaFirmwareData.DigestSign)的校验函数, 所有文件校验通过后调用,
+// path 为固件文件, 多文件升级包时为存放所有文件的目录
+type DigestVerifier func(pk, dn string, fw OtaFirmwareData, path string) error
+
+// WithOtaDigestVerifier 设置升级包摘要签名的校验, 未设置时忽略摘要签名
+func WithOtaDigestVerifier(v DigestVerifier) OtaOption {
+	return func(m *OtaManager) {
+		m.digestVerifier = v
+	}
+}
+
+// OtaManager OTA升级管理, 协程安全.
+// 下载固件(支持断点续传, 通过HTTP或MQTT分片下载, 多文件升级包),校验每个文件的大小,md5及签名,上报下载进度,差分包由 Patcher 还原为镜像并校验,交由 Installer 安装,
+// 安装成功后上报新的固件版本,配置了 ModuleRegistry 时同时记录新的版本. 失败时上报相应的失败进度:
+//   - 下载失败: OtaProgressStepDownloadFailed
+//   - 校验失败: OtaProgressStepVerifyFailed, 包括还原后镜像的校验
+//   - 安装失败: OtaProgressStepProgramFailed
+//   - 其它失败: OtaProgressStepUpgradeFailed
+//
+// 设置了 OtaStateStore 且安装接口实现了 RollbackInstaller 时, 安装前持久化目标版本,
+// 重启后设备上线时确认运行的版本, 一致时上报新的固件版本, 否则回滚并上报 OtaProgressStepProgramFailed
+type OtaManager struct {
+	installer      Installer
+	dir            string
+	httpClient     *http.Client
+	progressStep   int
+	downloadRetry  int
+	patcher        Patcher
+	imageVerifier  ImageVerifier
+	digestVerifier DigestVerifier
+	blockSize      int
+	blockTimeout   time.Duration
+	stateStore     OtaStateStore
+	cacheTTL       time.Duration
+
+	mu     sync.Mutex
+	tasks  map[string]*otaTask
+	states map[string]*otaInstallEntry // 安装状态, 首次使用时从stateStore加载
+}
+
+type otaTask struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewOtaManager 新建OTA升级管理
+func NewOtaManager(installer Installer, opts ...OtaOption) *OtaManager {
+	sf := &OtaManager{
+		installer:     installer,
+		dir:           os.TempDir(),
+		httpClient:    http.DefaultClient,
+		progressStep:  DefaultOtaProgressStep,
+		downloadRetry: DefaultOtaDownloadRetry,
+		cacheTTL:      DefaultGatewayOtaCacheTTL,
+		blockSize:     DefaultOtaBlockSize,
+		blockTimeout:  DefaultOtaBlockTimeout,
+		tasks:         make(map[string]*otaTask),
+	}
+	for _, opt := range opts {
+		opt(sf)
+	}
+	return sf
+}
+
+// Upgrade 执行一次升级, 同步. 同一设备同一模块正在进行的升级将被取消
+func (sf *OtaManager) Upgrade(ctx context.Context, c *Client, pk, dn string, fw OtaFirmwareData) error {
+	key := otaTaskKey(pk, dn, fw.Module)
+	ctx, cancel := context.WithCancel(ctx)
+	task := &otaTask{cancel, make(chan struct{})}
+
+	sf.mu.Lock()
+	prev := sf.tasks[key]
+	sf.tasks[key] = task
+	sf.mu.Unlock()
+	if prev != nil {
+		prev.cancel()
+		<-prev.done
+	}
+
+	defer func() {
+		cancel()
+		sf.mu.Lock()
+		if sf.tasks[key] == task {
+			delete(sf.tasks, key)
+		}
+		sf.mu.Unlock()
+		close(task.done)
+	}()
+	return sf.upgrade(ctx, c, pk, dn, fw)
+}
+
+// Cancel 取消设备模块正在进行的升级
+func (sf *OtaManager) Cancel(pk, dn, module string) {
+	sf.mu.Lock()
+	task := sf.tasks[otaTaskKey(pk, dn, module)]
+	sf.mu.Unlock()
+	if task != nil {
+		task.cancel()
+	}
+}
+
+// HandleUpgrade 处理平台推送的升级,异步, 可作为 OtaUpgradeHandler 注册到 ModuleRegistry
+func (sf *OtaManager) HandleUpgrade(c *Client, pk, dn string, fw OtaFirmwareData) error {
+	go func() {
+		if err := sf.Upgrade(context.Background(), c, pk, dn, fw); err != nil {
+			c.Log.Errorf("ota upgrade %s module %s to %s failed, %+v", FormatKey(pk, dn), fw.Module, fw.Version, err)
+		}
+	}()
+	return nil
+}
+
+func (sf *OtaManager) upgrade(ctx context.Context, c *Client, pk, dn string, fw OtaFirmwareData) error {
+	if sf.installer == nil {
+		return sf.fail(c, pk, dn, fw.Module, OtaProgressStepUpgradeFailed, errors.New("no installer"))
+	}
+	if otaSigned(fw) {
+		if _, err := newSignHash(fw.SignMethod); err != nil {
+			return sf.fail(c, pk, dn, fw.Module, OtaProgressStepVerifyFailed, err)
+		}
+	}
+	file := otaPackagePath(sf.firmwarePath(pk, dn, fw), fw)
+	if step, err := sf.download(ctx, c, pk, dn, fw, file); err != nil {
+		return sf.fail(c, pk, dn, fw.Module, step, err)
+	}
+	if fw.IsDiff != 0 {
+		image := file + ".img"
+		err := sf.patch(ctx, pk, dn, fw, file, image)
+		os.RemoveAll(file) // nolint: errcheck
+		if err != nil {
+			return sf.fail(c, pk, dn, fw.Module, OtaProgressStepUpgradeFailed, err)
+		}
+		file = image
+	}
+	if err := sf.verifyImage(pk, dn, fw, file); err != nil {
+		os.RemoveAll(file) // nolint: errcheck
+		return sf.fail(c, pk, dn, fw.Module, OtaProgressStepVerifyFailed, err)
+	}
+	if ri, ok := sf.rollbackInstaller(); ok {
+		return sf.installAB(ctx, c, ri, pk, dn, fw, file)
+	}
+	if err := sf.installer.Install(ctx, pk, dn, fw, file); err != nil {
+		return sf.fail(c, pk, dn, fw.Module, OtaProgressStepProgramFailed, err)
+	}
+	os.RemoveAll(file) // nolint: errcheck
+	return otaInstalled(c, pk, dn, fw)
+}
+
+// download 下载并校验固件, 上报设备的下载进度, 失败时返回失败的进度码
+func (sf *OtaManager) download(ctx context.Context, c *Client, pk, dn string, fw OtaFirmwareData, path string) (int, error) {
+	return sf.obtain(ctx, c, pk, dn, fw, path, func(step int) {
+		sf.progress(c, pk, dn, fw.Module, step, "downloading")
+	})
+}
+
+// obtain 下载并校验固件, 下载进度每增加progressStep时调用report, step为[1,100], 失败时返回失败的进度码.
+// 单文件时下载到文件path, 多文件升级包时下载到目录path, 文件名为 OtaFile.Name,
+// 所有文件均校验通过后才认为下载完成
+func (sf *OtaManager) obtain(ctx context.Context, c *Client, pk, dn string, fw OtaFirmwareData, path string, report func(step int)) (int, error) {
+	progress := sf.stepper(report)
+	if len(fw.Files) == 0 {
+		if err := sf.fetch(ctx, c, pk, dn, fw, path, progress); err != nil {
+			return OtaProgressStepDownloadFailed, err
+		}
+		if err := verifyFirmware(path, &fw); err != nil {
+			os.Remove(path) // nolint: errcheck
+			return OtaProgressStepVerifyFailed, err
+		}
+		return sf.verifyDigest(pk, dn, fw, path)
+	}
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return OtaProgressStepDownloadFailed, err
+	}
+	var total, base int64
+	for _, f := range fw.Files {
+		total += f.Size
+	}
+	for _, f := range fw.Files {
+		name := filepath.Base(filepath.Clean("/" + f.Name))
+		if name == "/" || name == "." {
+			return OtaProgressStepDownloadFailed, fmt.Errorf("ota invalid file name %q", f.Name)
+		}
+		file, ffw := filepath.Join(path, name), otaFileFirmware(fw, f)
+		err := sf.fetch(ctx, c, pk, dn, ffw, file, func(done, _ int64) {
+			progress(base+done, total)
+		})
+		if err != nil {
+			return OtaProgressStepDownloadFailed, err
+		}
+		if err = verifyFirmware(file, &ffw); err != nil {
+			os.RemoveAll(path) // nolint: errcheck
+			return OtaProgressStepVerifyFailed, fmt.Errorf("file %s, %w", f.Name, err)
+		}
+		base += f.Size
+	}
+	return sf.verifyDigest(pk, dn, fw, path)
+}
+
+// verifyDigest 校验升级包的摘要签名
+func (sf *OtaManager) verifyDigest(pk, dn string, fw OtaFirmwareData, path string) (int, error) {
+	if fw.DigestSign == "" || sf.digestVerifier == nil {
+		return 0, nil
+	}
+	if err := sf.digestVerifier(pk, dn, fw, path); err != nil {
+		os.RemoveAll(path) // nolint: errcheck
+		return OtaProgressStepVerifyFailed, err
+	}
+	return 0, nil
+}
+
+// stepper 将下载进度转换为百分比, 每增加progressStep时调用report, step为[1,100]
+func (sf *OtaManager) stepper(report func(step int)) func(done, total int64) {
+	last := 0
+	return func(done, total int64) {
+		if total <= 0 {
+			return
+		}
+		step := int(done * 100 / total)
+		if step < 1 {
+			step = 1
+		}
+		if step > 100 {
+			step = 100
+		}
+		if step >= last+sf.progressStep || (step == 100 && last != 100) {
+			last = step
+			report(step)
+		}
+	}
+}
+
+// fetch 下载固件文件, 失败后从断点重试, progress 参数为已下载的大小及总大小.
+// 固件通过MQTT下载时,使用设备pk,dn的文件分片下载topic
+func (sf *OtaManager) fetch(ctx context.Context, c *Client, pk, dn string, fw OtaFirmwareData, file string, progress func(done, total int64)) error {
+	if isStreamFirmware(fw) { // 分片各自重试
+		return sf.streamDownload(ctx, c, pk, dn, fw, file, progress)
+	}
+
+	var err error
+	for i := 0; i <= sf.downloadRetry; i++ {
+		if i > 0 {
+			c.Log.Warnf("ota download %s retry %d/%d, %+v", fw.URL, i, sf.downloadRetry, err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Second * time.Duration(i)):
+			}
+		}
+		if err = httpDownload(ctx, sf.httpClient, fw.URL, file, fw.Size, progress); err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// patch 使用差分包还原镜像到文件image
+func (sf *OtaManager) patch(ctx context.Context, pk, dn string, fw OtaFirmwareData, file, image string) error {
+	if sf.patcher == nil {
+		return ErrOtaNoPatcher
+	}
+	if err := sf.patcher.Patch(ctx, pk, dn, fw, file, image); err != nil {
+		os.Remove(image) // nolint: errcheck
+		return err
+	}
+	return nil
+}
+
+// verifyImage 安装前校验镜像, 差分包还原的镜像先按extData中的镜像校验值校验,
+// 无镜像校验值且未设置 ImageVerifier 时返回 ErrOtaImageUnverified
+func (sf *OtaManager) verifyImage(pk, dn string, fw OtaFirmwareData, image string) error {
+	if fw.IsDiff != 0 {
+		if want, ok := imageDigest(fw); ok {
+			if err := verifyFirmware(image, &want); err != nil {
+				return err
+			}
+		} else if sf.imageVerifier == nil {
+			return ErrOtaImageUnverified
+		}
+	}
+	if sf.imageVerifier != nil {
+		return sf.imageVerifier(pk, dn, fw, image)
+	}
+	return nil
+}
+
+// firmwarePath 固件的下载路径
+func (sf *OtaManager) firmwarePath(pk, dn string, fw OtaFirmwareData) string {
+	name := strings.NewReplacer("/", "_", "\\", "_", ":", "_").
+		Replace(fmt.Sprintf("%s_%s_%s_%s.bin", pk, dn, moduleName(fw.Module), fw.Version))
+	return filepath.Join(sf.dir, name)
+}
+
+func (sf *OtaManager) progress(c *Client, pk, dn, module string, step int, desc string) {
+	err := c.OtaProgress(pk, dn, OtaProgressParams{Step: step, Desc: desc, Module: module})
+	if err != nil {
+		c.Log.Warnf("ota progress %s step %d, %+v", FormatKey(pk, dn), step, err)
+	}
+}
+
+// fail 上报失败进度并返回错误, 升级被取消时不上报
+func (sf *OtaManager) fail(c *Client, pk, dn, module string, step int, err error) error {
+	if !errors.Is(err, context.Canceled) {
+		sf.progress(c, pk, dn, module, step, err.Error())
+	}
+	return err
+}
+
+// onOtaConnect 设备上线, 先确认或回滚上次运行时安装的固件, 再上报所有模块的固件版本,
+// 顺序执行, 避免模块版本上报晚于确认后的新版本上报而覆盖之
+func (sf *Client) onOtaConnect(c *Client, pk, dn string, reconnect bool) {
+	if sf.ota != nil {
+		sf.ota.onConnect(c, pk, dn, reconnect)
+	}
+	if sf.modules != nil {
+		sf.modules.onConnect(c, pk, dn, reconnect)
+	}
+}
+
+// otaInstalled 安装成功, 记录并上报新的固件版本
+func otaInstalled(c *Client, pk, dn string, fw OtaFirmwareData) error {
+	if c.modules != nil {
+		if err := c.modules.SetVersion(pk, dn, fw.Module, fw.Version); err != nil {
+			c.Log.Warnf("ota save %s module %s version, %+v", FormatKey(pk, dn), fw.Module, err)
+		}
+	}
+	return c.OtaInform(pk, dn, OtaInformParams{Version: fw.Version, Module: fw.Module})
+}
+
+func otaTaskKey(pk, dn, module string) string {
+	return FormatKey(pk, dn) + "." + moduleName(module)
+}
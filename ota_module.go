@@ -0,0 +1,220 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+)
+
+// OtaDefaultModule 默认模块名, 默认模块的固件版本号等同于整个设备的固件版本号
+const OtaDefaultModule = "default"
+
+// ModuleRecord 模块固件版本持久化记录
+type ModuleRecord struct {
+	ProductKey string `json:"productKey"`
+	DeviceName string `json:"deviceName"`
+	Module     string `json:"module"`
+	Version    string `json:"version"`
+}
+
+// ModuleStore 模块固件版本持久化存储
+type ModuleStore interface {
+	// Load 加载所有模块记录,无记录时返回空
+	Load() ([]ModuleRecord, error)
+	// Save 保存所有模块记录
+	Save(records []ModuleRecord) error
+}
+
+// JSONModuleStore 基于json文件的模块固件版本存储
+type JSONModuleStore struct {
+	file jsonFile
+}
+
+var _ ModuleStore = (*JSONModuleStore)(nil)
+
+// NewJSONModuleStore 新建json文件存储
+func NewJSONModuleStore(path string) *JSONModuleStore {
+	return &JSONModuleStore{jsonFile{path: path}}
+}
+
+// Load 实现 ModuleStore 接口
+func (sf *JSONModuleStore) Load() ([]ModuleRecord, error) {
+	var records []ModuleRecord
+	if err := sf.file.load(&records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Save 实现 ModuleStore 接口, 原子替换文件, 防止写入过程中掉电损坏文件
+func (sf *JSONModuleStore) Save(records []ModuleRecord) error {
+	return sf.file.save(records)
+}
+
+// OtaUpgradeHandler 模块升级处理函数
+type OtaUpgradeHandler func(c *Client, pk, dn string, fw OtaFirmwareData) error
+
+// ModuleRegistry 设备模块固件版本注册表,协程安全.
+// 记录每个设备默认模块及其它模块的固件版本并持久化, 设备上线(含重连及子设备上线)后自动上报所有模块的版本,
+// 平台推送的升级按模块交由注册的处理函数处理, 设备注册的处理函数优先于模块注册的处理函数
+type ModuleRegistry struct {
+	store ModuleStore
+
+	rw       sync.RWMutex
+	versions map[infra.MetaPair]map[string]string // 设备 -> 模块 -> 版本
+	modules  map[string]OtaUpgradeHandler
+	devices  map[string]OtaUpgradeHandler
+}
+
+// NewModuleRegistry 新建模块固件版本注册表, store不为nil时从中加载记录
+func NewModuleRegistry(store ModuleStore) (*ModuleRegistry, error) {
+	sf := &ModuleRegistry{
+		store:    store,
+		versions: make(map[infra.MetaPair]map[string]string),
+		modules:  make(map[string]OtaUpgradeHandler),
+		devices:  make(map[string]OtaUpgradeHandler),
+	}
+	if store == nil {
+		return sf, nil
+	}
+	records, err := store.Load()
+	if err != nil {
+		return sf, err
+	}
+	for _, r := range records {
+		sf.setLocked(r.ProductKey, r.DeviceName, r.Module, r.Version)
+	}
+	return sf, nil
+}
+
+// SetVersion 设置设备模块的固件版本并持久化, module为空表示默认模块
+func (sf *ModuleRegistry) SetVersion(pk, dn, module, version string) error {
+	sf.rw.Lock()
+	defer sf.rw.Unlock()
+	sf.setLocked(pk, dn, module, version)
+	return sf.saveLocked()
+}
+
+// Version 获得设备模块的固件版本, module为空表示默认模块
+func (sf *ModuleRegistry) Version(pk, dn, module string) (string, bool) {
+	sf.rw.RLock()
+	defer sf.rw.RUnlock()
+	v, ok := sf.versions[infra.MetaPair{ProductKey: pk, DeviceName: dn}][moduleName(module)]
+	return v, ok
+}
+
+// Modules 获得设备所有模块的固件版本
+func (sf *ModuleRegistry) Modules(pk, dn string) map[string]string {
+	sf.rw.RLock()
+	defer sf.rw.RUnlock()
+	ms := make(map[string]string)
+	for m, v := range sf.versions[infra.MetaPair{ProductKey: pk, DeviceName: dn}] {
+		ms[m] = v
+	}
+	return ms
+}
+
+// Remove 删除设备模块的固件版本并持久化, 未指定module时删除设备的所有模块
+func (sf *ModuleRegistry) Remove(pk, dn string, module ...string) error {
+	key := infra.MetaPair{ProductKey: pk, DeviceName: dn}
+	sf.rw.Lock()
+	defer sf.rw.Unlock()
+	if len(module) == 0 {
+		delete(sf.versions, key)
+	} else {
+		for _, m := range module {
+			delete(sf.versions[key], moduleName(m))
+		}
+		if len(sf.versions[key]) == 0 {
+			delete(sf.versions, key)
+		}
+	}
+	return sf.saveLocked()
+}
+
+// Handle 注册模块的升级处理函数, module为空表示默认模块
+func (sf *ModuleRegistry) Handle(module string, h OtaUpgradeHandler) {
+	sf.rw.Lock()
+	sf.modules[moduleName(module)] = h
+	sf.rw.Unlock()
+}
+
+// HandleDevice 注册设备模块的升级处理函数, module为空表示默认模块
+func (sf *ModuleRegistry) HandleDevice(pk, dn, module string, h OtaUpgradeHandler) {
+	sf.rw.Lock()
+	sf.devices[FormatKey(pk, dn)+"."+moduleName(module)] = h
+	sf.rw.Unlock()
+}
+
+// Lookup 查找设备模块的升级处理函数
+func (sf *ModuleRegistry) Lookup(pk, dn, module string) (OtaUpgradeHandler, bool) {
+	module = moduleName(module)
+	sf.rw.RLock()
+	defer sf.rw.RUnlock()
+	if h, ok := sf.devices[FormatKey(pk, dn)+"."+module]; ok {
+		return h, true
+	}
+	h, ok := sf.modules[module]
+	return h, ok
+}
+
+func (sf *ModuleRegistry) setLocked(pk, dn, module, version string) {
+	key := infra.MetaPair{ProductKey: pk, DeviceName: dn}
+	ms, ok := sf.versions[key]
+	if !ok {
+		ms = make(map[string]string)
+		sf.versions[key] = ms
+	}
+	ms[moduleName(module)] = version
+}
+
+func (sf *ModuleRegistry) saveLocked() error {
+	if sf.store == nil {
+		return nil
+	}
+	records := make([]ModuleRecord, 0, len(sf.versions))
+	for dev, ms := range sf.versions {
+		for m, v := range ms {
+			records = append(records, ModuleRecord{dev.ProductKey, dev.DeviceName, m, v})
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].ProductKey != records[j].ProductKey {
+			return records[i].ProductKey < records[j].ProductKey
+		}
+		if records[i].DeviceName != records[j].DeviceName {
+			return records[i].DeviceName < records[j].DeviceName
+		}
+		return records[i].Module < records[j].Module
+	})
+	return sf.store.Save(records)
+}
+
+// onConnect 设备上线后上报所有模块的固件版本
+func (sf *ModuleRegistry) onConnect(c *Client, pk, dn string, _ bool) {
+	modules := sf.Modules(pk, dn)
+	names := make([]string, 0, len(modules))
+	for m := range modules {
+		names = append(names, m)
+	}
+	sort.Strings(names)
+	for _, m := range names {
+		err := c.OtaInform(pk, dn, OtaInformParams{Version: modules[m], Module: m})
+		if err != nil {
+			c.Log.Warnf("ota inform %s module %s, %+v", FormatKey(pk, dn), m, err)
+		}
+	}
+}
+
+// moduleName 模块名,空为默认模块
+func moduleName(module string) string {
+	if module == "" {
+		return OtaDefaultModule
+	}
+	return module
+}
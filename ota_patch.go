@@ -0,0 +1,94 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+import (
+	"context"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/thinkgos/aliyun-iot/bsdiff"
+)
+
+// Patcher 差分包还原接口, 固件为差分包(IsDiff)时使用
+type Patcher interface {
+	// Patch 使用已校验通过的差分包patch(多文件升级包时为目录)及当前安装的镜像, 还原新的镜像到文件dst
+	Patch(ctx context.Context, pk, dn string, fw OtaFirmwareData, patch, dst string) error
+}
+
+// 差分包升级时, 升级包自定义推送信息(extData)中还原后镜像的校验值
+const (
+	OtaExtImageSize = "imageSize" // 镜像大小
+	OtaExtImageMD5  = "imageMd5"  // 镜像md5
+	OtaExtImageSign = "imageSign" // 镜像签名, 签名方法同 OtaFirmwareData.SignMethod
+)
+
+// ImageVerifier 还原后镜像的校验函数, 校验失败时返回错误
+type ImageVerifier func(pk, dn string, fw OtaFirmwareData, image string) error
+
+// CurrentImageFunc 获得设备模块当前安装的镜像文件路径
+type CurrentImageFunc func(pk, dn string, fw OtaFirmwareData) (string, error)
+
+// DefaultOtaMaxImageSize 默认差分包还原后镜像的最大长度
+const DefaultOtaMaxImageSize = 256 << 20
+
+// BsdiffPatcher 基于bsdiff(BSDIFF40)格式的差分包还原
+type BsdiffPatcher struct {
+	current  CurrentImageFunc
+	maxImage int64
+}
+
+var _ Patcher = (*BsdiffPatcher)(nil)
+
+// NewBsdiffPatcher 新建bsdiff差分包还原, current 获得当前安装的镜像文件,
+// maxImage 还原后镜像的最大长度, <= 0 使用 DefaultOtaMaxImageSize
+func NewBsdiffPatcher(current CurrentImageFunc, maxImage int64) *BsdiffPatcher {
+	if maxImage <= 0 {
+		maxImage = DefaultOtaMaxImageSize
+	}
+	return &BsdiffPatcher{current, maxImage}
+}
+
+// Patch 实现 Patcher 接口
+func (sf *BsdiffPatcher) Patch(_ context.Context, pk, dn string, fw OtaFirmwareData, patch, dst string) error {
+	current, err := sf.current(pk, dn, fw)
+	if err != nil {
+		return err
+	}
+	old, err := ioutil.ReadFile(current)
+	if err != nil {
+		return err
+	}
+	diff, err := ioutil.ReadFile(patch)
+	if err != nil {
+		return err
+	}
+	image, err := bsdiff.Patch(old, diff, sf.maxImage)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dst, image, 0644)
+}
+
+// imageDigest 差分包还原后镜像的校验信息, extData中无任何镜像校验值时返回false
+func imageDigest(fw OtaFirmwareData) (OtaFirmwareData, bool) {
+	want := OtaFirmwareData{SignMethod: fw.SignMethod}
+	want.MD5 = extString(fw.ExtData, OtaExtImageMD5)
+	want.Sign = extString(fw.ExtData, OtaExtImageSign)
+	if size := extString(fw.ExtData, OtaExtImageSize); size != "" {
+		want.Size, _ = strconv.ParseInt(size, 10, 64) // nolint: errcheck
+	}
+	return want, want.MD5 != "" || want.Sign != ""
+}
+
+func extString(ext map[string]interface{}, key string) string {
+	switch v := ext[key].(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// MQTT分片下载相关定义
+const (
+	// OtaBlockSizeMin 分片的最小值
+	OtaBlockSizeMin = 256
+	// OtaBlockSizeMax 分片的最大值
+	OtaBlockSizeMax = 128 * 1024
+	// DefaultOtaBlockSize 默认分片大小
+	DefaultOtaBlockSize = 16 * 1024
+	// DefaultOtaBlockTimeout 默认单个分片请求的超时时间
+	DefaultOtaBlockTimeout = 10 * time.Second
+)
+
+// WithOtaBlockSize 设置通过MQTT下载固件时的分片大小,限制在[OtaBlockSizeMin, OtaBlockSizeMax],默认 DefaultOtaBlockSize
+func WithOtaBlockSize(size int) OtaOption {
+	return func(m *OtaManager) {
+		if size < OtaBlockSizeMin {
+			size = OtaBlockSizeMin
+		} else if size > OtaBlockSizeMax {
+			size = OtaBlockSizeMax
+		}
+		m.blockSize = size
+	}
+}
+
+// WithOtaBlockTimeout 设置通过MQTT下载固件时单个分片请求的超时时间,默认 DefaultOtaBlockTimeout
+func WithOtaBlockTimeout(t time.Duration) OtaOption {
+	return func(m *OtaManager) {
+		if t > 0 {
+			m.blockTimeout = t
+		}
+	}
+}
+
+// isStreamFirmware 固件是否通过MQTT分片下载
+func isStreamFirmware(fw OtaFirmwareData) bool {
+	return fw.DProtocol == OtaProtocolMQTT || (fw.URL == "" && fw.StreamID != 0)
+}
+
+// streamDownload 通过MQTT分片下载固件到文件path,文件已存在时从文件末尾续传,
+// 每个分片失败(超时,错误应答,CRC校验失败)后退避重试downloadRetry次.
+// progress 在每次写入后调用, 参数为已下载的大小及总大小(未知时为0)
+func (sf *OtaManager) streamDownload(ctx context.Context, c *Client, pk, dn string,
+	fw OtaFirmwareData, path string, progress func(done, total int64)) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	total := fw.Size
+	if total > 0 && offset > total {
+		if err = f.Truncate(0); err != nil {
+			return err
+		}
+		offset = 0
+	}
+
+	params := FileDownloadParams{
+		FileInfo: FileInfo{StreamID: fw.StreamID, FileID: fw.StreamFileID},
+	}
+	for total <= 0 || offset < total {
+		size := int64(sf.blockSize)
+		if total > 0 && total-offset < size {
+			size = total - offset
+		}
+		params.FileBlock = FileBlockInfo{Size: int(size), Offset: offset}
+		blk, err := sf.fetchBlock(ctx, c, pk, dn, params)
+		if err != nil {
+			return err
+		}
+		if blk.BOffset != offset || len(blk.Data) == 0 {
+			return ErrFileBlockCorrupt
+		}
+		if _, err = f.Write(blk.Data); err != nil {
+			return err
+		}
+		offset += int64(len(blk.Data))
+		params.FileToken = blk.FileToken
+		if total <= 0 {
+			total = blk.FileLength
+		}
+		progress(offset, total)
+		if total <= 0 { // 未知文件大小, 以不足一个分片作为结束
+			if len(blk.Data) < sf.blockSize {
+				break
+			}
+		}
+	}
+	if fw.Size > 0 && offset != fw.Size {
+		return errors.New("stream download, size mismatch")
+	}
+	return nil
+}
+
+// fetchBlock 请求一个分片, 失败后退避重试, 第i次重试前等待i秒
+func (sf *OtaManager) fetchBlock(ctx context.Context, c *Client, pk, dn string, params FileDownloadParams) (FileBlock, error) {
+	var blk FileBlock
+	var err error
+	for i := 0; i <= sf.downloadRetry; i++ {
+		if i > 0 {
+			c.Log.Warnf("ota stream %d block @%d retry %d/%d, %+v",
+				params.FileInfo.StreamID, params.FileBlock.Offset, i, sf.downloadRetry, err)
+			select {
+			case <-ctx.Done():
+				return blk, ctx.Err()
+			case <-time.After(time.Second * time.Duration(i)):
+			}
+		}
+		actx, cancel := context.WithTimeout(ctx, sf.blockTimeout)
+		blk, err = c.LinkThingFileDownloadContext(actx, pk, dn, params)
+		cancel()
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		err = waitError(err)
+	}
+	if ctx.Err() != nil {
+		return blk, ctx.Err()
+	}
+	return blk, err
+}
@@ -0,0 +1,174 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+)
+
+// OutboundMessage 离线队列中的消息
+type OutboundMessage struct {
+	Topic     string `json:"topic"`
+	Qos       byte   `json:"qos"`
+	Payload   []byte `json:"payload"`
+	ID        uint   `json:"id,omitempty"` // 请求ID, 0表示无需应答
+	Timestamp int64  `json:"timestamp"`    // 入队时间,单位ms
+}
+
+// OutboundQueue 离线发送队列,须按入队顺序出队,协程安全
+type OutboundQueue interface {
+	// Push 入队
+	Push(msg OutboundMessage) error
+	// Front 获取队首消息但不出队,队列为空时返回 ErrNotFound
+	Front() (OutboundMessage, error)
+	// Pop 队首消息出队
+	Pop() error
+	// Len 队列中消息个数
+	Len() int
+}
+
+// setOffline 设置连接状态
+func (sf *Client) setOffline(offline bool) {
+	if offline {
+		atomic.StoreUint32(&sf.offline, 1)
+	} else {
+		atomic.StoreUint32(&sf.offline, 0)
+	}
+}
+
+// IsOffline 连接是否已断开
+func (sf *Client) IsOffline() bool {
+	return atomic.LoadUint32(&sf.offline) == 1
+}
+
+// publish 发布消息,配置了离线队列时,连接断开或发布失败的QoS1消息进入离线队列,
+// 待重连后按序重发. 离线队列正在重发或非空时,新消息同样进入离线队列,以免先于队列中的消息发送.
+// 返回消息是否已入队
+// id: 请求ID, 0表示无需应答
+func (sf *Client) publish(_uri string, qos byte, id uint, payload []byte) (bool, error) {
+	if sf.outbound == nil || qos == 0 {
+		return false, sf.Publish(_uri, qos, payload)
+	}
+	msg := OutboundMessage{
+		_uri,
+		qos,
+		payload,
+		id,
+		infra.Millisecond(time.Now()),
+	}
+	if !sf.IsOffline() {
+		sf.outboundMu.Lock()
+		if sf.replaying || sf.outbound.Len() > 0 {
+			err := sf.outbound.Push(msg)
+			sf.outboundMu.Unlock()
+			return err == nil, err
+		}
+		sf.outboundMu.Unlock()
+
+		err := sf.Publish(_uri, qos, payload)
+		if err == nil {
+			return false, nil
+		}
+		sf.logFor(_uri).Warnf("publish %s failed, push to outbound queue, %+v", _uri, err)
+	}
+	sf.outboundMu.Lock()
+	err := sf.outbound.Push(msg)
+	sf.outboundMu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// publishPayload 同publish, payload 仅支持 []byte 和 string 入队,其它类型直接发布
+func (sf *Client) publishPayload(_uri string, qos byte, payload interface{}) error {
+	if err := sf.waitLimit(context.Background(), _uri); err != nil {
+		return err
+	}
+	var err error
+
+	switch v := payload.(type) {
+	case []byte:
+		_, err = sf.publish(_uri, qos, 0, v)
+	case string:
+		_, err = sf.publish(_uri, qos, 0, []byte(v))
+	default:
+		err = sf.Publish(_uri, qos, payload)
+	}
+	return err
+}
+
+// replayOutbound 按序重发离线队列中的消息,发布失败时停止重发,剩余消息保留在队列中.
+// 发布期间队首消息可能因超出队列限制被丢弃, 出队前确认队首仍为已发布的消息
+func (sf *Client) replayOutbound() {
+	if sf.outbound == nil {
+		return
+	}
+	sf.replayMu.Lock()
+	defer sf.replayMu.Unlock()
+
+	sf.outboundMu.Lock()
+	sf.replaying = true
+	sf.outboundMu.Unlock()
+	defer func() {
+		sf.outboundMu.Lock()
+		sf.replaying = false
+		sf.outboundMu.Unlock()
+	}()
+
+	count := 0
+	for !sf.IsOffline() {
+		msg, err := sf.outbound.Front()
+		if err != nil {
+			if err != ErrNotFound {
+				sf.Log.Errorf("outbound queue front, %+v", err)
+			}
+			break
+		}
+		if msg.ID != 0 {
+			sf.releasePending(msg.ID)
+		}
+		if err = sf.Publish(msg.Topic, msg.Qos, msg.Payload); err != nil {
+			sf.logFor(msg.Topic).Warnf("replay outbound message %s, %+v", msg.Topic, err)
+			break
+		}
+		if err = sf.popOutbound(msg); err != nil {
+			sf.Log.Errorf("outbound queue pop, %+v", err)
+			break
+		}
+		count++
+	}
+	sf.Log.Infof("replay outbound message: %d, remain: %d", count, sf.outbound.Len())
+}
+
+// popOutbound 队首仍为msg时出队
+func (sf *Client) popOutbound(msg OutboundMessage) error {
+	sf.outboundMu.Lock()
+	defer sf.outboundMu.Unlock()
+	head, err := sf.outbound.Front()
+	if err != nil {
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	if !sameOutbound(head, msg) {
+		return nil
+	}
+	return sf.outbound.Pop()
+}
+
+func sameOutbound(a, b OutboundMessage) bool {
+	return a.ID == b.ID &&
+		a.Timestamp == b.Timestamp &&
+		a.Qos == b.Qos &&
+		a.Topic == b.Topic &&
+		bytes.Equal(a.Payload, b.Payload)
+}
@@ -0,0 +1,246 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+)
+
+// fileQueueCompactMin 文件中失效记录数达到该值且多于有效消息数时,压缩文件
+const fileQueueCompactMin = 128
+
+// FileQueue 基于文件的离线队列,文件为追加写入的日志,每行为一条记录:
+// json格式的消息,或 "-n" 表示从队首移除n条消息.
+// 入队,出队及丢弃消息时只追加一行记录并落盘,失效记录累积到一定数量时再整体压缩重写文件.
+// 队列消息负载总大小超过maxSize或消息保存时间超过maxAge时,将丢弃最旧的消息.
+type FileQueue struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	size    int64
+	msgs    []OutboundMessage
+	dead    int  // 文件中已失效的记录行数
+	exist   bool // 文件是否已创建
+}
+
+var _ OutboundQueue = (*FileQueue)(nil)
+
+// NewFileQueue 新建文件离线队列,文件已存在时将加载文件中的消息
+// maxSize: 消息负载总大小上限,单位byte, <= 0 表示不限制
+// maxAge: 消息最长保存时间, <= 0 表示不限制
+func NewFileQueue(path string, maxSize int64, maxAge time.Duration) (*FileQueue, error) {
+	sf := &FileQueue{
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sf.exist = err == nil
+	// 丢弃未完整写入的最后一行,比如写入过程中掉电
+	if i := bytes.LastIndexByte(b, '\n'); i+1 < len(b) {
+		b = b[:i+1]
+		sf.dead++
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(b)+1)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == '-' {
+			if n, err := strconv.Atoi(string(line[1:])); err == nil {
+				sf.removeLocked(n)
+			}
+			sf.dead++
+			continue
+		}
+		msg := OutboundMessage{}
+		if err = json.Unmarshal(line, &msg); err != nil {
+			sf.dead++ // 丢弃损坏的记录
+			continue
+		}
+		sf.msgs = append(sf.msgs, msg)
+		sf.size += int64(len(msg.Payload))
+	}
+	sf.dropLocked(0)
+	if sf.dead > 0 {
+		if err = sf.compactLocked(); err != nil {
+			return nil, err
+		}
+	}
+	return sf, nil
+}
+
+// Push 实现 OutboundQueue 接口
+func (sf *FileQueue) Push(msg OutboundMessage) error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	sf.msgs = append(sf.msgs, msg)
+	sf.size += int64(len(msg.Payload))
+	n := sf.dropLocked(0)
+	if n > 0 {
+		sf.dead++ // 移除记录本身
+	}
+	if sf.compactNeededLocked() {
+		return sf.compactLocked()
+	}
+	if n == 0 {
+		return sf.appendLocked(b)
+	}
+	return sf.appendLocked(b, removeRecord(n))
+}
+
+// Front 实现 OutboundQueue 接口
+func (sf *FileQueue) Front() (OutboundMessage, error) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	if err := sf.commitLocked(sf.dropLocked(0)); err != nil {
+		return OutboundMessage{}, err
+	}
+	if len(sf.msgs) == 0 {
+		return OutboundMessage{}, ErrNotFound
+	}
+	return sf.msgs[0], nil
+}
+
+// Pop 实现 OutboundQueue 接口
+func (sf *FileQueue) Pop() error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	if len(sf.msgs) == 0 {
+		return nil
+	}
+	return sf.commitLocked(sf.dropLocked(1))
+}
+
+// Len 实现 OutboundQueue 接口
+func (sf *FileQueue) Len() int {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return len(sf.msgs)
+}
+
+// dropLocked 丢弃队首n个消息,及超出大小限制或过期的消息,返回被丢弃的消息数
+func (sf *FileQueue) dropLocked(n int) int {
+	var deadline int64
+
+	if sf.maxAge > 0 {
+		deadline = infra.Millisecond(time.Now().Add(-sf.maxAge))
+	}
+	size := sf.size
+	i := 0
+	for ; i < len(sf.msgs); i++ {
+		if i >= n &&
+			(sf.maxSize <= 0 || size <= sf.maxSize) &&
+			(deadline == 0 || sf.msgs[i].Timestamp >= deadline) {
+			break
+		}
+		size -= int64(len(sf.msgs[i].Payload))
+	}
+	sf.removeLocked(i)
+	return i
+}
+
+// removeLocked 从内存中移除队首n个消息,对应的消息记录变为失效记录
+func (sf *FileQueue) removeLocked(n int) {
+	if n > len(sf.msgs) {
+		n = len(sf.msgs)
+	}
+	if n <= 0 {
+		return
+	}
+	for _, msg := range sf.msgs[:n] {
+		sf.size -= int64(len(msg.Payload))
+	}
+	sf.msgs = append(sf.msgs[:0], sf.msgs[n:]...)
+	sf.dead += n
+}
+
+// commitLocked 记录队首n个消息已移除
+func (sf *FileQueue) commitLocked(n int) error {
+	if n == 0 {
+		return nil
+	}
+	sf.dead++ // 移除记录本身
+	if sf.compactNeededLocked() {
+		return sf.compactLocked()
+	}
+	return sf.appendLocked(removeRecord(n))
+}
+
+func (sf *FileQueue) compactNeededLocked() bool {
+	return sf.dead >= fileQueueCompactMin && sf.dead > len(sf.msgs)
+}
+
+// appendLocked 追加写入记录并落盘
+func (sf *FileQueue) appendLocked(records ...[]byte) error {
+	f, err := os.OpenFile(sf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	buf := bytes.Buffer{}
+	for _, r := range records {
+		buf.Write(r)
+		buf.WriteByte('\n')
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil && !sf.exist {
+		if err = syncDir(filepath.Dir(sf.path)); err == nil {
+			sf.exist = true
+		}
+	}
+	return err
+}
+
+// compactLocked 仅保留有效消息,整体重写文件
+func (sf *FileQueue) compactLocked() error {
+	buf := bytes.Buffer{}
+	for _, msg := range sf.msgs {
+		b, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	if err := writeFileAtomic(sf.path, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	sf.dead = 0
+	sf.exist = true
+	return nil
+}
+
+func removeRecord(n int) []byte {
+	return []byte("-" + strconv.Itoa(n))
+}
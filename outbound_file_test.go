@@ -0,0 +1,196 @@
+package aiot
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+	"github.com/thinkgos/aliyun-iot/uri"
+)
+
+func newTestMessage(topic, payload string) OutboundMessage {
+	return OutboundMessage{
+		Topic:     topic,
+		Qos:       1,
+		Payload:   []byte(payload),
+		Timestamp: infra.Millisecond(time.Now()),
+	}
+}
+
+func fileLines(t *testing.T, path string) int {
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	return bytes.Count(b, []byte{'\n'})
+}
+
+func TestFileQueue_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbound.log")
+
+	q, err := NewFileQueue(path, 0, 0)
+	require.NoError(t, err)
+	for _, s := range []string{"a", "b", "c"} {
+		require.NoError(t, q.Push(newTestMessage("t/"+s, s)))
+	}
+	require.NoError(t, q.Pop())
+	assert.Equal(t, 4, fileLines(t, path), "3 messages and 1 remove record")
+
+	// 模拟写入过程中掉电, 最后一行不完整
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"topic":"t/d","qo`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	q, err = NewFileQueue(path, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, q.Len())
+	assert.Equal(t, 2, fileLines(t, path), "reload should compact dead records")
+
+	for _, want := range []string{"b", "c"} {
+		msg, err := q.Front()
+		require.NoError(t, err)
+		assert.Equal(t, "t/"+want, msg.Topic)
+		assert.Equal(t, want, string(msg.Payload))
+		require.NoError(t, q.Pop())
+	}
+	_, err = q.Front()
+	assert.Equal(t, ErrNotFound, err)
+
+	q, err = NewFileQueue(path, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestFileQueue_Limit(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("max size", func(t *testing.T) {
+		path := filepath.Join(dir, "size.log")
+		q, err := NewFileQueue(path, 8, 0)
+		require.NoError(t, err)
+		for _, s := range []string{"aaaa", "bbbb", "cccc"} {
+			require.NoError(t, q.Push(newTestMessage("t", s)))
+		}
+		assert.Equal(t, 2, q.Len())
+		msg, err := q.Front()
+		require.NoError(t, err)
+		assert.Equal(t, "bbbb", string(msg.Payload))
+
+		q, err = NewFileQueue(path, 8, 0)
+		require.NoError(t, err)
+		assert.Equal(t, 2, q.Len())
+	})
+	t.Run("max age", func(t *testing.T) {
+		path := filepath.Join(dir, "age.log")
+		q, err := NewFileQueue(path, 0, time.Minute)
+		require.NoError(t, err)
+		old := newTestMessage("t", "old")
+		old.Timestamp = infra.Millisecond(time.Now().Add(-time.Hour))
+		require.NoError(t, q.Push(old))
+		require.NoError(t, q.Push(newTestMessage("t", "new")))
+		assert.Equal(t, 1, q.Len())
+
+		q, err = NewFileQueue(path, 0, time.Minute)
+		require.NoError(t, err)
+		msg, err := q.Front()
+		require.NoError(t, err)
+		assert.Equal(t, "new", string(msg.Payload))
+	})
+}
+
+func TestFileQueue_Compact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbound.log")
+	q, err := NewFileQueue(path, 0, 0)
+	require.NoError(t, err)
+
+	for i := 0; i < fileQueueCompactMin*2; i++ {
+		require.NoError(t, q.Push(newTestMessage("t", "x")))
+		require.NoError(t, q.Pop())
+	}
+	require.NoError(t, q.Push(newTestMessage("t", "keep")))
+	assert.Equal(t, 1, q.Len())
+	assert.LessOrEqual(t, fileLines(t, path), fileQueueCompactMin+1, "dead records should be compacted")
+
+	q, err = NewFileQueue(path, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, q.Len())
+}
+
+func TestClient_ReplayOutbound(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbound.log")
+	q, err := NewFileQueue(path, 0, 0)
+	require.NoError(t, err)
+
+	c, conn := newFakeClient(func(_ string, req fakeRequest) (Response, bool) {
+		return Response{ID: req.ID, Code: infra.CodeSuccess, Data: struct{}{}}, true
+	}, WithOutboundQueue(q, time.Minute), WithPendingExpiration(time.Second))
+
+	// 连接断开, 请求进入离线队列
+	conn.setOffline(true)
+	c.setOffline(true)
+	token, err := c.ThingEventPropertyPostContext(context.Background(), "pk", "dn", map[string]int{"a": 1})
+	require.NoError(t, err)
+	require.NoError(t, c.publishPayload("/test/raw", 1, []byte("raw")))
+	c.failSentPending(ErrConnLost)
+	assert.Equal(t, 1, c.PendingLen(), "queued request should be kept")
+
+	reload, err := NewFileQueue(path, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, reload.Len())
+
+	// 重连后按序重发
+	conn.setOffline(false)
+	c.setOffline(false)
+	c.replayOutbound()
+	_, err = token.WaitContext(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, q.Len())
+	assert.Equal(t, []string{
+		uri.URI(uri.SysPrefix, uri.ThingEventPropertyPost, "pk", "dn"),
+		"/test/raw",
+	}, conn.topics())
+
+	reload, err = NewFileQueue(path, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, reload.Len())
+}
+
+func TestClient_ReplayOutboundEvicted(t *testing.T) {
+	q, err := NewFileQueue(filepath.Join(t.TempDir(), "outbound.log"), 8, 0)
+	require.NoError(t, err)
+	c, conn := newFakeClient(nil, WithOutboundQueue(q, time.Minute))
+
+	conn.setOffline(true)
+	c.setOffline(true)
+	require.NoError(t, c.publishPayload("/t/a", 1, "aaaa"))
+	require.NoError(t, c.publishPayload("/t/b", 1, "bbbb"))
+	conn.setOffline(false)
+	c.setOffline(false)
+
+	// 重发a期间有新消息, 新消息入队并挤出队首的a
+	var once sync.Once
+	conn.setOnPublish(func(topic string) {
+		if topic == "/t/a" {
+			once.Do(func() {
+				require.NoError(t, c.publishPayload("/t/c", 1, "cccc"))
+			})
+		}
+	})
+	c.replayOutbound()
+	assert.Equal(t, []string{"/t/a", "/t/b", "/t/c"}, conn.topics())
+	assert.Equal(t, 0, q.Len())
+
+	// 队列为空后直接发布
+	require.NoError(t, c.publishPayload("/t/d", 1, "dddd"))
+	assert.Equal(t, 0, q.Len())
+	assert.Equal(t, []string{"/t/a", "/t/b", "/t/c", "/t/d"}, conn.topics())
+}
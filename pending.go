@@ -0,0 +1,333 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 最近超时或被取消的请求ID保留个数,用于区分迟到的应答与未知的应答
+const pendingExpiredSize = 256
+
+// UnmatchedReplyHook 收到无法匹配在途请求的应答时的回调
+// late: true 表示该请求已超时或被取消,应答迟到; false 表示该ID未知(未发送过或已过久)
+type UnmatchedReplyHook func(c *Client, id uint, late bool)
+
+// resendState 在途请求重发所需的数据
+type resendState struct {
+	uri     string
+	qos     byte
+	payload []byte
+}
+
+// pendingEntry 在途请求条目
+type pendingEntry struct {
+	token    *Token
+	timer    *time.Timer
+	held     bool // 请求已进入离线队列,等待重发
+	resend   *resendState
+	attempts int // 已重发次数
+}
+
+// pending 在途请求表
+// 每个请求有独立的超时,超时后立即移除,不依赖后台清理协程.
+type pending struct {
+	mu         sync.Mutex
+	entries    map[uint]*pendingEntry
+	expiration time.Duration // 请求默认超时时间
+	slots      chan struct{} // 在途请求数限制,为nil时不限制
+
+	// 最近超时或取消的请求ID, ring buffer
+	expired    map[uint]struct{}
+	expiredIDs []uint
+	expiredPos int
+}
+
+func newPending(expiration time.Duration, maxInflight int) *pending {
+	p := &pending{
+		entries:    make(map[uint]*pendingEntry),
+		expiration: expiration,
+		expired:    make(map[uint]struct{}, pendingExpiredSize),
+		expiredIDs: make([]uint, 0, pendingExpiredSize),
+	}
+	if maxInflight > 0 {
+		p.slots = make(chan struct{}, maxInflight)
+	}
+	return p
+}
+
+// put 插入一个在途请求,在途请求数已达上限时阻塞,直到有空位或ctx完成,
+// ID与在途请求冲突时返回 ErrRequestIDInUse, 不影响已有的请求
+func (sf *pending) put(ctx context.Context, c *Client, id uint) (*Token, error) {
+	if sf.has(id) {
+		return nil, ErrRequestIDInUse
+	}
+	if sf.slots != nil {
+		select {
+		case sf.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	token := &Token{id, c, make(chan Message, 1)}
+	sf.mu.Lock()
+	if _, ok := sf.entries[id]; ok {
+		sf.mu.Unlock()
+		if sf.slots != nil {
+			<-sf.slots
+		}
+		return nil, ErrRequestIDInUse
+	}
+	sf.entries[id] = &pendingEntry{
+		token,
+		time.AfterFunc(sf.expiration, func() { sf.expire(id) }),
+		false,
+		nil,
+		0,
+	}
+	sf.mu.Unlock()
+	return token, nil
+}
+
+// deadline 设置请求的截止时间
+func (sf *pending) deadline(id uint, tm time.Time) {
+	sf.mu.Lock()
+	if entry, ok := sf.entries[id]; ok {
+		entry.timer.Reset(time.Until(tm))
+		entry.held = false
+	}
+	sf.mu.Unlock()
+}
+
+// hold 请求进入离线队列,超时时间延长为d,直到重发
+func (sf *pending) hold(id uint, d time.Duration) {
+	sf.mu.Lock()
+	if entry, ok := sf.entries[id]; ok {
+		entry.timer.Reset(d)
+		entry.held = true
+	}
+	sf.mu.Unlock()
+}
+
+// release 离线队列中的请求已重发,恢复默认超时时间,
+// 等待者已设置截止时间的不做处理
+func (sf *pending) release(id uint) {
+	sf.mu.Lock()
+	if entry, ok := sf.entries[id]; ok && entry.held {
+		entry.timer.Reset(sf.expiration)
+		entry.held = false
+	}
+	sf.mu.Unlock()
+}
+
+// track 记录请求重发所需的数据
+func (sf *pending) track(id uint, r resendState) {
+	sf.mu.Lock()
+	if entry, ok := sf.entries[id]; ok {
+		entry.resend = &r
+	}
+	sf.mu.Unlock()
+}
+
+// retry 请求需重发,未超过最大重发次数时返回重发数据及本次重发次数
+func (sf *pending) retry(id uint, maxRetry int) (resendState, int, bool) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	entry, ok := sf.entries[id]
+	if !ok || entry.resend == nil || entry.attempts >= maxRetry {
+		return resendState{}, 0, false
+	}
+	entry.attempts++
+	return *entry.resend, entry.attempts, true
+}
+
+// has 是否存在在途请求
+func (sf *pending) has(id uint) bool {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	_, ok := sf.entries[id]
+	return ok
+}
+
+// takeLocked 移除条目并释放在途请求占位
+func (sf *pending) takeLocked(id uint) (*pendingEntry, bool) {
+	entry, ok := sf.entries[id]
+	if !ok {
+		return nil, false
+	}
+	delete(sf.entries, id)
+	entry.timer.Stop()
+	if sf.slots != nil {
+		<-sf.slots
+	}
+	return entry, true
+}
+
+// markExpiredLocked 记录已超时或取消的请求ID
+func (sf *pending) markExpiredLocked(id uint) {
+	if len(sf.expiredIDs) < pendingExpiredSize {
+		sf.expiredIDs = append(sf.expiredIDs, id)
+	} else {
+		delete(sf.expired, sf.expiredIDs[sf.expiredPos])
+		sf.expiredIDs[sf.expiredPos] = id
+		sf.expiredPos = (sf.expiredPos + 1) % pendingExpiredSize
+	}
+	sf.expired[id] = struct{}{}
+}
+
+// expire 请求超时
+func (sf *pending) expire(id uint) {
+	sf.mu.Lock()
+	entry, ok := sf.takeLocked(id)
+	if ok {
+		sf.markExpiredLocked(id)
+	}
+	sf.mu.Unlock()
+	if ok {
+		entry.token.notify(Message{ID: id, err: ErrWaitTimeout})
+	}
+}
+
+// remove 移除请求, expired 为true表示请求被等待者放弃,之后到达的应答视为迟到
+func (sf *pending) remove(id uint, expired bool) {
+	sf.mu.Lock()
+	if _, ok := sf.takeLocked(id); ok && expired {
+		sf.markExpiredLocked(id)
+	}
+	sf.mu.Unlock()
+}
+
+// signal 请求收到回复,返回是否匹配到在途请求,未匹配时返回是否为迟到的应答
+func (sf *pending) signal(msg Message) (matched, late bool) {
+	sf.mu.Lock()
+	entry, ok := sf.takeLocked(msg.ID)
+	if !ok {
+		_, late = sf.expired[msg.ID]
+	}
+	sf.mu.Unlock()
+	if ok {
+		entry.token.notify(msg)
+	}
+	return ok, late
+}
+
+// failAll 以指定错误结束所有在途请求, keepHeld 为true时保留离线队列中等待重发的请求
+func (sf *pending) failAll(err error, keepHeld bool) {
+	sf.mu.Lock()
+	entries := make([]*pendingEntry, 0, len(sf.entries))
+	for id, entry := range sf.entries {
+		if keepHeld && entry.held {
+			continue
+		}
+		sf.takeLocked(id)
+		entries = append(entries, entry)
+	}
+	sf.mu.Unlock()
+	for _, entry := range entries {
+		entry.token.notify(Message{ID: entry.token.id, err: err})
+	}
+}
+
+// len 在途请求数
+func (sf *pending) len() int {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return len(sf.entries)
+}
+
+// putPending 插入指定ID的在途请求,非MQTT模式下返回已关闭的Token
+func (sf *Client) putPending(ctx context.Context, id uint) (*Token, error) {
+	if sf.mode != ModeMQTT {
+		return &Token{message: closedchan}, nil
+	}
+	return sf.pending.put(ctx, sf, id)
+}
+
+// sendPending 先登记在途请求再发送,发送失败时移除登记.
+// 请求进入离线队列时,在途请求保留至重发后再开始计时
+func (sf *Client) sendPending(ctx context.Context, _uri string, qos byte, id uint, payload []byte) (*Token, error) {
+	token, err := sf.putPending(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if sf.limiter != nil && sf.pending != nil {
+		sf.pending.track(id, resendState{_uri, qos, payload})
+	}
+	queued, err := sf.publish(_uri, qos, id, payload)
+	if err != nil {
+		sf.removePending(id)
+		return nil, err
+	}
+	if queued && sf.pending != nil {
+		sf.pending.hold(id, sf.outboundHold)
+	}
+	return token, nil
+}
+
+// setPendingDeadline 设置在途请求的截止时间
+func (sf *Client) setPendingDeadline(id uint, tm time.Time) {
+	if sf.pending != nil {
+		sf.pending.deadline(id, tm)
+	}
+}
+
+// releasePending 离线队列中的请求已重发
+func (sf *Client) releasePending(id uint) {
+	if sf.pending != nil {
+		sf.pending.release(id)
+	}
+}
+
+// removePending 移除指定ID的在途请求
+func (sf *Client) removePending(id uint) {
+	if sf.pending != nil {
+		sf.pending.remove(id, false)
+	}
+}
+
+// cancelPending 等待者放弃指定ID的在途请求, 之后的应答将视为迟到
+func (sf *Client) cancelPending(id uint) {
+	if sf.pending != nil {
+		sf.pending.remove(id, true)
+	}
+}
+
+// signalPending 指定缓存id收到回复,并发出同步通知,
+// 配置限流时,平台限流应答将在退避后重发请求,不通知等待者
+func (sf *Client) signalPending(msg Message) {
+	if sf.pending == nil || sf.retryThrottled(msg) {
+		return
+	}
+	if matched, late := sf.pending.signal(msg); !matched {
+		sf.Log.Debugf("unmatched reply @%d, late: %t", msg.ID, late)
+		if sf.unmatchedReplyHook != nil {
+			sf.unmatchedReplyHook(sf, msg.ID, late)
+		}
+	}
+}
+
+// failPending 以指定错误结束所有在途请求
+func (sf *Client) failPending(err error) {
+	if sf.pending != nil {
+		sf.pending.failAll(err, false)
+	}
+}
+
+// failSentPending 以指定错误结束已发送的在途请求, 离线队列中的请求保留至重发
+func (sf *Client) failSentPending(err error) {
+	if sf.pending != nil {
+		sf.pending.failAll(err, true)
+	}
+}
+
+// PendingLen 当前在途请求数
+func (sf *Client) PendingLen() int {
+	if sf.pending == nil {
+		return 0
+	}
+	return sf.pending.len()
+}
@@ -0,0 +1,193 @@
+package aiot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thinkgos/aliyun-iot/uri"
+)
+
+func TestPending_Expire(t *testing.T) {
+	p := newPending(20*time.Millisecond, 0)
+
+	token, err := p.put(context.Background(), nil, 1)
+	require.NoError(t, err)
+	_, err = token.WaitContext(context.Background())
+	assert.Equal(t, ErrWaitTimeout, err)
+	assert.Equal(t, 0, p.len())
+
+	matched, late := p.signal(Message{ID: 1})
+	assert.False(t, matched)
+	assert.True(t, late, "reply after expiration should be late")
+
+	matched, late = p.signal(Message{ID: 2})
+	assert.False(t, matched)
+	assert.False(t, late, "never sent id should be unknown")
+}
+
+func TestPending_Signal(t *testing.T) {
+	p := newPending(time.Minute, 0)
+
+	token, err := p.put(context.Background(), nil, 1)
+	require.NoError(t, err)
+	matched, _ := p.signal(Message{ID: 1, Data: "ok"})
+	assert.True(t, matched)
+
+	m, err := token.WaitContext(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ok", m.Data)
+	assert.Equal(t, 0, p.len())
+
+	// 被等待者放弃的请求, 之后的应答为迟到
+	_, err = p.put(context.Background(), nil, 2)
+	require.NoError(t, err)
+	p.remove(2, true)
+	matched, late := p.signal(Message{ID: 2})
+	assert.False(t, matched)
+	assert.True(t, late)
+
+	// 发送失败移除的请求, 之后的应答为未知
+	_, err = p.put(context.Background(), nil, 3)
+	require.NoError(t, err)
+	p.remove(3, false)
+	_, late = p.signal(Message{ID: 3})
+	assert.False(t, late)
+}
+
+func TestPending_ExpiredRing(t *testing.T) {
+	p := newPending(time.Minute, 0)
+	for id := uint(1); id <= pendingExpiredSize+1; id++ {
+		_, err := p.put(context.Background(), nil, id)
+		require.NoError(t, err)
+		p.remove(id, true)
+	}
+	// 最早的ID已被挤出
+	_, late := p.signal(Message{ID: 1})
+	assert.False(t, late)
+	_, late = p.signal(Message{ID: 2})
+	assert.True(t, late)
+	_, late = p.signal(Message{ID: pendingExpiredSize + 1})
+	assert.True(t, late)
+}
+
+func TestPending_MaxInflight(t *testing.T) {
+	p := newPending(time.Minute, 2)
+
+	for id := uint(1); id <= 2; id++ {
+		_, err := p.put(context.Background(), nil, id)
+		require.NoError(t, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	_, err := p.put(ctx, nil, 3)
+	cancel()
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 2, p.len())
+
+	// 应答释放占位后可继续插入
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.put(context.Background(), nil, 3)
+		done <- err
+	}()
+	p.signal(Message{ID: 1})
+	select {
+	case err = <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("put blocked after slot released")
+	}
+
+	// 超时同样释放占位
+	p.expire(2)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = p.put(ctx, nil, 4)
+	assert.NoError(t, err)
+}
+
+func TestPending_IDCollision(t *testing.T) {
+	p := newPending(30*time.Millisecond, 1)
+
+	token, err := p.put(context.Background(), nil, 1)
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	// 冲突的ID被拒绝, 不占用在途请求数
+	_, err = p.put(context.Background(), nil, 1)
+	assert.Equal(t, ErrRequestIDInUse, err)
+	assert.Equal(t, 1, p.len())
+
+	// 已有的请求按原定时间超时
+	_, err = token.WaitContext(context.Background())
+	assert.Equal(t, ErrWaitTimeout, err)
+
+	// 占位已释放, 可再次使用该ID
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	token, err = p.put(ctx, nil, 1)
+	require.NoError(t, err)
+	matched, _ := p.signal(Message{ID: 1, Data: "ok"})
+	assert.True(t, matched)
+	m, err := token.WaitContext(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ok", m.Data)
+}
+
+func TestPending_FailAll(t *testing.T) {
+	errLost := errors.New("connection lost")
+	p := newPending(time.Minute, 0)
+
+	sent, err := p.put(context.Background(), nil, 1)
+	require.NoError(t, err)
+	held, err := p.put(context.Background(), nil, 2)
+	require.NoError(t, err)
+	p.hold(2, time.Minute)
+
+	p.failAll(errLost, true)
+	_, err = sent.WaitContext(context.Background())
+	assert.Equal(t, errLost, err)
+	assert.True(t, p.has(2), "held request should be kept")
+
+	// 重发后恢复计时, 不再保留
+	p.release(2)
+	p.failAll(errLost, true)
+	_, err = held.WaitContext(context.Background())
+	assert.Equal(t, errLost, err)
+	assert.Equal(t, 0, p.len())
+}
+
+func TestClient_LateReply(t *testing.T) {
+	type unmatched struct {
+		id   uint
+		late bool
+	}
+	ch := make(chan unmatched, 2)
+	c, conn := newFakeClient(nil,
+		WithPendingExpiration(20*time.Millisecond),
+		WithUnmatchedReplyHook(func(_ *Client, id uint, late bool) {
+			ch <- unmatched{id, late}
+		}))
+
+	token, err := c.ThingEventPropertyPostContext(context.Background(), "pk", "dn", map[string]int{"a": 1})
+	require.NoError(t, err)
+	_, err = token.WaitContext(context.Background())
+	require.Equal(t, ErrWaitTimeout, err)
+
+	replyURI := uri.URI(uri.SysPrefix, uri.ThingEventPropertyPostReply, "pk", "dn")
+	for _, want := range []unmatched{{token.id, true}, {token.id + 1000, false}} {
+		payload := fmt.Sprintf(`{"id":"%d","code":200,"data":{}}`, want.id)
+		require.NoError(t, conn.deliver(replyURI, []byte(payload)))
+		select {
+		case got := <-ch:
+			assert.Equal(t, want, got)
+		case <-time.After(time.Second):
+			t.Fatal("unmatched reply hook not called")
+		}
+	}
+	assert.Equal(t, 0, c.PendingLen())
+}
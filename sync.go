@@ -5,7 +5,7 @@
 package aiot
 
 import (
-	"strconv"
+	"context"
 	"time"
 )
 
@@ -19,6 +19,8 @@ type Message struct {
 
 // Token defines the interface for the tokens used to indicate when actions have completed.
 type Token struct {
+	id      uint
+	client  *Client
 	message chan Message
 }
 
@@ -30,38 +32,46 @@ func init() {
 }
 
 // Wait the entry response,return ID,Data and error
-func (sf *Token) Wait(timeout time.Duration) (m Message, err error) {
-	tm := time.NewTimer(timeout)
-	defer tm.Stop()
+func (sf *Token) Wait(timeout time.Duration) (Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	m, err := sf.WaitContext(ctx)
+	return m, waitError(err)
+}
+
+// WaitContext wait the entry response until ctx done,return ID,Data and error
+// ctx带有截止时间时,在途请求的超时时间将与之一致.
+// ctx取消或超时时,将从在途请求中移除该条目,并返回ctx.Err()
+func (sf *Token) WaitContext(ctx context.Context) (m Message, err error) {
+	if tm, ok := ctx.Deadline(); ok && sf.client != nil {
+		sf.client.setPendingDeadline(sf.id, tm)
+	}
 	select {
 	case m, ok := <-sf.message:
 		if ok {
 			return m, m.err
 		}
 		return m, ErrEntryClosed
-	case <-tm.C:
+	case <-ctx.Done():
 	}
-	return m, ErrWaitTimeout
+	if sf.client != nil {
+		sf.client.cancelPending(sf.id)
+	}
+	return m, ctx.Err()
 }
 
-// putPending 缓存插入指定ID3
-func (sf *Client) putPending(id uint) *Token {
-	if sf.mode != ModeMQTT {
-		return &Token{closedchan}
+// notify 通知等待者,不阻塞
+func (sf *Token) notify(m Message) {
+	select {
+	case sf.message <- m:
+	default:
 	}
-	entry := &Token{make(chan Message, 1)}
-	sf.msgCache.SetDefault(strconv.FormatUint(uint64(id), 10), entry)
-	return entry
 }
 
-// signalPending 指定缓存id收到回复,并发出同步通知
-func (sf *Client) signalPending(msg Message) {
-	key := strconv.FormatUint(uint64(msg.ID), 10)
-	if v, ok := sf.msgCache.Get(key); ok {
-		sf.msgCache.Delete(key)
-		select {
-		case v.(*Token).message <- msg:
-		default:
-		}
+// waitError 将超时context的错误转换为ErrWaitTimeout
+func waitError(err error) error {
+	if err == context.DeadlineExceeded {
+		return ErrWaitTimeout
 	}
+	return err
 }
@@ -5,6 +5,7 @@
 package aiot
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/thinkgos/aliyun-iot/infra"
@@ -49,11 +50,16 @@ type ConfigPushRequest struct {
 // request:  /sys/{productKey}/{deviceName}/thing/config/get
 // response: /sys/{productKey}/{deviceName}/thing/config/get_reply
 func (sf *Client) ThingConfigGet(pk, dn string) (*Token, error) {
+	return sf.ThingConfigGetContext(context.Background(), pk, dn)
+}
+
+// ThingConfigGetContext 同 ThingConfigGet, 带ctx
+func (sf *Client) ThingConfigGetContext(ctx context.Context, pk, dn string) (*Token, error) {
 	if !sf.IsActive(pk, dn) {
 		return nil, ErrNotActive
 	}
 	_uri := uri.URI(uri.SysPrefix, uri.ThingConfigGet, pk, dn)
-	return sf.SendRequest(_uri, infra.MethodConfigGet, ConfigGetParams{
+	return sf.SendRequestContext(ctx, _uri, infra.MethodConfigGet, ConfigGetParams{
 		"product",
 		"file",
 	})
@@ -85,7 +91,7 @@ func ProcThingConfigGetReply(c *Client, rawURI string, payload []byte) error {
 	return c.cb.ThingConfigGetReply(c, err, pk, dn, rsp.Data)
 }
 
-// ProcThingConfigPush 处理配置推送,已做回复
+// ProcThingConfigPush 处理配置推送,已做回复, 设置了 ConfigManager 时由其处理
 // 下行
 // request:   /sys/{productKey}/{deviceName}/thing/config/push
 // response:  /sys/{productKey}/{deviceName}/thing/config/push_reply
@@ -106,5 +112,9 @@ func ProcThingConfigPush(c *Client, rawURI string, payload []byte) error {
 		c.Log.Errorf("thing.config.push.reply %+v", err)
 	}
 	pk, dn := uris[1], uris[2]
+	if c.config != nil {
+		c.config.HandleAsync(c, pk, dn, req.Params)
+		return nil
+	}
 	return c.cb.ThingConfigPush(c, pk, dn, req.Params)
 }
@@ -0,0 +1,321 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultConfigGetTimeout 默认设备上线后获取配置的超时时间
+const DefaultConfigGetTimeout = 10 * time.Second
+
+// Config 已校验的远程配置
+type Config struct {
+	ConfigParamsData
+	Data     []byte      // 配置文件内容
+	Value    interface{} // 配置了 WithConfigJSON 时为解码后的值
+	Rollback bool        // 为true表示新配置被拒绝, 回滚到此配置
+}
+
+// ConfigHandler 配置应用函数, 返回错误表示拒绝该配置, 此时回滚到上一个有效的配置
+type ConfigHandler func(c *Client, pk, dn string, cfg Config) error
+
+// ConfigOption 配置管理选项
+type ConfigOption func(*ConfigManager)
+
+// WithConfigHTTPClient 设置下载配置文件使用的http client,默认 http.DefaultClient
+func WithConfigHTTPClient(c *http.Client) ConfigOption {
+	return func(m *ConfigManager) {
+		m.httpClient = c
+	}
+}
+
+// WithConfigJSON 设置配置文件为json格式, newValue 返回用于解码的新值(指针),
+// 解码后的值通过 Config.Value 交由 ConfigHandler, 解码失败的配置视为无效
+func WithConfigJSON(newValue func() interface{}) ConfigOption {
+	return func(m *ConfigManager) {
+		m.newValue = newValue
+	}
+}
+
+// WithConfigGetTimeout 设置设备上线后获取配置的超时时间,默认 DefaultConfigGetTimeout
+func WithConfigGetTimeout(t time.Duration) ConfigOption {
+	return func(m *ConfigManager) {
+		if t > 0 {
+			m.timeout = t
+		}
+	}
+}
+
+// ConfigManager 远程配置管理,协程安全.
+// 设备上线(含重连及子设备上线)后获取配置, 并处理平台推送的配置,
+// 下载配置文件并校验大小及签名, 交由 ConfigHandler 应用, 应用成功的配置按ConfigID缓存在目录中,
+// 配置ID未变化时不再下载, 应用被拒绝时回滚到上一个有效的配置.
+// 同一设备的配置串行处理, 不同设备之间互不阻塞
+type ConfigManager struct {
+	dir        string
+	handler    ConfigHandler
+	httpClient *http.Client
+	newValue   func() interface{}
+	timeout    time.Duration
+
+	mu      sync.Mutex
+	devices map[string]*configDevice
+}
+
+// configDevice 设备的配置处理状态
+type configDevice struct {
+	mu      sync.Mutex // 串行处理同一设备的配置及缓存
+	applied string     // 本次运行已应用的配置ID
+	reject  string     // 被拒绝的配置ID
+}
+
+// configRecord 缓存的有效配置记录
+type configRecord struct {
+	Config ConfigParamsData `json:"config"`
+	File   string           `json:"file"`
+}
+
+// NewConfigManager 新建远程配置管理, dir 为配置缓存目录
+func NewConfigManager(dir string, handler ConfigHandler, opts ...ConfigOption) *ConfigManager {
+	sf := &ConfigManager{
+		dir:        dir,
+		handler:    handler,
+		httpClient: http.DefaultClient,
+		timeout:    DefaultConfigGetTimeout,
+		devices:    make(map[string]*configDevice),
+	}
+	for _, opt := range opts {
+		opt(sf)
+	}
+	return sf
+}
+
+// Current 获得设备缓存的有效配置
+func (sf *ConfigManager) Current(pk, dn string) (Config, error) {
+	d := sf.device(pk, dn)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	rec, err := sf.loadRecord(pk, dn)
+	if err != nil {
+		return Config{}, err
+	}
+	if rec == nil {
+		return Config{}, os.ErrNotExist
+	}
+	return sf.loadCached(rec)
+}
+
+// Handle 处理获取或推送的配置, 同步
+func (sf *ConfigManager) Handle(c *Client, pk, dn string, params ConfigParamsData) error {
+	if params.ConfigID == "" {
+		return nil
+	}
+	key := FormatKey(pk, dn)
+	d := sf.device(pk, dn)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.applied == params.ConfigID || d.reject == params.ConfigID {
+		return nil
+	}
+
+	rec, err := sf.loadRecord(pk, dn)
+	if err != nil {
+		c.Log.Warnf("config load %s cache record, %+v", key, err)
+	}
+	var cfg Config
+	if rec != nil && rec.Config.ConfigID == params.ConfigID {
+		cfg, err = sf.loadCached(rec)
+		if err != nil {
+			c.Log.Warnf("config load %s cache %s, %+v", key, params.ConfigID, err)
+		}
+	}
+	if cfg.Data == nil {
+		if cfg, err = sf.download(c, pk, dn, params); err != nil {
+			return err
+		}
+	}
+
+	if err = sf.handler(c, pk, dn, cfg); err != nil {
+		d.reject = params.ConfigID
+		c.Log.Warnf("config %s %s rejected, %+v", key, params.ConfigID, err)
+		if rec != nil && rec.Config.ConfigID != params.ConfigID {
+			prev, e := sf.loadCached(rec)
+			if e == nil {
+				prev.Rollback = true
+				e = sf.handler(c, pk, dn, prev)
+			}
+			if e != nil {
+				c.Log.Errorf("config %s rollback to %s failed, %+v", key, rec.Config.ConfigID, e)
+			}
+		}
+		return err
+	}
+	d.applied = params.ConfigID
+	d.reject = ""
+
+	if rec == nil || rec.Config.ConfigID != params.ConfigID {
+		if err = sf.saveCached(pk, dn, cfg, rec); err != nil {
+			c.Log.Warnf("config save %s cache %s, %+v", key, params.ConfigID, err)
+		}
+	}
+	return nil
+}
+
+// HandleAsync 处理获取或推送的配置, 异步
+func (sf *ConfigManager) HandleAsync(c *Client, pk, dn string, params ConfigParamsData) {
+	go func() {
+		if err := sf.Handle(c, pk, dn, params); err != nil {
+			c.Log.Errorf("config %s %s failed, %+v", FormatKey(pk, dn), params.ConfigID, err)
+		}
+	}()
+}
+
+// device 获得设备的配置处理状态
+func (sf *ConfigManager) device(pk, dn string) *configDevice {
+	key := FormatKey(pk, dn)
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	d, ok := sf.devices[key]
+	if !ok {
+		d = &configDevice{}
+		sf.devices[key] = d
+	}
+	return d
+}
+
+// onConnect 设备上线, 获取配置
+func (sf *ConfigManager) onConnect(c *Client, pk, dn string, _ bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), sf.timeout)
+	params, err := c.LinkThingConfigGetContext(ctx, pk, dn)
+	cancel()
+	if err != nil {
+		c.Log.Warnf("config get %s, %+v", FormatKey(pk, dn), waitError(err))
+		return
+	}
+	if err = sf.Handle(c, pk, dn, params); err != nil {
+		c.Log.Errorf("config %s %s failed, %+v", FormatKey(pk, dn), params.ConfigID, err)
+	}
+}
+
+// download 下载并校验配置文件
+func (sf *ConfigManager) download(c *Client, pk, dn string, params ConfigParamsData) (Config, error) {
+	if err := os.MkdirAll(sf.dir, 0755); err != nil {
+		return Config{}, err
+	}
+	tmp := sf.configPath(pk, dn, params.ConfigID) + ".tmp"
+	defer os.Remove(tmp) // nolint: errcheck
+
+	c.Log.Debugf("config download %s %s", FormatKey(pk, dn), params.ConfigID)
+	os.Remove(tmp) // nolint: errcheck
+	ctx, cancel := context.WithTimeout(context.Background(), sf.timeout)
+	err := httpDownload(ctx, sf.httpClient, params.URL, tmp, params.ConfigSize, nil)
+	cancel()
+	if err != nil {
+		return Config{}, err
+	}
+	data, err := ioutil.ReadFile(tmp)
+	if err != nil {
+		return Config{}, err
+	}
+	return sf.verify(params, data)
+}
+
+// verify 校验配置文件的大小及签名, 并解码
+func (sf *ConfigManager) verify(params ConfigParamsData, data []byte) (Config, error) {
+	if params.ConfigSize > 0 && int64(len(data)) != params.ConfigSize {
+		return Config{}, fmt.Errorf("%w, size %d, want %d", ErrConfigVerifyFailed, len(data), params.ConfigSize)
+	}
+	if params.Sign != "" {
+		h, err := newSignHash(params.SignMethod)
+		if err != nil {
+			return Config{}, err
+		}
+		h.Write(data) // nolint: errcheck
+		if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, params.Sign) {
+			return Config{}, fmt.Errorf("%w, %s sign %s, want %s", ErrConfigVerifyFailed, params.SignMethod, sum, params.Sign)
+		}
+	}
+	cfg := Config{ConfigParamsData: params, Data: data}
+	if sf.newValue != nil {
+		v := sf.newValue()
+		if err := json.Unmarshal(data, v); err != nil {
+			return Config{}, fmt.Errorf("%w, %v", ErrConfigVerifyFailed, err)
+		}
+		cfg.Value = v
+	}
+	return cfg, nil
+}
+
+// loadRecord 加载设备缓存的有效配置记录, 无缓存时返回nil
+func (sf *ConfigManager) loadRecord(pk, dn string) (*configRecord, error) {
+	b, err := ioutil.ReadFile(sf.recordPath(pk, dn))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	rec := &configRecord{}
+	if err = json.Unmarshal(b, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// loadCached 加载缓存的配置并重新校验
+func (sf *ConfigManager) loadCached(rec *configRecord) (Config, error) {
+	data, err := ioutil.ReadFile(filepath.Join(sf.dir, rec.File))
+	if err != nil {
+		return Config{}, err
+	}
+	return sf.verify(rec.Config, data)
+}
+
+// saveCached 缓存有效的配置并删除之前的缓存, 先写入临时文件再替换,防止写入过程中掉电损坏文件
+func (sf *ConfigManager) saveCached(pk, dn string, cfg Config, prev *configRecord) error {
+	path := sf.configPath(pk, dn, cfg.ConfigID)
+	if err := writeFileAtomic(path, cfg.Data, 0600); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(configRecord{cfg.ConfigParamsData, filepath.Base(path)}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(sf.recordPath(pk, dn), b, 0600); err != nil {
+		return err
+	}
+	if prev != nil && prev.File != filepath.Base(path) {
+		os.Remove(filepath.Join(sf.dir, prev.File)) // nolint: errcheck
+	}
+	return nil
+}
+
+func (sf *ConfigManager) recordPath(pk, dn string) string {
+	return filepath.Join(sf.dir, configFileName(pk, dn, "")+".json")
+}
+
+func (sf *ConfigManager) configPath(pk, dn, id string) string {
+	return filepath.Join(sf.dir, configFileName(pk, dn, id)+".cfg")
+}
+
+func configFileName(pk, dn, id string) string {
+	name := "config_" + FormatKey(pk, dn)
+	if id != "" {
+		name += "_" + id
+	}
+	return strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(name)
+}
@@ -5,6 +5,7 @@
 package aiot
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/thinkgos/aliyun-iot/infra"
@@ -17,6 +18,11 @@ import (
 // request:  /sys/{productKey}/{deviceName}/thing/property/desired/get
 // response: /sys/{productKey}/{deviceName}/thing/property/desired/get_reply
 func (sf *Client) ThingDesiredPropertyGet(pk, dn string, params []string) (*Token, error) {
+	return sf.ThingDesiredPropertyGetContext(context.Background(), pk, dn, params)
+}
+
+// ThingDesiredPropertyGetContext 同 ThingDesiredPropertyGet, 带ctx
+func (sf *Client) ThingDesiredPropertyGetContext(ctx context.Context, pk, dn string, params []string) (*Token, error) {
 	if !sf.hasDesired {
 		return nil, ErrNotSupportFeature
 	}
@@ -24,13 +30,18 @@ func (sf *Client) ThingDesiredPropertyGet(pk, dn string, params []string) (*Toke
 		return nil, ErrNotActive
 	}
 	_uri := uri.URI(uri.SysPrefix, uri.ThingDesiredPropertyGet, pk, dn)
-	return sf.SendRequest(_uri, infra.MethodDesiredPropertyGet, params)
+	return sf.SendRequestContext(ctx, _uri, infra.MethodDesiredPropertyGet, params)
 }
 
 // ThingDesiredPropertyDelete 清空期望属性值
 // request:  /sys/{productKey}/{deviceName}/thing/property/desired/delete
 // response: /sys/{productKey}/{deviceName}/thing/property/desired/delete_reply
 func (sf *Client) ThingDesiredPropertyDelete(pk, dn string, params interface{}) (*Token, error) {
+	return sf.ThingDesiredPropertyDeleteContext(context.Background(), pk, dn, params)
+}
+
+// ThingDesiredPropertyDeleteContext 同 ThingDesiredPropertyDelete, 带ctx
+func (sf *Client) ThingDesiredPropertyDeleteContext(ctx context.Context, pk, dn string, params interface{}) (*Token, error) {
 	if !sf.hasDesired {
 		return nil, ErrNotSupportFeature
 	}
@@ -38,7 +49,7 @@ func (sf *Client) ThingDesiredPropertyDelete(pk, dn string, params interface{})
 		return nil, ErrNotActive
 	}
 	_uri := uri.URI(uri.SysPrefix, uri.ThingDesiredPropertyDelete, pk, dn)
-	return sf.SendRequest(_uri, infra.MethodDesiredPropertyDelete, params)
+	return sf.SendRequestContext(ctx, _uri, infra.MethodDesiredPropertyDelete, params)
 }
 
 // ProcThingDesiredPropertyGetReply 处理获取期望属性值的应答
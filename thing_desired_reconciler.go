@@ -0,0 +1,266 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+)
+
+// 期望属性调和默认值
+const (
+	// DefaultDesiredTimeout 默认设备上线后一次调和的超时时间
+	DefaultDesiredTimeout = 30 * time.Second
+	// DefaultDesiredRounds 默认版本冲突时重新获取期望值的最大轮数
+	DefaultDesiredRounds = 3
+)
+
+// DesiredValue 期望属性值
+type DesiredValue struct {
+	Value   json.RawMessage `json:"value"`
+	Version int64           `json:"version"`
+}
+
+// DesiredVersion 清空期望属性值时指定的版本, 与云端的版本一致时才清空
+type DesiredVersion struct {
+	Version int64 `json:"version"`
+}
+
+// DecodeDesired 解码获取期望属性值应答的数据, 无期望值(value为空)的属性不包含在结果中
+func DecodeDesired(data json.RawMessage) (map[string]DesiredValue, error) {
+	values := make(map[string]DesiredValue)
+	if len(data) == 0 || string(data) == "null" {
+		return values, nil
+	}
+	raw := make(map[string]DesiredValue)
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	for id, v := range raw {
+		if len(v.Value) > 0 && string(v.Value) != "null" {
+			values[id] = v
+		}
+	}
+	return values, nil
+}
+
+// DesiredOption 期望属性调和选项
+type DesiredOption func(*DesiredReconciler)
+
+// WithDesiredTimeout 设置设备上线后一次调和的超时时间,默认 DefaultDesiredTimeout
+func WithDesiredTimeout(t time.Duration) DesiredOption {
+	return func(r *DesiredReconciler) {
+		if t > 0 {
+			r.timeout = t
+		}
+	}
+}
+
+// WithDesiredRounds 设置版本冲突时重新获取期望值的最大轮数,默认 DefaultDesiredRounds
+func WithDesiredRounds(n int) DesiredOption {
+	return func(r *DesiredReconciler) {
+		if n > 0 {
+			r.rounds = n
+		}
+	}
+}
+
+// WithDesiredConflictCodes 设置清空期望值时表示版本冲突的平台应答错误码,
+// 收到这些错误码时重新获取期望值, 其它错误码直接返回.
+// 默认不设置, 清空期望值的任何错误应答均视为版本冲突, 重新获取期望值
+func WithDesiredConflictCodes(codes ...int) DesiredOption {
+	return func(r *DesiredReconciler) {
+		for _, code := range codes {
+			r.conflicts[code] = struct{}{}
+		}
+	}
+}
+
+// DesiredReconciler 期望属性调和,协程安全.
+// 设备上线(含重连及子设备上线)后, 获取 PropertyStore 中设备所有可设置属性的期望值,
+// 通过注册的设置函数应用, 上报应用后的属性值, 再按版本清空期望值, 避免重复应用.
+// 清空时平台应答错误(视为版本冲突, 见 WithDesiredConflictCodes), 则重新获取并应用新的期望值,
+// 已应用的版本不再重复设置, 最多 WithDesiredRounds 轮
+type DesiredReconciler struct {
+	store     *PropertyStore
+	timeout   time.Duration
+	rounds    int
+	conflicts map[int]struct{} // 表示版本冲突的错误码, 为空时任何错误码均视为版本冲突
+
+	mu      sync.Mutex
+	applied map[string]map[string]int64 // 设备 -> 属性 -> 已应用但未清空的版本
+	running map[string]bool
+}
+
+// NewDesiredReconciler 新建期望属性调和, store 提供属性的设置及读取函数
+func NewDesiredReconciler(store *PropertyStore, opts ...DesiredOption) *DesiredReconciler {
+	sf := &DesiredReconciler{
+		store:     store,
+		timeout:   DefaultDesiredTimeout,
+		rounds:    DefaultDesiredRounds,
+		conflicts: make(map[int]struct{}),
+		applied:   make(map[string]map[string]int64),
+		running:   make(map[string]bool),
+	}
+	for _, opt := range opts {
+		opt(sf)
+	}
+	return sf
+}
+
+// Reconcile 执行一次期望属性调和, 同步. 属性设置失败的期望值保留在云端, 返回首个设置失败的错误
+func (sf *DesiredReconciler) Reconcile(ctx context.Context, c *Client, pk, dn string) error {
+	key := FormatKey(pk, dn)
+	var setErr error
+	for round := 1; round <= sf.rounds; round++ {
+		ids := sf.store.settable(pk, dn)
+		if len(ids) == 0 {
+			return setErr
+		}
+		data, err := c.LinkThingDesiredPropertyGetContext(ctx, pk, dn, ids)
+		if err != nil {
+			return waitError(err)
+		}
+		desired, err := DecodeDesired(data)
+		if err != nil {
+			return err
+		}
+		if len(desired) == 0 {
+			return setErr
+		}
+
+		versions := make(map[string]DesiredVersion, len(desired))
+		params := make(map[string]json.RawMessage)
+		for id, d := range desired {
+			versions[id] = DesiredVersion{d.Version}
+			if v, ok := sf.version(key, id); !ok || v != d.Version {
+				params[id] = d.Value
+			}
+		}
+		if len(params) > 0 {
+			applied, failures := sf.store.Set(pk, dn, params)
+			for _, id := range sortedKeys(failures) {
+				c.Log.Warnf("desired %s property %s version %d set failed, %+v", key, id, desired[id].Version, failures[id])
+				delete(versions, id)
+				if setErr == nil {
+					setErr = failures[id]
+				}
+			}
+			if len(applied) > 0 {
+				if err = sf.report(ctx, c, pk, dn, applied, params); err != nil {
+					return waitError(err)
+				}
+				for _, id := range applied {
+					sf.setVersion(key, id, desired[id].Version)
+				}
+			}
+		}
+		if len(versions) == 0 {
+			return setErr
+		}
+
+		err = c.LinkThingDesiredPropertyDeleteContext(ctx, pk, dn, versions)
+		if err == nil {
+			sf.clearVersion(key, versions)
+			return setErr
+		}
+		if !sf.conflict(err) {
+			return waitError(err)
+		}
+		c.Log.Warnf("desired %s delete conflict, round %d/%d, %+v", key, round, sf.rounds, err)
+	}
+	return ErrDesiredConflict
+}
+
+// conflict 清空期望值的错误是否为版本冲突, 超时等非平台应答的错误不是版本冲突
+func (sf *DesiredReconciler) conflict(err error) bool {
+	var ce *infra.CodeError
+	if !errors.As(err, &ce) {
+		return false
+	}
+	if len(sf.conflicts) == 0 {
+		return true
+	}
+	_, ok := sf.conflicts[ce.Code()]
+	return ok
+}
+
+// onConnect 设备上线, 执行期望属性调和, 同一设备正在调和时忽略
+func (sf *DesiredReconciler) onConnect(c *Client, pk, dn string, _ bool) {
+	key := FormatKey(pk, dn)
+	sf.mu.Lock()
+	if sf.running[key] {
+		sf.mu.Unlock()
+		return
+	}
+	sf.running[key] = true
+	sf.mu.Unlock()
+	defer func() {
+		sf.mu.Lock()
+		delete(sf.running, key)
+		sf.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), sf.timeout)
+	defer cancel()
+	if err := sf.Reconcile(ctx, c, pk, dn); err != nil {
+		c.Log.Errorf("desired %s reconcile failed, %+v", key, err)
+	}
+}
+
+// report 上报应用后的属性当前值, 不可读的属性上报期望值
+func (sf *DesiredReconciler) report(ctx context.Context, c *Client, pk, dn string, applied []string, params map[string]json.RawMessage) error {
+	values, _ := sf.store.Get(pk, dn, applied...)
+	for _, id := range applied {
+		if _, ok := values[id]; !ok {
+			values[id] = params[id]
+		}
+	}
+	return c.LinkThingEventPropertyPostContext(ctx, pk, dn, values)
+}
+
+func (sf *DesiredReconciler) version(key, id string) (int64, bool) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	v, ok := sf.applied[key][id]
+	return v, ok
+}
+
+func (sf *DesiredReconciler) setVersion(key, id string, version int64) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	vs, ok := sf.applied[key]
+	if !ok {
+		vs = make(map[string]int64)
+		sf.applied[key] = vs
+	}
+	vs[id] = version
+}
+
+func (sf *DesiredReconciler) clearVersion(key string, versions map[string]DesiredVersion) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	for id := range versions {
+		delete(sf.applied[key], id)
+	}
+	if len(sf.applied[key]) == 0 {
+		delete(sf.applied, key)
+	}
+}
+
+func sortedKeys(m map[string]error) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
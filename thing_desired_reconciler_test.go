@@ -0,0 +1,206 @@
+package aiot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+	"github.com/thinkgos/aliyun-iot/uri"
+)
+
+const testDesiredConflictCode = 6508
+
+// desiredCloud 模拟云端期望属性
+type desiredCloud struct {
+	mu      sync.Mutex
+	values  map[string]DesiredValue
+	deletes int
+	// onDelete 清空请求时调用, 返回 > 0 的错误码表示清空失败
+	onDelete func(cloud *desiredCloud, versions map[string]DesiredVersion) int
+}
+
+// setLocked 云端更新期望值, 版本递增
+func (sf *desiredCloud) setLocked(id, value string) {
+	sf.values[id] = DesiredValue{json.RawMessage(value), sf.values[id].Version + 1}
+}
+
+func (sf *desiredCloud) reply(topic string, req fakeRequest) (Response, bool) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	switch {
+	case strings.HasSuffix(topic, uri.ThingDesiredPropertyGet):
+		var ids []string
+		_ = json.Unmarshal(req.Params, &ids)
+		data := make(map[string]DesiredValue)
+		for _, id := range ids {
+			if v, ok := sf.values[id]; ok {
+				data[id] = v
+			}
+		}
+		return Response{ID: req.ID, Code: infra.CodeSuccess, Data: data}, true
+	case strings.HasSuffix(topic, uri.ThingDesiredPropertyDelete):
+		versions := make(map[string]DesiredVersion)
+		_ = json.Unmarshal(req.Params, &versions)
+		sf.deletes++
+		if sf.onDelete != nil {
+			if code := sf.onDelete(sf, versions); code > 0 {
+				return Response{ID: req.ID, Code: code, Message: "version conflict"}, true
+			}
+		}
+		for id, v := range versions {
+			if sf.values[id].Version == v.Version {
+				delete(sf.values, id)
+			}
+		}
+	}
+	return Response{ID: req.ID, Code: infra.CodeSuccess, Data: struct{}{}}, true
+}
+
+// desiredDevice 记录属性设置
+type desiredDevice struct {
+	mu   sync.Mutex
+	sets []string
+	fail map[string]bool
+}
+
+func (sf *desiredDevice) register(store *PropertyStore, ids ...string) {
+	for _, id := range ids {
+		id := id
+		store.Register("pk", "dn", id, nil, func(value json.RawMessage) error {
+			sf.mu.Lock()
+			defer sf.mu.Unlock()
+			if sf.fail[id] {
+				return errors.New("set " + id + " failed")
+			}
+			sf.sets = append(sf.sets, id+"="+string(value))
+			return nil
+		})
+	}
+}
+
+func (sf *desiredDevice) takeSets() []string {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sets := sf.sets
+	sf.sets = nil
+	return sets
+}
+
+func newDesiredTest(cloud *desiredCloud, opts ...DesiredOption) (*DesiredReconciler, *Client, *desiredDevice) {
+	store := NewPropertyStore(false)
+	dev := &desiredDevice{fail: make(map[string]bool)}
+	dev.register(store, "a", "b")
+	r := NewDesiredReconciler(store, opts...)
+	c, _ := newFakeClient(cloud.reply, WithEnableDesired())
+	return r, c, dev
+}
+
+func TestDesiredReconciler_Reconcile(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("no conflict", func(t *testing.T) {
+		cloud := &desiredCloud{values: map[string]DesiredValue{
+			"a": {json.RawMessage(`1`), 1},
+			"b": {json.RawMessage(`"x"`), 3},
+		}}
+		r, c, dev := newDesiredTest(cloud)
+		require.NoError(t, r.Reconcile(ctx, c, "pk", "dn"))
+		assert.ElementsMatch(t, []string{"a=1", `b="x"`}, dev.takeSets())
+		assert.Empty(t, cloud.values)
+		assert.Equal(t, 1, cloud.deletes)
+		assert.Empty(t, r.applied)
+	})
+
+	t.Run("conflict then refetch", func(t *testing.T) {
+		cloud := &desiredCloud{values: map[string]DesiredValue{
+			"a": {json.RawMessage(`1`), 1},
+			"b": {json.RawMessage(`"x"`), 1},
+		}}
+		// 首次清空时云端更新了a
+		cloud.onDelete = func(cloud *desiredCloud, _ map[string]DesiredVersion) int {
+			if cloud.deletes == 1 {
+				cloud.setLocked("a", `2`)
+				return testDesiredConflictCode
+			}
+			return 0
+		}
+		// 默认任何错误应答均视为版本冲突
+		r, c, dev := newDesiredTest(cloud)
+		require.NoError(t, r.Reconcile(ctx, c, "pk", "dn"))
+		// 已应用的b不再重复设置
+		assert.ElementsMatch(t, []string{"a=1", `b="x"`, "a=2"}, dev.takeSets())
+		assert.Empty(t, cloud.values)
+		assert.Equal(t, 2, cloud.deletes)
+		assert.Empty(t, r.applied)
+	})
+
+	t.Run("conflict rounds exhausted", func(t *testing.T) {
+		cloud := &desiredCloud{values: map[string]DesiredValue{"a": {json.RawMessage(`1`), 1}}}
+		cloud.onDelete = func(cloud *desiredCloud, _ map[string]DesiredVersion) int {
+			cloud.setLocked("a", `1`)
+			return testDesiredConflictCode
+		}
+		r, c, dev := newDesiredTest(cloud, WithDesiredRounds(2))
+		assert.Equal(t, ErrDesiredConflict, r.Reconcile(ctx, c, "pk", "dn"))
+		assert.Equal(t, []string{"a=1", "a=1"}, dev.takeSets())
+		assert.Equal(t, 2, cloud.deletes)
+	})
+
+	t.Run("configured conflict code", func(t *testing.T) {
+		cloud := &desiredCloud{values: map[string]DesiredValue{"a": {json.RawMessage(`1`), 1}}}
+		cloud.onDelete = func(cloud *desiredCloud, _ map[string]DesiredVersion) int {
+			if cloud.deletes == 1 {
+				cloud.setLocked("a", `2`)
+				return testDesiredConflictCode
+			}
+			return 0
+		}
+		r, c, dev := newDesiredTest(cloud, WithDesiredConflictCodes(testDesiredConflictCode))
+		require.NoError(t, r.Reconcile(ctx, c, "pk", "dn"))
+		assert.Equal(t, []string{"a=1", "a=2"}, dev.takeSets())
+		assert.Equal(t, 2, cloud.deletes)
+	})
+
+	t.Run("unconfigured code", func(t *testing.T) {
+		cloud := &desiredCloud{values: map[string]DesiredValue{"a": {json.RawMessage(`1`), 1}}}
+		cloud.onDelete = func(*desiredCloud, map[string]DesiredVersion) int {
+			return testDesiredConflictCode
+		}
+		r, c, dev := newDesiredTest(cloud, WithDesiredConflictCodes(testDesiredConflictCode+1))
+		err := r.Reconcile(ctx, c, "pk", "dn")
+		var ce *infra.CodeError
+		require.True(t, errors.As(err, &ce), "got %v", err)
+		assert.Equal(t, testDesiredConflictCode, ce.Code())
+		assert.Equal(t, 1, cloud.deletes, "should not refetch")
+		assert.Equal(t, []string{"a=1"}, dev.takeSets())
+
+		// 下次调和时已应用的版本不再重复设置
+		cloud.onDelete = nil
+		require.NoError(t, r.Reconcile(ctx, c, "pk", "dn"))
+		assert.Empty(t, dev.takeSets())
+		assert.Empty(t, cloud.values)
+	})
+
+	t.Run("set failed", func(t *testing.T) {
+		cloud := &desiredCloud{values: map[string]DesiredValue{
+			"a": {json.RawMessage(`1`), 1},
+			"b": {json.RawMessage(`"x"`), 1},
+		}}
+		r, c, dev := newDesiredTest(cloud)
+		dev.fail["b"] = true
+		assert.EqualError(t, r.Reconcile(ctx, c, "pk", "dn"), "set b failed")
+		assert.Equal(t, []string{"a=1"}, dev.takeSets())
+		// 设置失败的期望值保留在云端
+		assert.Equal(t, map[string]DesiredValue{"b": {json.RawMessage(`"x"`), 1}}, cloud.values)
+	})
+}
@@ -5,6 +5,7 @@
 package aiot
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/thinkgos/aliyun-iot/infra"
@@ -53,7 +54,7 @@ type DiagRequest struct {
 	Params  DiagParam `json:"params"`
 }
 
-func (sf *Client) thingDiagPost(pk, dn string, p interface{}, isNow bool) (*Token, error) {
+func (sf *Client) thingDiagPost(ctx context.Context, pk, dn string, p interface{}, isNow bool) (*Token, error) {
 	var model string
 
 	if !sf.hasDiag {
@@ -83,25 +84,32 @@ func (sf *Client) thingDiagPost(pk, dn string, p interface{}, isNow bool) (*Toke
 
 	sf.Log.Debugf("thing.diag.post @%d", id)
 	_uri := uri.URI(uri.SysPrefix, uri.ThingDiagPost, pk, dn)
-	if err = sf.Publish(_uri, 1, out); err != nil {
-		return nil, err
-	}
-	return sf.putPending(id), nil
+	return sf.sendPending(ctx, _uri, 1, id, out)
 }
 
 // ThingDiagPost 设备主动上报当前网络状态
 // request:  /sys/{productKey}/{deviceName}/_thing/diag/post
 // response: /sys/{productKey}/{deviceName}/_thing/diag/post_reply
 func (sf *Client) ThingDiagPost(pk, dn string, p P) (*Token, error) {
-	return sf.thingDiagPost(pk, dn, p, true)
+	return sf.ThingDiagPostContext(context.Background(), pk, dn, p)
+}
+
+// ThingDiagPostContext 同 ThingDiagPost, 带ctx
+func (sf *Client) ThingDiagPostContext(ctx context.Context, pk, dn string, p P) (*Token, error) {
+	return sf.thingDiagPost(ctx, pk, dn, p, true)
 }
 
 // ThingDiagHistoryPost 设备主动上报历史网络状态
 func (sf *Client) ThingDiagHistoryPost(pk, dn string, ps []P) (*Token, error) {
+	return sf.ThingDiagHistoryPostContext(context.Background(), pk, dn, ps)
+}
+
+// ThingDiagHistoryPostContext 同 ThingDiagHistoryPost, 带ctx
+func (sf *Client) ThingDiagHistoryPostContext(ctx context.Context, pk, dn string, ps []P) (*Token, error) {
 	if len(ps) == 0 {
 		return nil, ErrInvalidParameter
 	}
-	return sf.thingDiagPost(pk, dn, ps, false)
+	return sf.thingDiagPost(ctx, pk, dn, ps, false)
 }
 
 // ProcThingDialPostReply 处理设备主动上报网络状态回复
@@ -5,6 +5,7 @@
 package aiot
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
@@ -18,33 +19,55 @@ import (
 // request:  /sys/{productKey}/{deviceName}/thing/event/property/post
 // response: /sys/{productKey}/{deviceName}/thing/event/property/post_reply
 func (sf *Client) ThingEventPropertyPost(pk, dn string, params interface{}) (*Token, error) {
+	return sf.ThingEventPropertyPostContext(context.Background(), pk, dn, params)
+}
+
+// ThingEventPropertyPostContext 同 ThingEventPropertyPost, 带ctx
+func (sf *Client) ThingEventPropertyPostContext(ctx context.Context, pk, dn string, params interface{}) (*Token, error) {
 	if sf.hasRawModel {
 		return nil, ErrNotSupportFeature
 	}
 	if !sf.IsActive(pk, dn) {
 		return nil, ErrNotActive
 	}
+	if err := sf.validateProperties(pk, params); err != nil {
+		return nil, err
+	}
 	_uri := uri.URI(uri.SysPrefix, uri.ThingEventPropertyPost, pk, dn)
-	return sf.SendRequest(_uri, infra.MethodEventPropertyPost, params)
+	return sf.SendRequestContext(ctx, _uri, infra.MethodEventPropertyPost, params)
 }
 
 // ThingEventPost 设备事件上报
 // request:  /sys/{productKey}/{deviceName}/thing/event/{tsl.event.identifier}/post
 // response: /sys/{productKey}/{deviceName}/thing/event/{tsl.event.identifier}/post_reply
 func (sf *Client) ThingEventPost(pk, dn, eventID string, params interface{}) (*Token, error) {
+	return sf.ThingEventPostContext(context.Background(), pk, dn, eventID, params)
+}
+
+// ThingEventPostContext 同 ThingEventPost, 带ctx
+func (sf *Client) ThingEventPostContext(ctx context.Context, pk, dn, eventID string, params interface{}) (*Token, error) {
 	if !sf.IsActive(pk, dn) {
 		return nil, ErrNotActive
 	}
+	if err := sf.validateEvent(pk, eventID, params); err != nil {
+		return nil, err
+	}
 	_uri := uri.URI(uri.SysPrefix, uri.ThingEventPost, pk, dn, eventID)
 	method := fmt.Sprintf(infra.MethodEventFormatPost, eventID)
-	return sf.SendRequest(_uri, method, params)
+	return sf.SendRequestContext(ctx, _uri, method, params)
 }
 
 // ThingEventPropertyPackPost 网关批量上报数据
 // NOTE: 仅网关支持,一次最多200个属性,20个事件,一次最多为20个子设备上报数据
+// params 可使用 PackParams, 超出限制时使用 PackBuilder 拆分批次
 // request:  /sys/{productKey}/{deviceName}/thing/event/property/pack/post
 // response: /sys/{productKey}/{deviceName}/thing/event/property/pack/post_reply
 func (sf *Client) ThingEventPropertyPackPost(params interface{}) (*Token, error) {
+	return sf.ThingEventPropertyPackPostContext(context.Background(), params)
+}
+
+// ThingEventPropertyPackPostContext 同 ThingEventPropertyPackPost, 带ctx
+func (sf *Client) ThingEventPropertyPackPostContext(ctx context.Context, params interface{}) (*Token, error) {
 	if !sf.isGateway {
 		return nil, ErrNotSupportFeature
 	}
@@ -52,19 +75,25 @@ func (sf *Client) ThingEventPropertyPackPost(params interface{}) (*Token, error)
 		return nil, ErrNotActive
 	}
 	_uri := sf.URIGateway(uri.SysPrefix, uri.ThingEventPropertyPackPost)
-	return sf.SendRequest(_uri, infra.MethodEventPropertyPackPost, params)
+	return sf.SendRequestContext(ctx, _uri, infra.MethodEventPropertyPackPost, params)
 }
 
 // ThingEventPropertyHistoryPost  物模型历史数据上报
 // 直连设备仅能上报自己的物模型历史数据,网关设备可以上报其子设备的物模型历史数据
+// params 可使用 []HistoryParams, 超出限制时使用 HistoryBuilder 拆分批次
 // request： /sys/{productKey}/{deviceName}/thing/event/property/history/post
 // response：/sys/{productKey}/{deviceName}/thing/event/property/history/post_reply
 func (sf *Client) ThingEventPropertyHistoryPost(params interface{}) (*Token, error) {
+	return sf.ThingEventPropertyHistoryPostContext(context.Background(), params)
+}
+
+// ThingEventPropertyHistoryPostContext 同 ThingEventPropertyHistoryPost, 带ctx
+func (sf *Client) ThingEventPropertyHistoryPostContext(ctx context.Context, params interface{}) (*Token, error) {
 	if !sf.IsActive(sf.tetrad.ProductKey, sf.tetrad.DeviceName) {
 		return nil, ErrNotActive
 	}
 	_uri := sf.URIGateway(uri.SysPrefix, uri.ThingEventPropertyHistoryPost)
-	return sf.SendRequest(_uri, infra.MethodEventPropertyHistoryPost, params)
+	return sf.SendRequestContext(ctx, _uri, infra.MethodEventPropertyHistoryPost, params)
 }
 
 // ProcThingEventPostReply 处理ThingEvent XXX上行的应答
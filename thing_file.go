@@ -0,0 +1,137 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+	"github.com/thinkgos/aliyun-iot/uri"
+)
+
+// FileInfo 文件信息,来自OTA升级推送的streamId及streamFileId
+type FileInfo struct {
+	StreamID int64 `json:"streamId"`
+	FileID   int   `json:"fileId"`
+}
+
+// FileBlockInfo 请求的文件分片
+type FileBlockInfo struct {
+	Size   int   `json:"size"`   // 分片大小, [256, 131072] 字节
+	Offset int64 `json:"offset"` // 分片在文件中的偏移
+}
+
+// FileDownloadParams 文件分片下载请求参数域
+type FileDownloadParams struct {
+	FileToken string        `json:"fileToken,omitempty"`
+	FileInfo  FileInfo      `json:"fileInfo"`
+	FileBlock FileBlockInfo `json:"fileBlock"`
+}
+
+// FileBlock 文件分片下载应答
+type FileBlock struct {
+	FileToken  string `json:"fileToken"`
+	FileLength int64  `json:"fileLength"` // 文件总大小
+	BSize      int    `json:"bSize"`      // 分片大小
+	BOffset    int64  `json:"bOffset"`    // 分片在文件中的偏移
+	Data       []byte `json:"-"`          // 分片数据
+}
+
+// ThingFileDownload 通过MQTT请求文件分片
+// request：  /sys/{productKey}/{deviceName}/thing/file/download
+// response： /sys/{productKey}/{deviceName}/thing/file/download_reply
+func (sf *Client) ThingFileDownload(pk, dn string, params FileDownloadParams) (*Token, error) {
+	return sf.ThingFileDownloadContext(context.Background(), pk, dn, params)
+}
+
+// ThingFileDownloadContext 同 ThingFileDownload, 带ctx
+func (sf *Client) ThingFileDownloadContext(ctx context.Context, pk, dn string, params FileDownloadParams) (*Token, error) {
+	if !sf.hasOTA {
+		return nil, ErrNotSupportFeature
+	}
+	if !sf.IsActive(pk, dn) {
+		return nil, ErrNotActive
+	}
+	_uri := uri.URI(uri.SysPrefix, uri.ThingFileDownload, pk, dn)
+	return sf.SendRequestContext(ctx, _uri, infra.MethodFileDownload, params)
+}
+
+// ProcThingFileDownloadReply 处理文件分片下载应答,
+// payload为: 2字节json长度(高字节在前) + json + 分片数据 + 2字节分片数据的CRC16/IBM校验值
+// request：  /sys/{productKey}/{deviceName}/thing/file/download
+// response： /sys/{productKey}/{deviceName}/thing/file/download_reply
+// subscribe：/sys/{productKey}/{deviceName}/thing/file/download_reply
+func ProcThingFileDownloadReply(c *Client, rawURI string, payload []byte) error {
+	uris := uri.Spilt(rawURI)
+	if len(uris) < 6 {
+		return ErrInvalidURI
+	}
+	if len(payload) < 2 {
+		return ErrInvalidParameter
+	}
+	n := int(binary.BigEndian.Uint16(payload))
+	if len(payload) < 2+n {
+		return ErrInvalidParameter
+	}
+	rsp := &struct {
+		ID      uint      `json:"id,string"`
+		Code    int       `json:"code"`
+		Data    FileBlock `json:"data"`
+		Msg     string    `json:"msg"`
+		Message string    `json:"message"`
+	}{}
+	err := json.Unmarshal(payload[2:2+n], rsp)
+	if err != nil {
+		return err
+	}
+	if rsp.Code != infra.CodeSuccess {
+		msg := rsp.Msg
+		if msg == "" {
+			msg = rsp.Message
+		}
+		err = infra.NewCodeError(rsp.Code, msg)
+	} else {
+		err = decodeFileBlock(&rsp.Data, payload[2+n:])
+	}
+	c.Log.Debugf("thing.file.download.reply @%d", rsp.ID)
+	c.signalPending(Message{rsp.ID, rsp.Data, err})
+	return nil
+}
+
+// decodeFileBlock 解码分片数据并进行CRC校验
+func decodeFileBlock(blk *FileBlock, b []byte) error {
+	if len(b) < 2 {
+		return ErrFileBlockCorrupt
+	}
+	data, sum := b[:len(b)-2], b[len(b)-2:]
+	if blk.BSize > 0 && len(data) != blk.BSize {
+		return ErrFileBlockCorrupt
+	}
+	// 兼容两种字节序的校验值
+	crc := crc16IBM(data)
+	if binary.BigEndian.Uint16(sum) != crc && binary.LittleEndian.Uint16(sum) != crc {
+		return ErrFileBlockCorrupt
+	}
+	blk.Data = data
+	return nil
+}
+
+// crc16IBM CRC16/IBM(ARC) 多项式0x8005, 初始值0, 输入输出反转
+func crc16IBM(b []byte) uint16 {
+	var crc uint16
+	for _, v := range b {
+		crc ^= uint16(v)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
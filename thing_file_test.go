@@ -0,0 +1,117 @@
+package aiot
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+	"github.com/thinkgos/aliyun-iot/uri"
+)
+
+func TestCrc16IBM(t *testing.T) {
+	tests := []struct {
+		data string
+		want uint16
+	}{
+		{"", 0x0000},
+		{"A", 0x30c0},
+		{"\xff", 0x4040},
+		{"\x00\x00", 0x0000},
+		{"123456789", 0xbb3d},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, crc16IBM([]byte(tt.data)), "crc16IBM(%q)", tt.data)
+	}
+}
+
+// fileBlockFrame 分片数据及指定字节序的CRC16校验值
+func fileBlockFrame(data string, order binary.ByteOrder) []byte {
+	b := make([]byte, len(data)+2)
+	copy(b, data)
+	order.PutUint16(b[len(data):], crc16IBM([]byte(data)))
+	return b
+}
+
+func TestDecodeFileBlock(t *testing.T) {
+	corrupt := fileBlockFrame("123456789", binary.BigEndian)
+	corrupt[0] = '0'
+
+	tests := []struct {
+		name    string
+		bSize   int
+		payload []byte
+		want    string
+		wantErr error
+	}{
+		{"big endian", 9, fileBlockFrame("123456789", binary.BigEndian), "123456789", nil},
+		{"little endian", 9, fileBlockFrame("123456789", binary.LittleEndian), "123456789", nil},
+		{"no block size", 0, fileBlockFrame("abc", binary.BigEndian), "abc", nil},
+		{"empty block", 0, fileBlockFrame("", binary.BigEndian), "", nil},
+		{"crc mismatch", 9, corrupt, "", ErrFileBlockCorrupt},
+		{"size mismatch", 8, fileBlockFrame("123456789", binary.BigEndian), "", ErrFileBlockCorrupt},
+		{"too short", 0, []byte{0x01}, "", ErrFileBlockCorrupt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blk := FileBlock{BSize: tt.bSize}
+			err := decodeFileBlock(&blk, tt.payload)
+			assert.Equal(t, tt.wantErr, err)
+			if err == nil {
+				assert.Equal(t, tt.want, string(blk.Data))
+			}
+		})
+	}
+}
+
+func TestProcThingFileDownloadReply(t *testing.T) {
+	c, conn := newFakeClient(nil, WithEnableOTA())
+	replyURI := uri.URI(uri.SysPrefix, uri.ThingFileDownloadReply, "pk", "dn")
+
+	frame := func(id uint, code int, block []byte) []byte {
+		js := fmt.Sprintf(`{"id":"%d","code":%d,"data":{"bSize":%d,"bOffset":16,"fileLength":64},"msg":"failed"}`,
+			id, code, len(block)-2)
+		b := make([]byte, 2, 2+len(js)+len(block))
+		binary.BigEndian.PutUint16(b, uint16(len(js)))
+		return append(append(b, js...), block...)
+	}
+
+	t.Run("success", func(t *testing.T) {
+		token, err := c.ThingFileDownloadContext(context.Background(), "pk", "dn", FileDownloadParams{})
+		require.NoError(t, err)
+		require.NoError(t, conn.deliver(replyURI, frame(token.id, 200, fileBlockFrame("block", binary.BigEndian))))
+		m, err := token.WaitContext(context.Background())
+		require.NoError(t, err)
+		blk := m.Data.(FileBlock)
+		assert.Equal(t, "block", string(blk.Data))
+		assert.Equal(t, int64(16), blk.BOffset)
+		assert.Equal(t, int64(64), blk.FileLength)
+	})
+	t.Run("corrupt", func(t *testing.T) {
+		token, err := c.ThingFileDownloadContext(context.Background(), "pk", "dn", FileDownloadParams{})
+		require.NoError(t, err)
+		block := fileBlockFrame("block", binary.BigEndian)
+		block[0] = 'B'
+		require.NoError(t, conn.deliver(replyURI, frame(token.id, 200, block)))
+		_, err = token.WaitContext(context.Background())
+		assert.Equal(t, ErrFileBlockCorrupt, err)
+	})
+	t.Run("error code", func(t *testing.T) {
+		token, err := c.ThingFileDownloadContext(context.Background(), "pk", "dn", FileDownloadParams{})
+		require.NoError(t, err)
+		require.NoError(t, conn.deliver(replyURI, frame(token.id, 9201, fileBlockFrame("", binary.BigEndian))))
+		_, err = token.WaitContext(context.Background())
+		var ce *infra.CodeError
+		require.True(t, errors.As(err, &ce))
+		assert.Equal(t, 9201, ce.Code())
+		assert.Equal(t, "failed", ce.Message())
+	})
+	t.Run("truncated json", func(t *testing.T) {
+		assert.Equal(t, ErrInvalidParameter, conn.deliver(replyURI, []byte{0x00, 0x10, '{'}))
+	})
+}
@@ -0,0 +1,180 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+import (
+	"sort"
+	"time"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+)
+
+// 物模型历史数据上报的平台限制
+const (
+	HistoryMaxDevices    = 30  // 一次最多为30个设备上报数据
+	HistoryMaxProperties = 200 // 一次最多200个属性值
+	HistoryMaxEvents     = 20  // 一次最多20个事件值
+)
+
+// HistoryRecord 同一时刻的属性或事件, key为标识符
+type HistoryRecord map[string]PackValue
+
+// HistoryParams 单个设备的物模型历史数据, 为history post的params数组元素
+type HistoryParams struct {
+	Identity   infra.MetaPair  `json:"identity"`
+	Properties []HistoryRecord `json:"properties,omitempty"`
+	Events     []HistoryRecord `json:"events,omitempty"`
+}
+
+type historyDevice struct {
+	identity   infra.MetaPair
+	properties map[int64]HistoryRecord
+	events     map[int64]HistoryRecord
+}
+
+// HistoryBuilder 物模型历史数据构建器,按设备分组,按时间升序排列,
+// 超出平台限制时自动拆分为多个批次,非协程安全
+type HistoryBuilder struct {
+	devices []*historyDevice
+	index   map[string]*historyDevice
+}
+
+// NewHistoryBuilder 新建物模型历史数据构建器
+func NewHistoryBuilder() *HistoryBuilder {
+	return &HistoryBuilder{index: make(map[string]*historyDevice)}
+}
+
+// AddProperty 添加设备某一时刻的属性值, 同一时刻同一属性多次添加时仅保留最后一次
+func (sf *HistoryBuilder) AddProperty(pk, dn, identifier string, value interface{}, t time.Time) *HistoryBuilder {
+	d := sf.device(pk, dn)
+	addHistoryRecord(d.properties, identifier, value, t)
+	return sf
+}
+
+// AddProperties 添加设备某一时刻的多个属性值
+func (sf *HistoryBuilder) AddProperties(pk, dn string, params map[string]interface{}, t time.Time) *HistoryBuilder {
+	d := sf.device(pk, dn)
+	for id, v := range params {
+		addHistoryRecord(d.properties, id, v, t)
+	}
+	return sf
+}
+
+// AddEvent 添加设备某一时刻的事件, 同一时刻同一事件多次添加时仅保留最后一次
+func (sf *HistoryBuilder) AddEvent(pk, dn, identifier string, value interface{}, t time.Time) *HistoryBuilder {
+	d := sf.device(pk, dn)
+	addHistoryRecord(d.events, identifier, value, t)
+	return sf
+}
+
+// Build 按平台限制拆分为多个批次, 每个批次为一次上报的params
+func (sf *HistoryBuilder) Build() [][]HistoryParams {
+	s := &historySplitter{}
+	for _, d := range sf.devices {
+		s.addDevice(d)
+	}
+	return s.chunks
+}
+
+func (sf *HistoryBuilder) device(pk, dn string) *historyDevice {
+	key := FormatKey(pk, dn)
+	d, ok := sf.index[key]
+	if !ok {
+		d = &historyDevice{
+			identity:   infra.MetaPair{ProductKey: pk, DeviceName: dn},
+			properties: make(map[int64]HistoryRecord),
+			events:     make(map[int64]HistoryRecord),
+		}
+		sf.index[key] = d
+		sf.devices = append(sf.devices, d)
+	}
+	return d
+}
+
+func addHistoryRecord(records map[int64]HistoryRecord, identifier string, value interface{}, t time.Time) {
+	ms := infra.Millisecond(t)
+	r, ok := records[ms]
+	if !ok {
+		r = make(HistoryRecord)
+		records[ms] = r
+	}
+	r[identifier] = PackValue{value, ms}
+}
+
+// sortedRecords 按时间升序排列
+func sortedRecords(records map[int64]HistoryRecord) []int64 {
+	ts := make([]int64, 0, len(records))
+	for t := range records {
+		ts = append(ts, t)
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i] < ts[j] })
+	return ts
+}
+
+// historySplitter 按平台限制拆分批次
+type historySplitter struct {
+	chunks     [][]HistoryParams
+	properties int
+	events     int
+}
+
+// next 新建批次
+func (sf *historySplitter) next() {
+	sf.chunks = append(sf.chunks, nil)
+	sf.properties, sf.events = 0, 0
+}
+
+// open 在当前批次中添加设备数据, full为true或当前批次设备数已达限制时新建批次
+func (sf *historySplitter) open(d *historyDevice, full bool) *HistoryParams {
+	if full || len(sf.chunks) == 0 || len(sf.chunks[len(sf.chunks)-1]) >= HistoryMaxDevices {
+		sf.next()
+	}
+	i := len(sf.chunks) - 1
+	sf.chunks[i] = append(sf.chunks[i], HistoryParams{Identity: d.identity})
+	return &sf.chunks[i][len(sf.chunks[i])-1]
+}
+
+func (sf *historySplitter) addDevice(d *historyDevice) {
+	// p 当前批次中该设备的数据,在添加数据时创建,以免产生空的设备数据
+	var p *HistoryParams
+
+	sf.addRecords(d.properties, &sf.properties, HistoryMaxProperties, func(full bool) []HistoryRecord {
+		if full || p == nil {
+			p = sf.open(d, full)
+		}
+		p.Properties = append(p.Properties, make(HistoryRecord))
+		return p.Properties
+	})
+	sf.addRecords(d.events, &sf.events, HistoryMaxEvents, func(full bool) []HistoryRecord {
+		if full || p == nil {
+			p = sf.open(d, full)
+		}
+		p.Events = append(p.Events, make(HistoryRecord))
+		return p.Events
+	})
+}
+
+// addRecords 按时间升序添加记录, 当前批次数量达到限制时拆分同一时刻的记录到新批次
+func (sf *historySplitter) addRecords(records map[int64]HistoryRecord, count *int, max int,
+	newRecord func(full bool) []HistoryRecord) {
+	for _, t := range sortedRecords(records) {
+		r := records[t]
+		ids := make([]string, 0, len(r))
+		for id := range r {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		var cur HistoryRecord
+		for _, id := range ids {
+			if full := *count >= max; full || cur == nil {
+				rs := newRecord(full)
+				cur = rs[len(rs)-1]
+			}
+			cur[id] = r[id]
+			*count++
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package aiot
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// historyChunk 批次的数据统计
+type historyChunk struct {
+	devices    int
+	properties int
+	events     int
+}
+
+func summaryHistory(t *testing.T, chunks [][]HistoryParams) []historyChunk {
+	ss := make([]historyChunk, 0, len(chunks))
+	for _, chunk := range chunks {
+		s := historyChunk{devices: len(chunk)}
+		for _, p := range chunk {
+			assert.False(t, len(p.Properties) == 0 && len(p.Events) == 0, "empty device %v", p.Identity)
+			for _, r := range p.Properties {
+				s.properties += len(r)
+			}
+			for _, r := range p.Events {
+				s.events += len(r)
+			}
+		}
+		assert.LessOrEqual(t, s.devices, HistoryMaxDevices)
+		assert.LessOrEqual(t, s.properties, HistoryMaxProperties)
+		assert.LessOrEqual(t, s.events, HistoryMaxEvents)
+		ss = append(ss, s)
+	}
+	return ss
+}
+
+func TestHistoryBuilder_Build(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name       string
+		devices    int
+		times      int // 每个设备的时刻数
+		properties int // 每个时刻的属性数
+		events     int // 每个时刻的事件数
+		want       []historyChunk
+	}{
+		{"empty", 0, 0, 0, 0, []historyChunk{}},
+		{"properties at limit", 1, 2, 100, 0, []historyChunk{{1, 200, 0}}},
+		{"properties over limit", 1, 3, 100, 0, []historyChunk{{1, 200, 0}, {1, 100, 0}}},
+		{"record split", 1, 1, 201, 0, []historyChunk{{1, 200, 0}, {1, 1, 0}}},
+		{"events over limit", 1, 21, 0, 1, []historyChunk{{1, 0, 20}, {1, 0, 1}}},
+		{"devices at limit", 30, 1, 1, 0, []historyChunk{{30, 30, 0}}},
+		{"devices over limit", 31, 1, 1, 0, []historyChunk{{30, 30, 0}, {1, 1, 0}}},
+		{"device spans chunks", 2, 1, 150, 0, []historyChunk{{2, 200, 0}, {1, 100, 0}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewHistoryBuilder()
+			for d := 0; d < tt.devices; d++ {
+				dn := fmt.Sprintf("dn%d", d)
+				for ts := 0; ts < tt.times; ts++ {
+					tm := now.Add(time.Duration(ts) * time.Second)
+					for i := 0; i < tt.properties; i++ {
+						b.AddProperty("pk", dn, fmt.Sprintf("p%d", i), i, tm)
+					}
+					for i := 0; i < tt.events; i++ {
+						b.AddEvent("pk", dn, fmt.Sprintf("e%d", i), i, tm)
+					}
+				}
+			}
+			assert.Equal(t, tt.want, summaryHistory(t, b.Build()))
+		})
+	}
+}
+
+func TestHistoryBuilder_Order(t *testing.T) {
+	t1, t2, t3 := time.Unix(1, 0), time.Unix(2, 0), time.Unix(3, 0)
+	chunks := NewHistoryBuilder().
+		AddProperty("pk", "dn", "p", 3, t3).
+		AddProperty("pk", "dn", "p", 1, t1).
+		AddProperties("pk", "dn", map[string]interface{}{"p": 2, "q": 2}, t2).
+		AddProperty("pk", "dn", "p", 4, t3).
+		Build()
+	if assert.Len(t, chunks, 1) && assert.Len(t, chunks[0], 1) {
+		assert.Equal(t, []HistoryRecord{
+			{"p": {1, 1000}},
+			{"p": {2, 2000}, "q": {2, 2000}},
+			{"p": {4, 3000}},
+		}, chunks[0][0].Properties)
+	}
+}
@@ -5,6 +5,7 @@
 package aiot
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/thinkgos/aliyun-iot/infra"
@@ -26,6 +27,11 @@ type DeviceInfoLabel struct {
 // request:  /sys/{productKey}/{deviceName}/thing/deviceinfo/update
 // response: /sys/{productKey}/{deviceName}/thing/deviceinfo/update_reply
 func (sf *Client) ThingDeviceInfoUpdate(pk, dn string, params []DeviceInfoLabel) (*Token, error) {
+	return sf.ThingDeviceInfoUpdateContext(context.Background(), pk, dn, params)
+}
+
+// ThingDeviceInfoUpdateContext 同 ThingDeviceInfoUpdate, 带ctx
+func (sf *Client) ThingDeviceInfoUpdateContext(ctx context.Context, pk, dn string, params []DeviceInfoLabel) (*Token, error) {
 	if len(params) == 0 {
 		return nil, ErrInvalidParameter
 	}
@@ -33,7 +39,7 @@ func (sf *Client) ThingDeviceInfoUpdate(pk, dn string, params []DeviceInfoLabel)
 		return nil, ErrNotActive
 	}
 	_uri := uri.URI(uri.SysPrefix, uri.ThingDeviceInfoUpdate, pk, dn)
-	return sf.SendRequest(_uri, infra.MethodDeviceInfoUpdate, params)
+	return sf.SendRequestContext(ctx, _uri, infra.MethodDeviceInfoUpdate, params)
 }
 
 // DeviceLabelKey 删除设备标答的键
@@ -45,6 +51,11 @@ type DeviceLabelKey struct {
 // request:  /sys/{productKey}/{deviceName}/thing/deviceinfo/delete
 // response: /sys/{productKey}/{deviceName}/thing/deviceinfo/delete_reply
 func (sf *Client) ThingDeviceInfoDelete(pk, dn string, params []DeviceLabelKey) (*Token, error) {
+	return sf.ThingDeviceInfoDeleteContext(context.Background(), pk, dn, params)
+}
+
+// ThingDeviceInfoDeleteContext 同 ThingDeviceInfoDelete, 带ctx
+func (sf *Client) ThingDeviceInfoDeleteContext(ctx context.Context, pk, dn string, params []DeviceLabelKey) (*Token, error) {
 	if len(params) == 0 {
 		return nil, ErrInvalidParameter
 	}
@@ -52,7 +63,7 @@ func (sf *Client) ThingDeviceInfoDelete(pk, dn string, params []DeviceLabelKey)
 		return nil, ErrNotActive
 	}
 	_uri := uri.URI(uri.SysPrefix, uri.ThingDeviceInfoDelete, pk, dn)
-	return sf.SendRequest(_uri, infra.MethodDeviceInfoDelete, params)
+	return sf.SendRequestContext(ctx, _uri, infra.MethodDeviceInfoDelete, params)
 }
 
 // ProcThingDeviceInfoUpdateReply 处理设备信息更新应答
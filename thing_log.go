@@ -5,6 +5,7 @@
 package aiot
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/thinkgos/aliyun-iot/infra"
@@ -34,12 +35,17 @@ type ConfigLogParam struct {
 // ThingConfigLogGet 获取日志配置
 // request： /sys/${productKey}/${deviceName}/thing/config/Log/get
 // response：/sys/${productKey}/${deviceName}/thing/config/Log/get_reply
-func (sf *Client) ThingConfigLogGet(pk, dn string, _ ConfigLogParam) (*Token, error) {
+func (sf *Client) ThingConfigLogGet(pk, dn string, clp ConfigLogParam) (*Token, error) {
+	return sf.ThingConfigLogGetContext(context.Background(), pk, dn, clp)
+}
+
+// ThingConfigLogGetContext 同 ThingConfigLogGet, 带ctx
+func (sf *Client) ThingConfigLogGetContext(ctx context.Context, pk, dn string, clp ConfigLogParam) (*Token, error) {
 	if !sf.IsActive(pk, dn) {
 		return nil, ErrNotActive
 	}
 	_uri := uri.URI(uri.SysPrefix, uri.ThingConfigLogGet, pk, dn)
-	return sf.SendRequest(_uri, infra.MethodConfigLogGet, ConfigLogParam{
+	return sf.SendRequestContext(ctx, _uri, infra.MethodConfigLogGet, ConfigLogParam{
 		"device",
 		"content",
 	})
@@ -70,6 +76,11 @@ type LogParam struct {
 // request： /sys/${productKey}/${deviceName}/thing/config/Log/post
 // response：/sys/${productKey}/${deviceName}/thing/config/Log/post_reply
 func (sf *Client) ThingLogPost(pk, dn string, lp []LogParam) (*Token, error) {
+	return sf.ThingLogPostContext(context.Background(), pk, dn, lp)
+}
+
+// ThingLogPostContext 同 ThingLogPost, 带ctx
+func (sf *Client) ThingLogPostContext(ctx context.Context, pk, dn string, lp []LogParam) (*Token, error) {
 	if !sf.IsActive(pk, dn) {
 		return nil, ErrNotActive
 	}
@@ -77,7 +88,7 @@ func (sf *Client) ThingLogPost(pk, dn string, lp []LogParam) (*Token, error) {
 		return nil, ErrInvalidParameter
 	}
 	_uri := uri.URI(uri.SysPrefix, uri.ThingLogPost, pk, dn)
-	return sf.SendRequest(_uri, infra.MethodLogPost, lp)
+	return sf.SendRequestContext(ctx, _uri, infra.MethodLogPost, lp)
 }
 
 // ConfigLogMode 日志配置的日志上报模式
@@ -140,7 +151,7 @@ func ProcThingLogPostReply(c *Client, rawURI string, payload []byte) error {
 		err = infra.NewCodeError(rsp.Code, rsp.Message)
 	}
 	c.signalPending(Message{rsp.ID, nil, err})
-	c.Log.Debugf("thing.log.post.reply @%d", rsp.ID)
+	c.logFor(rawURI).Debugf("thing.log.post.reply @%d", rsp.ID)
 	pk, dn := uris[1], uris[2]
 	return c.cb.ThingLogPostReply(c, err, pk, dn)
 }
@@ -152,7 +163,7 @@ type ConfigLogPush struct {
 	Params  ConfigLogParamData `json:"params"`
 }
 
-// ProcThingConfigLogPush 处理日志配置推送
+// ProcThingConfigLogPush 处理日志配置推送, 设置了 CloudLogger 时同时更新其上报模式
 // subscribe: /sys/${productKey}/${deviceName}/thing/config/Log/push
 func ProcThingConfigLogPush(c *Client, rawURI string, payload []byte) error {
 	uris := uri.Spilt(rawURI)
@@ -168,5 +179,8 @@ func ProcThingConfigLogPush(c *Client, rawURI string, payload []byte) error {
 
 	c.Log.Debugf("thing.config.log.push @%d", req.ID)
 	pk, dn := uris[1], uris[2]
+	if c.cloudLog != nil && pk == c.tetrad.ProductKey && dn == c.tetrad.DeviceName {
+		c.cloudLog.SetMode(req.Params.Content.Mode)
+	}
 	return c.cb.ThingConfigLogPush(c, pk, dn, req.Params)
 }
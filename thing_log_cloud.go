@@ -0,0 +1,374 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thinkgos/x/lib/logger"
+
+	"github.com/thinkgos/aliyun-iot/uri"
+)
+
+// 云端日志默认值
+const (
+	// DefaultCloudLogBatch 默认单次上报的最大日志条数
+	DefaultCloudLogBatch = 40
+	// DefaultCloudLogInterval 默认上报间隔
+	DefaultCloudLogInterval = 5 * time.Second
+	// DefaultCloudLogBuffer 默认本地缓存的最大日志条数
+	DefaultCloudLogBuffer = 1000
+	// DefaultCloudLogMaxContent 默认日志内容的最大长度,超出截断
+	DefaultCloudLogMaxContent = 4096
+	// DefaultCloudLogTimeout 默认上报及获取日志配置的超时时间
+	DefaultCloudLogTimeout = 10 * time.Second
+)
+
+// 云端日志上报模式
+const (
+	cloudLogModeUnknown = -1
+	cloudLogModeOff     = 0
+	cloudLogModeOn      = 1
+)
+
+// LogUtcTimeLayout 日志采集时间的格式, 即 yyyy-MM-dd'T'HH:mm:ss.SSSZ
+const LogUtcTimeLayout = "2006-01-02T15:04:05.000-0700"
+
+// CloudLoggerOption 云端日志选项
+type CloudLoggerOption func(*CloudLogger)
+
+// WithCloudLogModule 设置日志的模块名称
+func WithCloudLogModule(module string) CloudLoggerOption {
+	return func(l *CloudLogger) {
+		l.module = module
+	}
+}
+
+// WithCloudLogLevel 设置上报的最低日志级别, 默认 LogInfo
+func WithCloudLogLevel(level string) CloudLoggerOption {
+	return func(l *CloudLogger) {
+		l.level = logPriority(level)
+	}
+}
+
+// WithCloudLogBatch 设置单次上报的最大日志条数及上报间隔, 默认 DefaultCloudLogBatch, DefaultCloudLogInterval
+func WithCloudLogBatch(size int, interval time.Duration) CloudLoggerOption {
+	return func(l *CloudLogger) {
+		if size > 0 {
+			l.batch = size
+		}
+		if interval > 0 {
+			l.interval = interval
+		}
+	}
+}
+
+// WithCloudLogBuffer 设置本地缓存的最大日志条数, 默认 DefaultCloudLogBuffer
+func WithCloudLogBuffer(size int) CloudLoggerOption {
+	return func(l *CloudLogger) {
+		if size > 0 {
+			l.maxBuffer = size
+		}
+	}
+}
+
+// CloudLogger 上报日志到云端的 logger.Logger 实现, 协程安全.
+// 日志同时输出到本地的logger, 不低于设定级别的日志缓存后按批通过 ThingLogPost 上报,
+// 上报模式由日志配置推送及设备上线时获取的日志配置决定, 模式未知时仅缓存, 关闭上报时丢弃,
+// 连接断开或上报失败时保留在本地缓存中, 缓存满时优先丢弃级别最低且最早的日志.
+// 由 WithCloudLogger 设置为 Client 的日志, 客户端创建完成后开始上报.
+// 客户端发送日志上报请求过程中产生的日志(发布失败,限流重发等)只输出到本地, 避免循环上报
+type CloudLogger struct {
+	next       logger.Logger
+	module     string
+	level      int
+	batch      int
+	interval   time.Duration
+	maxBuffer  int
+	maxContent int
+
+	mu      sync.Mutex
+	c       *Client
+	mode    int
+	buf     []LogParam
+	dropped int
+	flush   chan struct{}
+	closed  chan struct{}
+	done    chan struct{}
+}
+
+var _ logger.Logger = (*CloudLogger)(nil)
+
+// NewCloudLogger 新建云端日志, next 为本地日志输出, 为nil时不输出到本地
+func NewCloudLogger(next logger.Logger, opts ...CloudLoggerOption) *CloudLogger {
+	if next == nil {
+		next = logger.NewDiscard()
+	}
+	sf := &CloudLogger{
+		next:       next,
+		level:      logPriority(LogInfo),
+		batch:      DefaultCloudLogBatch,
+		interval:   DefaultCloudLogInterval,
+		maxBuffer:  DefaultCloudLogBuffer,
+		maxContent: DefaultCloudLogMaxContent,
+		mode:       cloudLogModeUnknown,
+		flush:      make(chan struct{}, 1),
+		closed:     make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(sf)
+	}
+	return sf
+}
+
+// Debugf 实现 logger.Logger 接口
+func (sf *CloudLogger) Debugf(format string, args ...interface{}) {
+	sf.next.Debugf(format, args...)
+	sf.record(LogDebug, format, args...)
+}
+
+// Infof 实现 logger.Logger 接口
+func (sf *CloudLogger) Infof(format string, args ...interface{}) {
+	sf.next.Infof(format, args...)
+	sf.record(LogInfo, format, args...)
+}
+
+// Warnf 实现 logger.Logger 接口
+func (sf *CloudLogger) Warnf(format string, args ...interface{}) {
+	sf.next.Warnf(format, args...)
+	sf.record(LogWarn, format, args...)
+}
+
+// Errorf 实现 logger.Logger 接口
+func (sf *CloudLogger) Errorf(format string, args ...interface{}) {
+	sf.next.Errorf(format, args...)
+	sf.record(LogError, format, args...)
+}
+
+// DPanicf 实现 logger.Logger 接口
+func (sf *CloudLogger) DPanicf(format string, args ...interface{}) {
+	sf.record(LogError, format, args...)
+	sf.next.DPanicf(format, args...)
+}
+
+// Fatalf 实现 logger.Logger 接口, 本地日志退出程序前尽力上报缓存的日志
+func (sf *CloudLogger) Fatalf(format string, args ...interface{}) {
+	sf.record(LogFatal, format, args...)
+	sf.post()
+	sf.next.Fatalf(format, args...)
+}
+
+// Record 缓存一条日志, 可指定code及traceContext等, UtcTime为空时使用当前时间, Module为空时使用设定的模块名称
+func (sf *CloudLogger) Record(lp LogParam) {
+	if logPriority(lp.LogLevel) < sf.level {
+		return
+	}
+	if lp.UtcTime == "" {
+		lp.UtcTime = time.Now().Format(LogUtcTimeLayout)
+	}
+	if lp.Module == "" {
+		lp.Module = sf.module
+	}
+	if len(lp.LogContent) > sf.maxContent {
+		lp.LogContent = lp.LogContent[:sf.maxContent]
+	}
+
+	sf.mu.Lock()
+	if sf.mode == cloudLogModeOff {
+		sf.mu.Unlock()
+		return
+	}
+	if len(sf.buf) >= sf.maxBuffer {
+		sf.dropped++
+		if !sf.dropLocked(logPriority(lp.LogLevel)) {
+			sf.mu.Unlock()
+			return
+		}
+	}
+	sf.buf = append(sf.buf, lp)
+	full := sf.mode == cloudLogModeOn && len(sf.buf) >= sf.batch
+	sf.mu.Unlock()
+
+	if full {
+		select {
+		case sf.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// SetMode 设置上报模式, mode 0 表示不上报并丢弃缓存的日志, 1 表示上报
+func (sf *CloudLogger) SetMode(mode int) {
+	sf.mu.Lock()
+	if mode != cloudLogModeOn {
+		mode = cloudLogModeOff
+		sf.buf = nil
+	}
+	sf.mode = mode
+	sf.mu.Unlock()
+	if mode == cloudLogModeOn {
+		select {
+		case sf.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Dropped 获得因缓存满而丢弃的日志条数
+func (sf *CloudLogger) Dropped() int {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return sf.dropped
+}
+
+// Close 停止上报, 关闭前尽力上报缓存的日志
+func (sf *CloudLogger) Close() error {
+	sf.mu.Lock()
+	started := sf.c != nil
+	select {
+	case <-sf.closed:
+		sf.mu.Unlock()
+		return nil
+	default:
+		close(sf.closed)
+	}
+	sf.mu.Unlock()
+	if started {
+		<-sf.done
+	}
+	return nil
+}
+
+// start 绑定客户端并开始上报
+func (sf *CloudLogger) start(c *Client) {
+	sf.mu.Lock()
+	if sf.c != nil {
+		sf.mu.Unlock()
+		return
+	}
+	sf.c = c
+	sf.mu.Unlock()
+	go sf.run()
+}
+
+func (sf *CloudLogger) run() {
+	defer close(sf.done)
+	tick := time.NewTicker(sf.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-sf.closed:
+			sf.post()
+			return
+		case <-tick.C:
+		case <-sf.flush:
+		}
+		sf.post()
+	}
+}
+
+// post 按批上报缓存的日志, 上报失败时放回缓存
+func (sf *CloudLogger) post() {
+	for {
+		sf.mu.Lock()
+		c := sf.c
+		if c == nil || sf.mode != cloudLogModeOn || len(sf.buf) == 0 || c.IsOffline() {
+			sf.mu.Unlock()
+			return
+		}
+		n := len(sf.buf)
+		if n > sf.batch {
+			n = sf.batch
+		}
+		batch := append([]LogParam{}, sf.buf[:n]...)
+		sf.buf = sf.buf[n:]
+		sf.mu.Unlock()
+
+		pk, dn := c.tetrad.ProductKey, c.tetrad.DeviceName
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultCloudLogTimeout)
+		err := c.LinkThingLogPostContext(ctx, pk, dn, batch)
+		cancel()
+		if err != nil {
+			sf.next.Warnf("cloud log post %d records, %+v", len(batch), waitError(err))
+			sf.mu.Lock()
+			if sf.mode == cloudLogModeOn {
+				sf.buf = append(batch, sf.buf...)
+				for len(sf.buf) > sf.maxBuffer && sf.dropLocked(logPriority(LogFatal)) {
+					sf.dropped++
+				}
+			}
+			sf.mu.Unlock()
+			return
+		}
+	}
+}
+
+// logFor 获得uri相关日志的输出, 日志上报请求及其应答的日志只输出到本地
+func (sf *Client) logFor(_uri string) logger.Logger {
+	if sf.cloudLog != nil &&
+		(strings.HasSuffix(_uri, uri.Sep+uri.ThingLogPost) || strings.HasSuffix(_uri, uri.Sep+uri.ThingLogPostReply)) {
+		return sf.cloudLog.next
+	}
+	return sf.Log
+}
+
+// onConnect 设备上线, 获取日志配置
+func (sf *CloudLogger) onConnect(c *Client, pk, dn string, _ bool) {
+	if pk != c.tetrad.ProductKey || dn != c.tetrad.DeviceName {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultCloudLogTimeout)
+	data, err := c.LinkThingConfigLogGetContext(ctx, pk, dn, ConfigLogParam{})
+	cancel()
+	if err != nil {
+		sf.next.Warnf("cloud log get config, %+v", waitError(err))
+		return
+	}
+	sf.SetMode(data.Content.Mode)
+}
+
+func (sf *CloudLogger) record(level, format string, args ...interface{}) {
+	if logPriority(level) < sf.level {
+		return
+	}
+	sf.Record(LogParam{LogLevel: level, LogContent: fmt.Sprintf(format, args...)})
+}
+
+// dropLocked 缓存满时丢弃级别最低且最早的一条日志, 仅丢弃级别不高于priority的日志, 无可丢弃时返回false
+func (sf *CloudLogger) dropLocked(priority int) bool {
+	idx := -1
+	for i, lp := range sf.buf {
+		if p := logPriority(lp.LogLevel); p <= priority && (idx < 0 || p < logPriority(sf.buf[idx].LogLevel)) {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return false
+	}
+	sf.buf = append(sf.buf[:idx], sf.buf[idx+1:]...)
+	return true
+}
+
+// logPriority 日志级别的优先级, 越大越重要
+func logPriority(level string) int {
+	switch level {
+	case LogFatal:
+		return 5
+	case LogError:
+		return 4
+	case LogWarn:
+		return 3
+	case LogInfo:
+		return 2
+	case LogDebug:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,57 @@
+package aiot
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+	"github.com/thinkgos/aliyun-iot/uri"
+)
+
+func TestCloudLogger_NoSelfLog(t *testing.T) {
+	var mu sync.Mutex
+	posts := 0
+	reply := func(topic string, req fakeRequest) (Response, bool) {
+		if !strings.HasSuffix(topic, uri.ThingLogPost) {
+			return Response{}, false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		posts++
+		// 首次上报失败, 按重试策略重试
+		if posts == 1 {
+			return Response{ID: req.ID, Code: infra.CodeSystemUnknownException, Message: "failed"}, true
+		}
+		return Response{ID: req.ID, Code: infra.CodeSuccess, Data: struct{}{}}, true
+	}
+	countPosts := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return posts
+	}
+
+	l := NewCloudLogger(nil, WithCloudLogLevel(LogDebug), WithCloudLogBatch(10, 10*time.Millisecond))
+	c, _ := newFakeClient(reply,
+		WithCloudLogger(l),
+		WithRetryPolicy(RetryPolicy{
+			MaxAttempts: 2,
+			Backoff:     time.Millisecond,
+			Codes:       []int{infra.CodeSystemUnknownException},
+		}))
+	defer l.Close()
+
+	l.SetMode(cloudLogModeOn)
+	c.Log.Debugf("hello")
+	assert.Eventually(t, func() bool { return countPosts() == 2 }, time.Second, 5*time.Millisecond)
+
+	// 上报请求, 重试及应答的日志不再进入缓存, 不会继续上报
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 2, countPosts())
+	l.mu.Lock()
+	assert.Empty(t, l.buf)
+	l.mu.Unlock()
+}
@@ -5,6 +5,7 @@
 package aiot
 
 import (
+	"context"
 	"encoding/json"
 	"time"
 
@@ -28,7 +29,7 @@ type TopoAddParams struct {
 // 子设备身份注册后,需网关上报与子设备的关系,然后才进行子设备上线
 // request:   /sys/{productKey}/{deviceName}/thing/topo/add
 // response:  /sys/{productKey}/{deviceName}/thing/topo/add_reply
-func (sf *Client) thingTopoAdd(pk, dn string) (*Token, error) {
+func (sf *Client) thingTopoAdd(ctx context.Context, pk, dn string) (*Token, error) {
 	if !sf.isGateway {
 		return nil, ErrNotSupportFeature
 	}
@@ -45,7 +46,7 @@ func (sf *Client) thingTopoAdd(pk, dn string) (*Token, error) {
 			DeviceSecret: ds,
 		}, timestamp)
 	_uri := sf.URIGateway(uri.SysPrefix, uri.ThingTopoAdd)
-	return sf.SendRequest(_uri, infra.MethodTopoAdd, []TopoAddParams{
+	return sf.SendRequestContext(ctx, _uri, infra.MethodTopoAdd, []TopoAddParams{
 		{
 			pk,
 			dn,
@@ -60,12 +61,12 @@ func (sf *Client) thingTopoAdd(pk, dn string) (*Token, error) {
 // thingTopoDelete 删除网关与子设备的拓扑关系
 // request： /sys/{productKey}/{deviceName}/thing/topo/delete
 // response：/sys/{productKey}/{deviceName}/thing/topo/delete_reply
-func (sf *Client) thingTopoDelete(pk, dn string) (*Token, error) {
+func (sf *Client) thingTopoDelete(ctx context.Context, pk, dn string) (*Token, error) {
 	if !sf.isGateway {
 		return nil, ErrNotSupportFeature
 	}
 	_uri := sf.URIGateway(uri.SysPrefix, uri.ThingTopoDelete)
-	return sf.SendRequest(_uri, infra.MethodTopoDelete, []infra.MetaPair{
+	return sf.SendRequestContext(ctx, _uri, infra.MethodTopoDelete, []infra.MetaPair{
 		{ProductKey: pk, DeviceName: dn},
 	})
 }
@@ -74,11 +75,16 @@ func (sf *Client) thingTopoDelete(pk, dn string) (*Token, error) {
 // request:   /sys/{productKey}/{deviceName}/thing/topo/get
 // response:  /sys/{productKey}/{deviceName}/thing/topo/get_reply
 func (sf *Client) ThingTopoGet() (*Token, error) {
+	return sf.ThingTopoGetContext(context.Background())
+}
+
+// ThingTopoGetContext 同 ThingTopoGet, 带ctx
+func (sf *Client) ThingTopoGetContext(ctx context.Context) (*Token, error) {
 	if !sf.isGateway {
 		return nil, ErrNotSupportFeature
 	}
 	_uri := sf.URIGateway(uri.SysPrefix, uri.ThingTopoGet)
-	return sf.SendRequest(_uri, infra.MethodTopoGet, "{}")
+	return sf.SendRequestContext(ctx, _uri, infra.MethodTopoGet, "{}")
 }
 
 // ThingListFound 发现设备列表上报
@@ -87,6 +93,11 @@ func (sf *Client) ThingTopoGet() (*Token, error) {
 // request： /sys/{productKey}/{deviceName}/thing/list/found
 // response：/sys/{productKey}/{deviceName}/thing/list/found_reply
 func (sf *Client) ThingListFound(pairs []infra.MetaPair) (*Token, error) {
+	return sf.ThingListFoundContext(context.Background(), pairs)
+}
+
+// ThingListFoundContext 同 ThingListFound, 带ctx
+func (sf *Client) ThingListFoundContext(ctx context.Context, pairs []infra.MetaPair) (*Token, error) {
 	if !sf.isGateway {
 		return nil, ErrNotSupportFeature
 	}
@@ -94,7 +105,7 @@ func (sf *Client) ThingListFound(pairs []infra.MetaPair) (*Token, error) {
 		return nil, ErrInvalidParameter
 	}
 	_uri := sf.URIGateway(uri.SysPrefix, uri.ThingListFound)
-	return sf.SendRequest(_uri, infra.MethodListFound, pairs)
+	return sf.SendRequestContext(ctx, _uri, infra.MethodListFound, pairs)
 }
 
 // TopoAddResponse 添加网络拓扑应答
@@ -0,0 +1,203 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+import (
+	"time"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+)
+
+// 网关批量上报数据的平台限制
+const (
+	PackMaxProperties = 200 // 一次最多200个属性
+	PackMaxEvents     = 20  // 一次最多20个事件
+	PackMaxSubDevices = 20  // 一次最多为20个子设备上报数据
+)
+
+// PackValue 带时间戳的属性或事件值, Time 单位ms
+type PackValue struct {
+	Value interface{} `json:"value"`
+	Time  int64       `json:"time"`
+}
+
+// PackSubDevice 子设备的批量上报数据
+type PackSubDevice struct {
+	Identity   infra.MetaPair       `json:"identity"`
+	Properties map[string]PackValue `json:"properties,omitempty"`
+	Events     map[string]PackValue `json:"events,omitempty"`
+}
+
+// PackParams 网关批量上报数据的params
+type PackParams struct {
+	Properties map[string]PackValue `json:"properties,omitempty"`
+	Events     map[string]PackValue `json:"events,omitempty"`
+	SubDevices []PackSubDevice      `json:"subDevices,omitempty"`
+}
+
+type packItem struct {
+	identifier string
+	value      PackValue
+}
+
+type packDevice struct {
+	identity   infra.MetaPair
+	properties []packItem
+	events     []packItem
+}
+
+// PackBuilder 网关批量上报数据构建器,超出平台限制时自动拆分为多个批次,非协程安全
+type PackBuilder struct {
+	root       packDevice
+	subDevices []*packDevice
+	index      map[string]*packDevice
+}
+
+// NewPackBuilder 新建网关批量上报数据构建器
+func NewPackBuilder() *PackBuilder {
+	return &PackBuilder{index: make(map[string]*packDevice)}
+}
+
+// AddProperty 添加网关的属性, 同一属性多次添加时仅保留最后一次
+func (sf *PackBuilder) AddProperty(identifier string, value interface{}, t time.Time) *PackBuilder {
+	sf.root.properties = addPackItem(sf.root.properties, identifier, value, t)
+	return sf
+}
+
+// AddEvent 添加网关的事件, 同一事件多次添加时仅保留最后一次
+func (sf *PackBuilder) AddEvent(identifier string, value interface{}, t time.Time) *PackBuilder {
+	sf.root.events = addPackItem(sf.root.events, identifier, value, t)
+	return sf
+}
+
+// AddSubProperty 添加子设备的属性, 同一属性多次添加时仅保留最后一次
+func (sf *PackBuilder) AddSubProperty(pk, dn, identifier string, value interface{}, t time.Time) *PackBuilder {
+	d := sf.subDevice(pk, dn)
+	d.properties = addPackItem(d.properties, identifier, value, t)
+	return sf
+}
+
+// AddSubEvent 添加子设备的事件, 同一事件多次添加时仅保留最后一次
+func (sf *PackBuilder) AddSubEvent(pk, dn, identifier string, value interface{}, t time.Time) *PackBuilder {
+	d := sf.subDevice(pk, dn)
+	d.events = addPackItem(d.events, identifier, value, t)
+	return sf
+}
+
+// Build 按平台限制拆分为多个批次的params
+func (sf *PackBuilder) Build() []PackParams {
+	s := &packSplitter{}
+	s.addRoot(&sf.root)
+	for _, d := range sf.subDevices {
+		s.addSubDevice(d)
+	}
+	return s.chunks
+}
+
+func (sf *PackBuilder) subDevice(pk, dn string) *packDevice {
+	key := FormatKey(pk, dn)
+	d, ok := sf.index[key]
+	if !ok {
+		d = &packDevice{identity: infra.MetaPair{ProductKey: pk, DeviceName: dn}}
+		sf.index[key] = d
+		sf.subDevices = append(sf.subDevices, d)
+	}
+	return d
+}
+
+func addPackItem(items []packItem, identifier string, value interface{}, t time.Time) []packItem {
+	v := PackValue{value, infra.Millisecond(t)}
+	for i := range items {
+		if items[i].identifier == identifier {
+			items[i].value = v
+			return items
+		}
+	}
+	return append(items, packItem{identifier, v})
+}
+
+// packSplitter 按平台限制拆分批次
+type packSplitter struct {
+	chunks     []PackParams
+	properties int
+	events     int
+}
+
+// current 当前批次
+func (sf *packSplitter) current() *PackParams {
+	if len(sf.chunks) == 0 {
+		sf.next()
+	}
+	return &sf.chunks[len(sf.chunks)-1]
+}
+
+// next 新建批次
+func (sf *packSplitter) next() {
+	sf.chunks = append(sf.chunks, PackParams{})
+	sf.properties, sf.events = 0, 0
+}
+
+func (sf *packSplitter) addRoot(d *packDevice) {
+	for _, item := range d.properties {
+		if sf.properties >= PackMaxProperties {
+			sf.next()
+		}
+		p := sf.current()
+		if p.Properties == nil {
+			p.Properties = make(map[string]PackValue)
+		}
+		p.Properties[item.identifier] = item.value
+		sf.properties++
+	}
+	for _, item := range d.events {
+		if sf.events >= PackMaxEvents {
+			sf.next()
+		}
+		p := sf.current()
+		if p.Events == nil {
+			p.Events = make(map[string]PackValue)
+		}
+		p.Events[item.identifier] = item.value
+		sf.events++
+	}
+}
+
+func (sf *packSplitter) addSubDevice(d *packDevice) {
+	// sub 当前批次中该子设备的数据,在添加数据时创建,以免产生空的子设备数据
+	var sub *PackSubDevice
+	open := func(full bool) {
+		if full {
+			sf.next()
+		}
+		p := sf.current()
+		if len(p.SubDevices) >= PackMaxSubDevices {
+			sf.next()
+			p = sf.current()
+		}
+		p.SubDevices = append(p.SubDevices, PackSubDevice{Identity: d.identity})
+		sub = &p.SubDevices[len(p.SubDevices)-1]
+	}
+
+	for _, item := range d.properties {
+		if full := sf.properties >= PackMaxProperties; full || sub == nil {
+			open(full)
+		}
+		if sub.Properties == nil {
+			sub.Properties = make(map[string]PackValue)
+		}
+		sub.Properties[item.identifier] = item.value
+		sf.properties++
+	}
+	for _, item := range d.events {
+		if full := sf.events >= PackMaxEvents; full || sub == nil {
+			open(full)
+		}
+		if sub.Events == nil {
+			sub.Events = make(map[string]PackValue)
+		}
+		sub.Events[item.identifier] = item.value
+		sf.events++
+	}
+}
@@ -0,0 +1,92 @@
+package aiot
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+)
+
+// packChunk 批次的数据统计
+type packChunk struct {
+	properties int
+	events     int
+	subDevices int
+}
+
+func summaryPack(t *testing.T, chunks []PackParams) []packChunk {
+	ss := make([]packChunk, 0, len(chunks))
+	for _, p := range chunks {
+		s := packChunk{properties: len(p.Properties), events: len(p.Events), subDevices: len(p.SubDevices)}
+		for _, sub := range p.SubDevices {
+			assert.False(t, len(sub.Properties) == 0 && len(sub.Events) == 0, "empty sub device %v", sub.Identity)
+			s.properties += len(sub.Properties)
+			s.events += len(sub.Events)
+		}
+		assert.LessOrEqual(t, s.properties, PackMaxProperties)
+		assert.LessOrEqual(t, s.events, PackMaxEvents)
+		assert.LessOrEqual(t, s.subDevices, PackMaxSubDevices)
+		ss = append(ss, s)
+	}
+	return ss
+}
+
+func TestPackBuilder_Build(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name       string
+		properties int // 网关属性数
+		events     int // 网关事件数
+		subDevices int // 子设备数
+		subProps   int // 每个子设备的属性数
+		want       []packChunk
+	}{
+		{"empty", 0, 0, 0, 0, []packChunk{}},
+		{"properties at limit", 200, 0, 0, 0, []packChunk{{200, 0, 0}}},
+		{"properties over limit", 201, 0, 0, 0, []packChunk{{200, 0, 0}, {1, 0, 0}}},
+		{"events at limit", 0, 20, 0, 0, []packChunk{{0, 20, 0}}},
+		{"events over limit", 0, 41, 0, 0, []packChunk{{0, 20, 0}, {0, 20, 0}, {0, 1, 0}}},
+		{"sub devices at limit", 0, 0, 20, 1, []packChunk{{20, 0, 20}}},
+		{"sub devices over limit", 0, 0, 21, 1, []packChunk{{20, 0, 20}, {1, 0, 1}}},
+		{"sub device split", 0, 0, 1, 201, []packChunk{{200, 0, 1}, {1, 0, 1}}},
+		{"root and sub device share", 150, 0, 1, 100, []packChunk{{200, 0, 1}, {50, 0, 1}}},
+		{"events with sub devices", 0, 20, 2, 1, []packChunk{{2, 20, 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewPackBuilder()
+			for i := 0; i < tt.properties; i++ {
+				b.AddProperty(fmt.Sprintf("p%d", i), i, now)
+			}
+			for i := 0; i < tt.events; i++ {
+				b.AddEvent(fmt.Sprintf("e%d", i), i, now)
+			}
+			for d := 0; d < tt.subDevices; d++ {
+				for i := 0; i < tt.subProps; i++ {
+					b.AddSubProperty("pk", fmt.Sprintf("dn%d", d), fmt.Sprintf("p%d", i), i, now)
+				}
+			}
+			assert.Equal(t, tt.want, summaryPack(t, b.Build()))
+		})
+	}
+}
+
+func TestPackBuilder_Overwrite(t *testing.T) {
+	t1, t2 := time.Unix(1, 0), time.Unix(2, 0)
+	chunks := NewPackBuilder().
+		AddProperty("p", 1, t1).
+		AddProperty("p", 2, t2).
+		AddSubEvent("pk", "dn", "e", 1, t1).
+		AddSubEvent("pk", "dn", "e", 2, t2).
+		Build()
+	assert.Equal(t, []PackParams{{
+		Properties: map[string]PackValue{"p": {2, 2000}},
+		SubDevices: []PackSubDevice{{
+			Identity: infra.MetaPair{ProductKey: "pk", DeviceName: "dn"},
+			Events:   map[string]PackValue{"e": {2, 2000}},
+		}},
+	}}, chunks)
+}
@@ -0,0 +1,315 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/thinkgos/aliyun-iot/uri"
+)
+
+// 属性服务
+const (
+	propertySet = "set"
+	propertyGet = "get"
+	// 属性服务的method
+	methodServicePropertySet = "thing.service.property.set"
+	methodServicePropertyGet = "thing.service.property.get"
+)
+
+// PropertyGetter 属性读取函数,返回属性的当前值
+type PropertyGetter func() (interface{}, error)
+
+// PropertySetter 属性设置函数, value为云端下发的属性值
+type PropertySetter func(value json.RawMessage) error
+
+// PropertyFailure 属性设置或读取失败项
+type PropertyFailure struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type propertyEntry struct {
+	get PropertyGetter
+	set PropertySetter
+}
+
+// PropertyStore 设备属性存储,按设备注册属性的读取及设置函数,协程安全.
+// 配置后, 属性设置(property/set)及属性获取(property/get)由存储应答,
+// 未注册任何属性的设备仍交由 Callback.ThingServicePropertySet 处理
+type PropertyStore struct {
+	rw       sync.RWMutex
+	devices  map[string]map[string]*propertyEntry
+	postBack bool
+}
+
+// NewPropertyStore 新建属性存储
+// postBack: 属性设置成功后,是否将设置成功的属性当前值通过 ThingEventPropertyPost 上报
+func NewPropertyStore(postBack bool) *PropertyStore {
+	return &PropertyStore{
+		devices:  make(map[string]map[string]*propertyEntry),
+		postBack: postBack,
+	}
+}
+
+// Register 注册设备属性的读取及设置函数, get为nil表示不可读, set为nil表示只读
+func (sf *PropertyStore) Register(pk, dn, identifier string, get PropertyGetter, set PropertySetter) {
+	key := FormatKey(pk, dn)
+	sf.rw.Lock()
+	defer sf.rw.Unlock()
+	props, ok := sf.devices[key]
+	if !ok {
+		props = make(map[string]*propertyEntry)
+		sf.devices[key] = props
+	}
+	props[identifier] = &propertyEntry{get, set}
+}
+
+// Unregister 删除设备属性, 未指定identifier时删除设备的所有属性
+func (sf *PropertyStore) Unregister(pk, dn string, identifier ...string) {
+	key := FormatKey(pk, dn)
+	sf.rw.Lock()
+	defer sf.rw.Unlock()
+	if len(identifier) == 0 {
+		delete(sf.devices, key)
+		return
+	}
+	props := sf.devices[key]
+	for _, id := range identifier {
+		delete(props, id)
+	}
+	if len(props) == 0 {
+		delete(sf.devices, key)
+	}
+}
+
+// HasDevice 设备是否注册了属性
+func (sf *PropertyStore) HasDevice(pk, dn string) bool {
+	sf.rw.RLock()
+	defer sf.rw.RUnlock()
+	_, ok := sf.devices[FormatKey(pk, dn)]
+	return ok
+}
+
+func (sf *PropertyStore) lookup(pk, dn, identifier string) (propertyEntry, bool) {
+	sf.rw.RLock()
+	defer sf.rw.RUnlock()
+	e, ok := sf.devices[FormatKey(pk, dn)][identifier]
+	if !ok {
+		return propertyEntry{}, false
+	}
+	return *e, true
+}
+
+// identifiers 设备所有可读的属性
+func (sf *PropertyStore) identifiers(pk, dn string) []string {
+	sf.rw.RLock()
+	defer sf.rw.RUnlock()
+	props := sf.devices[FormatKey(pk, dn)]
+	ids := make([]string, 0, len(props))
+	for id, e := range props {
+		if e.get != nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// settable 设备所有可设置的属性
+func (sf *PropertyStore) settable(pk, dn string) []string {
+	sf.rw.RLock()
+	defer sf.rw.RUnlock()
+	props := sf.devices[FormatKey(pk, dn)]
+	ids := make([]string, 0, len(props))
+	for id, e := range props {
+		if e.set != nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Get 读取设备属性的当前值, 未指定identifier时读取所有可读属性
+func (sf *PropertyStore) Get(pk, dn string, identifier ...string) (map[string]interface{}, map[string]error) {
+	if len(identifier) == 0 {
+		identifier = sf.identifiers(pk, dn)
+	}
+	values := make(map[string]interface{}, len(identifier))
+	failures := make(map[string]error)
+	for _, id := range identifier {
+		e, ok := sf.lookup(pk, dn, id)
+		if !ok {
+			failures[id] = ErrPropertyNotFound
+			continue
+		}
+		if e.get == nil {
+			failures[id] = ErrPropertyNoGetter
+			continue
+		}
+		v, err := e.get()
+		if err != nil {
+			failures[id] = err
+			continue
+		}
+		values[id] = v
+	}
+	return values, failures
+}
+
+// Set 设置设备属性,返回设置成功的属性及失败项
+func (sf *PropertyStore) Set(pk, dn string, params map[string]json.RawMessage) ([]string, map[string]error) {
+	ids := make([]string, 0, len(params))
+	for id := range params {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	applied := make([]string, 0, len(ids))
+	failures := make(map[string]error)
+	for _, id := range ids {
+		e, ok := sf.lookup(pk, dn, id)
+		if !ok {
+			failures[id] = ErrPropertyNotFound
+			continue
+		}
+		if e.set == nil {
+			failures[id] = ErrPropertyReadOnly
+			continue
+		}
+		if err := e.set(params[id]); err != nil {
+			failures[id] = err
+			continue
+		}
+		applied = append(applied, id)
+	}
+	return applied, failures
+}
+
+// propertyResponse 生成属性服务应答, 存在失败项时, 使用首个失败项的错误码,
+// data中包含成功的数据及失败项 {"identifier": {"code": 460, "message": "..."}}
+func propertyResponse(id uint, data map[string]interface{}, failures map[string]error) Response {
+	if len(failures) == 0 {
+		return NewServiceResponse(id, data, nil)
+	}
+	ids := make([]string, 0, len(failures))
+	for k := range failures {
+		ids = append(ids, k)
+	}
+	sort.Strings(ids)
+
+	msgs := make([]string, 0, len(ids))
+	var first Response
+	for i, k := range ids {
+		rsp := NewServiceResponse(id, nil, failures[k])
+		if i == 0 {
+			first = rsp
+		}
+		data[k] = PropertyFailure{rsp.Code, rsp.Message}
+		msgs = append(msgs, k+": "+rsp.Message)
+	}
+	first.Data = data
+	first.Message = strings.Join(msgs, "; ")
+	return first
+}
+
+// servePropertySet 处理属性设置,并回复
+func (sf *Client) servePropertySet(pk, dn string, payload []byte) (Response, error) {
+	req, err := decodeServiceRequest(pk, dn, "", payload)
+	if err != nil {
+		return Response{}, err
+	}
+	params := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(req.Params, &params); err != nil {
+		return NewServiceResponse(req.ID, nil, ErrInvalidParameter), nil
+	}
+	applied, failures := sf.propStore.Set(pk, dn, params)
+	if sf.propStore.postBack && len(applied) > 0 {
+		go sf.postBackProperties(pk, dn, applied, params)
+	}
+	return propertyResponse(req.ID, make(map[string]interface{}), failures), nil
+}
+
+// servePropertyGet 处理属性获取, params为属性标识符列表
+func (sf *Client) servePropertyGet(pk, dn string, payload []byte) (Response, error) {
+	req, err := decodeServiceRequest(pk, dn, "", payload)
+	if err != nil {
+		return Response{}, err
+	}
+	var ids []string
+	if len(req.Params) > 0 && string(req.Params) != "null" {
+		if err = json.Unmarshal(req.Params, &ids); err != nil {
+			return NewServiceResponse(req.ID, nil, ErrInvalidParameter), nil
+		}
+	}
+	values, failures := sf.propStore.Get(pk, dn, ids...)
+	return propertyResponse(req.ID, values, failures), nil
+}
+
+// postBackProperties 上报设置成功的属性的当前值,不可读的属性上报设置值
+func (sf *Client) postBackProperties(pk, dn string, applied []string, params map[string]json.RawMessage) {
+	values, _ := sf.propStore.Get(pk, dn, applied...)
+	for _, id := range applied {
+		if _, ok := values[id]; !ok {
+			values[id] = params[id]
+		}
+	}
+	if _, err := sf.ThingEventPropertyPost(pk, dn, values); err != nil {
+		sf.Log.Warnf("property post back failed, %+v", err)
+	}
+}
+
+// serveThingProperty 异步属性服务处理, 未配置属性存储或设备未注册属性时返回 handled = false
+// response: /sys/{productKey}/{deviceName}/thing/service/property/[set,get]_reply
+func (sf *Client) serveThingProperty(method, pk, dn string, payload []byte) (bool, error) {
+	if sf.propStore == nil || !sf.propStore.HasDevice(pk, dn) {
+		return false, nil
+	}
+	var rsp Response
+	var err error
+	switch method {
+	case propertySet:
+		rsp, err = sf.servePropertySet(pk, dn, payload)
+	case propertyGet:
+		rsp, err = sf.servePropertyGet(pk, dn, payload)
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	_uri := uri.URI(uri.SysPrefix, uri.ThingServiceResponse, pk, dn, property+uri.Sep+method)
+	return true, sf.Response(_uri, rsp)
+}
+
+// serveRRPCProperty 同步属性服务处理, 未配置属性存储或设备未注册属性时返回 handled = false
+// response: /sys/{productKey}/{deviceName}/rrpc/response/{messageId}
+func (sf *Client) serveRRPCProperty(messageID, pk, dn string, payload []byte) (bool, error) {
+	if sf.propStore == nil || !sf.propStore.HasDevice(pk, dn) {
+		return false, nil
+	}
+	req := &Request{}
+	if err := json.Unmarshal(payload, req); err != nil {
+		return false, nil
+	}
+	var rsp Response
+	var err error
+	switch req.Method {
+	case methodServicePropertySet:
+		rsp, err = sf.servePropertySet(pk, dn, payload)
+	case methodServicePropertyGet:
+		rsp, err = sf.servePropertyGet(pk, dn, payload)
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	return true, sf.RRPCResponse(pk, dn, messageID, rsp)
+}
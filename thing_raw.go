@@ -19,7 +19,7 @@ func (sf *Client) ThingModelUpRaw(pk, dn string, payload interface{}) error {
 	}
 	sf.Log.Debugf("thing.model.up.raw")
 	_uri := uri.URI(uri.SysPrefix, uri.ThingModelUpRaw, pk, dn)
-	return sf.Publish(_uri, 1, payload)
+	return sf.publishPayload(_uri, 1, payload)
 }
 
 // ProcThingModelUpRawReply 处理透传上行的应答
@@ -0,0 +1,345 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultReportMergeInterval 默认属性变化合并上报周期
+	DefaultReportMergeInterval = time.Second
+	// DefaultReportTimeout 默认一次上报等待平台应答的超时时间
+	DefaultReportTimeout = 10 * time.Second
+)
+
+// Deadband 属性上报死区,仅对数值属性有效,
+// 与上次上报值的差值达到Abs,或达到上次上报值的Percent(%)时才上报, 均为0表示任何变化都上报.
+// 非数值属性任何变化都上报
+type Deadband struct {
+	Abs     float64
+	Percent float64
+}
+
+// exceeded 值的变化是否超出死区
+func (sf Deadband) exceeded(last, v interface{}) bool {
+	lf, ok1 := toFloat(last)
+	vf, ok2 := toFloat(v)
+	if !ok1 || !ok2 {
+		return !reflect.DeepEqual(last, v)
+	}
+	diff := math.Abs(vf - lf)
+	if sf.Abs <= 0 && sf.Percent <= 0 {
+		return diff != 0
+	}
+	if sf.Abs > 0 && diff >= sf.Abs {
+		return true
+	}
+	if sf.Percent > 0 {
+		if lf == 0 {
+			return diff != 0
+		}
+		return diff/math.Abs(lf)*100 >= sf.Percent
+	}
+	return false
+}
+
+// ReporterOption 属性上报选项
+type ReporterOption func(*Reporter)
+
+// WithReportDeadband 设置属性的上报死区
+func WithReportDeadband(identifier string, db Deadband) ReporterOption {
+	return func(r *Reporter) {
+		r.deadbands[identifier] = db
+	}
+}
+
+// WithReportDefaultDeadband 设置未单独设置死区的属性的默认上报死区
+func WithReportDefaultDeadband(db Deadband) ReporterOption {
+	return func(r *Reporter) {
+		r.defaultDeadband = db
+	}
+}
+
+// WithReportMergeInterval 设置属性变化合并上报周期,周期内的变化合并为一次上报,
+// 默认 DefaultReportMergeInterval, <= 0 表示有变化立即上报, Update 将等待上报完成
+func WithReportMergeInterval(d time.Duration) ReporterOption {
+	return func(r *Reporter) {
+		r.mergeInterval = d
+	}
+}
+
+// WithReportTimeout 设置一次上报等待平台应答的超时时间,默认 DefaultReportTimeout
+func WithReportTimeout(t time.Duration) ReporterOption {
+	return func(r *Reporter) {
+		if t > 0 {
+			r.timeout = t
+		}
+	}
+}
+
+// WithReportFullInterval 设置全量上报周期, <= 0 表示不周期全量上报(默认)
+func WithReportFullInterval(d time.Duration) ReporterOption {
+	return func(r *Reporter) {
+		r.fullInterval = d
+	}
+}
+
+type reportDevice struct {
+	pk, dn    string
+	last      map[string]interface{} // 上次上报的值
+	current   map[string]interface{} // 当前值
+	pending   map[string]interface{} // 待上报的变化
+	lastFull  time.Time
+	forceFull bool
+
+	flushMu sync.Mutex // 串行上报, 避免定时,上线及更新时并发上报相同的值
+}
+
+// Reporter 属性变化上报,基于 LinkThingEventPropertyPost, 协程安全.
+// 记录每个设备每个属性上次上报成功的值,仅上报超出死区的变化,周期内的变化合并为一次上报,
+// 上报失败的变化保留至下次上报, 按全量上报周期及设备上线(含重连)后全量上报当前值.
+// 需通过 WithReporter 设置到客户端后才开始上报
+type Reporter struct {
+	c               *Client
+	timeout         time.Duration
+	mergeInterval   time.Duration
+	fullInterval    time.Duration
+	defaultDeadband Deadband
+	deadbands       map[string]Deadband
+
+	mu      sync.Mutex
+	devices map[string]*reportDevice
+
+	once sync.Once
+	done chan struct{}
+}
+
+// NewReporter 新建属性变化上报
+func NewReporter(opts ...ReporterOption) *Reporter {
+	sf := &Reporter{
+		timeout:       DefaultReportTimeout,
+		mergeInterval: DefaultReportMergeInterval,
+		deadbands:     make(map[string]Deadband),
+		devices:       make(map[string]*reportDevice),
+		done:          make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(sf)
+	}
+	return sf
+}
+
+// Update 更新设备的属性值, params为属性标识符及值的对象,如 map[string]interface{} 或 带json tag的结构体,
+// 超出死区的变化将在合并上报周期内上报
+func (sf *Reporter) Update(pk, dn string, params interface{}) error {
+	values, err := normalizeParams(params)
+	if err != nil {
+		return err
+	}
+
+	sf.mu.Lock()
+	d := sf.deviceLocked(pk, dn)
+	for id, v := range values {
+		d.current[id] = v
+		last, ok := d.last[id]
+		if !ok || sf.deadband(id).exceeded(last, v) {
+			d.pending[id] = v
+		} else {
+			delete(d.pending, id)
+		}
+	}
+	sf.mu.Unlock()
+
+	if sf.mergeInterval <= 0 {
+		return sf.flush(pk, dn)
+	}
+	return nil
+}
+
+// ReportFull 立即全量上报设备的当前值
+func (sf *Reporter) ReportFull(pk, dn string) error {
+	sf.mu.Lock()
+	sf.deviceLocked(pk, dn).forceFull = true
+	sf.mu.Unlock()
+	return sf.flush(pk, dn)
+}
+
+// Flush 立即上报所有设备待上报的变化
+func (sf *Reporter) Flush() {
+	sf.mu.Lock()
+	devices := make([]*reportDevice, 0, len(sf.devices))
+	for _, d := range sf.devices {
+		devices = append(devices, d)
+	}
+	sf.mu.Unlock()
+
+	for _, d := range devices {
+		if err := sf.flush(d.pk, d.dn); err != nil {
+			sf.c.Log.Warnf("report %s property, %+v", FormatKey(d.pk, d.dn), err)
+		}
+	}
+}
+
+// Remove 删除设备的上报记录
+func (sf *Reporter) Remove(pk, dn string) {
+	sf.mu.Lock()
+	delete(sf.devices, FormatKey(pk, dn))
+	sf.mu.Unlock()
+}
+
+// Close 停止周期上报
+func (sf *Reporter) Close() error {
+	sf.once.Do(func() { close(sf.done) })
+	return nil
+}
+
+// start 客户端创建完成后开始周期上报
+func (sf *Reporter) start() {
+	tick := sf.mergeInterval
+	if tick <= 0 || (sf.fullInterval > 0 && sf.fullInterval < tick) {
+		tick = sf.fullInterval
+	}
+	if tick > 0 {
+		go sf.run(tick)
+	}
+}
+
+func (sf *Reporter) run(tick time.Duration) {
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	for {
+		select {
+		case <-sf.done:
+			return
+		case <-t.C:
+			sf.Flush()
+		}
+	}
+}
+
+// onConnect 设备上线后全量上报
+func (sf *Reporter) onConnect(_ *Client, pk, dn string, _ bool) {
+	select {
+	case <-sf.done:
+		return
+	default:
+	}
+	sf.mu.Lock()
+	d, ok := sf.devices[FormatKey(pk, dn)]
+	if ok {
+		d.forceFull = true
+	}
+	sf.mu.Unlock()
+	if ok {
+		if err := sf.flush(pk, dn); err != nil {
+			sf.c.Log.Warnf("report %s property after connect, %+v", FormatKey(pk, dn), err)
+		}
+	}
+}
+
+func (sf *Reporter) deadband(identifier string) Deadband {
+	if db, ok := sf.deadbands[identifier]; ok {
+		return db
+	}
+	return sf.defaultDeadband
+}
+
+func (sf *Reporter) deviceLocked(pk, dn string) *reportDevice {
+	key := FormatKey(pk, dn)
+	d, ok := sf.devices[key]
+	if !ok {
+		d = &reportDevice{
+			pk:       pk,
+			dn:       dn,
+			last:     make(map[string]interface{}),
+			current:  make(map[string]interface{}),
+			pending:  make(map[string]interface{}),
+			lastFull: time.Now(),
+		}
+		sf.devices[key] = d
+	}
+	return d
+}
+
+// flush 上报设备待上报的变化,需全量上报时上报所有当前值,
+// 平台应答成功后才更新上次上报的值,失败时变化保留待下次上报.
+// 同一设备的上报串行执行, 后者等待前者完成后仅上报其间新的变化
+func (sf *Reporter) flush(pk, dn string) error {
+	if sf.c == nil {
+		return nil
+	}
+	sf.mu.Lock()
+	d, ok := sf.devices[FormatKey(pk, dn)]
+	sf.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	d.flushMu.Lock()
+	defer d.flushMu.Unlock()
+
+	sf.mu.Lock()
+	full := d.forceFull || (sf.fullInterval > 0 && time.Since(d.lastFull) >= sf.fullInterval)
+	src := d.pending
+	if full {
+		src = d.current
+	}
+	values := make(map[string]interface{}, len(src))
+	for k, v := range src {
+		values[k] = v
+	}
+	sf.mu.Unlock()
+
+	if len(values) == 0 {
+		return nil
+	}
+	if err := sf.c.LinkThingEventPropertyPost(pk, dn, values, sf.timeout); err != nil {
+		return err
+	}
+
+	sf.mu.Lock()
+	for k, v := range values {
+		d.last[k] = v
+		// 上报期间可能有新的变化
+		if pv, ok := d.pending[k]; ok && reflect.DeepEqual(pv, v) {
+			delete(d.pending, k)
+		}
+	}
+	if full {
+		d.forceFull = false
+		d.lastFull = time.Now()
+	}
+	sf.mu.Unlock()
+	return nil
+}
+
+// normalizeParams 将参数转换为属性标识符及值的对象,数值为json.Number
+func normalizeParams(params interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{})
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err = dec.Decode(&values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
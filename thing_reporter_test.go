@@ -0,0 +1,155 @@
+package aiot
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+)
+
+func TestDeadband_Exceeded(t *testing.T) {
+	tests := []struct {
+		name     string
+		deadband Deadband
+		last     interface{}
+		v        interface{}
+		want     bool
+	}{
+		{"no deadband same", Deadband{}, json.Number("1"), json.Number("1"), false},
+		{"no deadband changed", Deadband{}, json.Number("1"), json.Number("1.01"), true},
+		{"abs below", Deadband{Abs: 0.5}, json.Number("10"), json.Number("10.4"), false},
+		{"abs reached", Deadband{Abs: 0.5}, json.Number("10"), json.Number("10.5"), true},
+		{"abs negative change", Deadband{Abs: 0.5}, json.Number("10"), json.Number("9.4"), true},
+		{"percent below", Deadband{Percent: 10}, json.Number("100"), json.Number("109"), false},
+		{"percent reached", Deadband{Percent: 10}, json.Number("-100"), json.Number("-110"), true},
+		{"percent last zero", Deadband{Percent: 10}, json.Number("0"), json.Number("0.001"), true},
+		{"percent last zero same", Deadband{Percent: 10}, json.Number("0"), json.Number("0"), false},
+		{"abs or percent", Deadband{Abs: 5, Percent: 1}, json.Number("100"), json.Number("101"), true},
+		{"text same", Deadband{Abs: 5}, "on", "on", false},
+		{"text changed", Deadband{Abs: 5}, "on", "off", true},
+		{"type changed", Deadband{Abs: 5}, json.Number("1"), "1", true},
+		{"object changed", Deadband{Abs: 5},
+			map[string]interface{}{"a": json.Number("1")}, map[string]interface{}{"a": json.Number("2")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.deadband.exceeded(tt.last, tt.v))
+		})
+	}
+}
+
+// reportRecorder 记录属性上报请求, 按fail决定应答成功或失败
+type reportRecorder struct {
+	mu    sync.Mutex
+	fail  bool
+	posts []map[string]interface{}
+}
+
+func (sf *reportRecorder) reply(_ string, req fakeRequest) (Response, bool) {
+	params := make(map[string]interface{})
+	_ = json.Unmarshal(req.Params, &params)
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.posts = append(sf.posts, params)
+	if sf.fail {
+		return Response{ID: req.ID, Code: infra.CodeSystemUnknownException, Message: "failed"}, true
+	}
+	return Response{ID: req.ID, Code: infra.CodeSuccess, Data: struct{}{}}, true
+}
+
+func (sf *reportRecorder) setFail(fail bool) {
+	sf.mu.Lock()
+	sf.fail = fail
+	sf.mu.Unlock()
+}
+
+// take 取出已记录的上报
+func (sf *reportRecorder) take() []map[string]interface{} {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	posts := sf.posts
+	sf.posts = nil
+	return posts
+}
+
+func TestReporter_Update(t *testing.T) {
+	rec := &reportRecorder{}
+	r := NewReporter(
+		WithReportMergeInterval(0),
+		WithReportDeadband("temp", Deadband{Abs: 1}),
+	)
+	c, _ := newFakeClient(rec.reply, WithReporter(r))
+	defer r.Close()
+	require.Equal(t, r, c.reporter)
+
+	require.NoError(t, r.Update("pk", "dn", map[string]interface{}{"temp": 20, "mode": "auto"}))
+	assert.Equal(t, []map[string]interface{}{{"temp": 20.0, "mode": "auto"}}, rec.take())
+
+	// 死区内的变化不上报
+	require.NoError(t, r.Update("pk", "dn", map[string]interface{}{"temp": 20.5, "mode": "auto"}))
+	assert.Empty(t, rec.take())
+
+	// 与上次上报值比较, 累积超出死区后上报
+	require.NoError(t, r.Update("pk", "dn", map[string]interface{}{"temp": 21}))
+	assert.Equal(t, []map[string]interface{}{{"temp": 21.0}}, rec.take())
+
+	// 上报失败时不更新上次上报的值, 变化保留至下次上报
+	rec.setFail(true)
+	assert.Error(t, r.Update("pk", "dn", map[string]interface{}{"temp": 23}))
+	assert.Equal(t, []map[string]interface{}{{"temp": 23.0}}, rec.take())
+	rec.setFail(false)
+	require.NoError(t, r.Update("pk", "dn", map[string]interface{}{"mode": "manual"}))
+	assert.Equal(t, []map[string]interface{}{{"temp": 23.0, "mode": "manual"}}, rec.take())
+
+	// 回到死区内的值时, 取消待上报的变化
+	rec.setFail(true)
+	assert.Error(t, r.Update("pk", "dn", map[string]interface{}{"temp": 25}))
+	rec.setFail(false)
+	require.NoError(t, r.Update("pk", "dn", map[string]interface{}{"temp": 23.5}))
+	assert.Len(t, rec.take(), 1, "only the failed post")
+
+	// 全量上报当前值
+	require.NoError(t, r.ReportFull("pk", "dn"))
+	assert.Equal(t, []map[string]interface{}{{"temp": 23.5, "mode": "manual"}}, rec.take())
+}
+
+func TestReporter_FlushSerialized(t *testing.T) {
+	rec := &reportRecorder{}
+	release := make(chan struct{})
+	var once sync.Once
+	reply := func(topic string, req fakeRequest) (Response, bool) {
+		rsp, ok := rec.reply(topic, req)
+		// 首次上报等待, 期间其它上报应等待其完成
+		once.Do(func() { <-release })
+		return rsp, ok
+	}
+	r := NewReporter(WithReportMergeInterval(0))
+	c, _ := newFakeClient(reply, WithReporter(r))
+	defer r.Close()
+
+	errs := make(chan error, 3)
+	go func() { errs <- r.Update("pk", "dn", map[string]interface{}{"temp": 20}) }()
+	require.Eventually(t, func() bool {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		return len(rec.posts) == 1
+	}, time.Second, time.Millisecond)
+
+	// 定时上报, 设备上线及更新与进行中的上报并发
+	go func() { r.Flush(); errs <- nil }()
+	go func() { r.onConnect(c, "pk", "dn", true); errs <- nil }()
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, rec.take(), 1, "concurrent flush should wait")
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, <-errs)
+	}
+	// 定时上报不再重复上报已上报的值, 仅有上线后的全量上报
+	assert.Equal(t, []map[string]interface{}{{"temp": 20.0}}, rec.take())
+}
@@ -4,12 +4,27 @@
 
 package aiot
 
-import "github.com/thinkgos/aliyun-iot/uri"
+import (
+	"github.com/thinkgos/aliyun-iot/infra"
+	"github.com/thinkgos/aliyun-iot/uri"
+)
+
+// ThingServiceResponse 设备服务调用(异步)回复, 成功的回复将进行物模型校验
+// response: /sys/{productKey}/{deviceName}/thing/service/{tsl.service.identifier}_reply
+func (sf *Client) ThingServiceResponse(pk, dn, serviceID string, rsp Response) error {
+	if rsp.Code == infra.CodeSuccess {
+		if err := sf.validateServiceOutput(pk, serviceID, rsp.Data); err != nil {
+			return err
+		}
+	}
+	_uri := uri.URI(uri.SysPrefix, uri.ThingServiceResponse, pk, dn, serviceID)
+	return sf.Response(_uri, rsp)
+}
 
 // ProcThingServiceRequest 处理设备服务调用(异步)
 // 下行
-// request:   /sys/{productKey}/{deviceName}/thing/service/[{tsl.service.identifier},property/set]
-// response:  /sys/{productKey}/{deviceName}/thing/service/[{tsl.service.identifier}_reply,property/set_reply
+// request:   /sys/{productKey}/{deviceName}/thing/service/[{tsl.service.identifier},property/set,property/get]
+// response:  /sys/{productKey}/{deviceName}/thing/service/[{tsl.service.identifier}_reply,property/set_reply,property/get_reply]
 // subscribe: /sys/{productKey}/{deviceName}/thing/service/[+,#]
 func ProcThingServiceRequest(c *Client, rawURI string, payload []byte) error {
 	uris := uri.Spilt(rawURI)
@@ -19,10 +34,19 @@ func ProcThingServiceRequest(c *Client, rawURI string, payload []byte) error {
 
 	pk, dn := uris[1], uris[2]
 	serviceID := uris[5]
-	if serviceID == property && len(uris) >= 7 && uris[6] == "set" {
-		c.Log.Debugf("thing.service.property.set")
-		return c.cb.ThingServicePropertySet(c, pk, dn, payload)
+	if serviceID == property && len(uris) >= 7 {
+		c.Log.Debugf("thing.service.property.%s", uris[6])
+		if handled, err := c.serveThingProperty(uris[6], pk, dn, payload); handled {
+			return err
+		}
+		if uris[6] == propertySet {
+			return c.cb.ThingServicePropertySet(c, pk, dn, payload)
+		}
+		return c.cb.ThingServiceRequest(c, serviceID, pk, dn, payload)
 	}
 	c.Log.Debugf("thing.service.%s", serviceID)
+	if c.router != nil {
+		return c.serveThingService(serviceID, pk, dn, payload)
+	}
 	return c.cb.ThingServiceRequest(c, serviceID, pk, dn, payload)
 }
@@ -0,0 +1,209 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/thinkgos/aliyun-iot/infra"
+	"github.com/thinkgos/aliyun-iot/uri"
+)
+
+// serviceMethodPrefix 服务调用的method前缀, thing.service.{tsl.service.identifier}
+const serviceMethodPrefix = "thing.service."
+
+// ServiceRequest 服务调用请求
+type ServiceRequest struct {
+	ProductKey string
+	DeviceName string
+	ServiceID  string
+	ID         uint
+	Version    string
+	Method     string
+	Params     json.RawMessage
+}
+
+// Bind 将请求参数解码到v, 失败时返回的错误将以 infra.CodeRequestParamsError 回复
+func (sf *ServiceRequest) Bind(v interface{}) error {
+	if err := json.Unmarshal(sf.Params, v); err != nil {
+		return fmt.Errorf("%w, %v", ErrInvalidParameter, err)
+	}
+	return nil
+}
+
+// ServiceHandler 服务处理函数, 返回应答数据及错误, 由路由自动回复.
+// 错误为 *infra.CodeError 时回复其错误码, 为 ErrInvalidParameter 时回复 infra.CodeRequestParamsError,
+// 其它错误回复 infra.CodeSystemUnknownException
+type ServiceHandler func(c *Client, req *ServiceRequest) (interface{}, error)
+
+// ServiceRouter 服务路由,按产品及服务标识符注册处理函数,网关可按子设备注册,
+// 设备注册的处理函数优先于产品注册的处理函数. 协程安全.
+// 异步服务(thing/service/{tsl.service.identifier})未找到处理函数时,使用NotFound处理函数回复,
+// 同步服务(rrpc)未找到处理函数时, 交由 Callback.RRPCRequest 处理
+type ServiceRouter struct {
+	rw       sync.RWMutex
+	products map[string]ServiceHandler
+	devices  map[string]ServiceHandler
+	notFound ServiceHandler
+}
+
+// NewServiceRouter 新建服务路由
+func NewServiceRouter() *ServiceRouter {
+	return &ServiceRouter{
+		products: make(map[string]ServiceHandler),
+		devices:  make(map[string]ServiceHandler),
+		notFound: serviceNotFound,
+	}
+}
+
+// Handle 注册产品的服务处理函数
+func (sf *ServiceRouter) Handle(pk, srvID string, h ServiceHandler) {
+	sf.rw.Lock()
+	sf.products[pk+uri.Sep+srvID] = h
+	sf.rw.Unlock()
+}
+
+// HandleDevice 注册设备的服务处理函数
+func (sf *ServiceRouter) HandleDevice(pk, dn, srvID string, h ServiceHandler) {
+	sf.rw.Lock()
+	sf.devices[FormatKey(pk, dn)+uri.Sep+srvID] = h
+	sf.rw.Unlock()
+}
+
+// RemoveDevice 删除设备的所有服务处理函数
+func (sf *ServiceRouter) RemoveDevice(pk, dn string) {
+	prefix := FormatKey(pk, dn) + uri.Sep
+	sf.rw.Lock()
+	for k := range sf.devices {
+		if strings.HasPrefix(k, prefix) {
+			delete(sf.devices, k)
+		}
+	}
+	sf.rw.Unlock()
+}
+
+// NotFound 设置未找到服务时的处理函数,默认回复 infra.CodeServiceNotFound
+func (sf *ServiceRouter) NotFound(h ServiceHandler) {
+	sf.rw.Lock()
+	sf.notFound = h
+	sf.rw.Unlock()
+}
+
+// Lookup 查找服务处理函数
+func (sf *ServiceRouter) Lookup(pk, dn, srvID string) (ServiceHandler, bool) {
+	sf.rw.RLock()
+	defer sf.rw.RUnlock()
+	if h, ok := sf.devices[FormatKey(pk, dn)+uri.Sep+srvID]; ok {
+		return h, true
+	}
+	h, ok := sf.products[pk+uri.Sep+srvID]
+	return h, ok
+}
+
+func (sf *ServiceRouter) notFoundHandler() ServiceHandler {
+	sf.rw.RLock()
+	defer sf.rw.RUnlock()
+	return sf.notFound
+}
+
+// serve 调用处理函数并生成应答, 应答数据校验失败时回复 infra.CodeSystemUnknownException
+func (sf *ServiceRouter) serve(c *Client, h ServiceHandler, req *ServiceRequest) Response {
+	data, err := h(c, req)
+	if err == nil {
+		if err = c.validateServiceOutput(req.ProductKey, req.ServiceID, data); err != nil {
+			c.Log.Warnf("thing.service.%s reply validate failed, %+v", req.ServiceID, err)
+			data, err = nil, infra.NewCodeError(infra.CodeSystemUnknownException, "invalid service output, "+err.Error())
+		}
+	}
+	return NewServiceResponse(req.ID, data, err)
+}
+
+// NewServiceResponse 根据处理结果生成服务应答,
+// 错误为 *infra.CodeError 时使用其错误码, 为 ErrInvalidParameter 时使用 infra.CodeRequestParamsError,
+// 其它错误使用 infra.CodeSystemUnknownException
+func NewServiceResponse(id uint, data interface{}, err error) Response {
+	if err == nil {
+		if data == nil {
+			data = struct{}{}
+		}
+		return Response{ID: id, Code: infra.CodeSuccess, Data: data}
+	}
+	code, message := infra.CodeSystemUnknownException, err.Error()
+	var ce *infra.CodeError
+	if errors.As(err, &ce) {
+		code, message = ce.Code(), ce.Message()
+	} else if errors.Is(err, ErrInvalidParameter) {
+		code = infra.CodeRequestParamsError
+	}
+	return Response{ID: id, Code: code, Data: struct{}{}, Message: message}
+}
+
+func serviceNotFound(_ *Client, req *ServiceRequest) (interface{}, error) {
+	return nil, infra.NewCodeError(infra.CodeServiceNotFound, "service not found: "+req.ServiceID)
+}
+
+// decodeServiceRequest 解码服务调用请求
+func decodeServiceRequest(pk, dn, srvID string, payload []byte) (*ServiceRequest, error) {
+	req := &struct {
+		ID      uint            `json:"id,string"`
+		Version string          `json:"version"`
+		Params  json.RawMessage `json:"params"`
+		Method  string          `json:"method"`
+	}{}
+	if err := json.Unmarshal(payload, req); err != nil {
+		return nil, err
+	}
+	if srvID == "" {
+		srvID = strings.TrimPrefix(req.Method, serviceMethodPrefix)
+	}
+	return &ServiceRequest{pk, dn, srvID, req.ID, req.Version, req.Method, req.Params}, nil
+}
+
+// ServiceRequestID 从无法解码的请求中尽量取出请求ID, 用于回复错误, 取不到时为0
+func ServiceRequestID(payload []byte) uint {
+	req := &struct {
+		ID json.RawMessage `json:"id"`
+	}{}
+	if err := json.Unmarshal(payload, req); err != nil {
+		return 0
+	}
+	id, _ := strconv.ParseUint(strings.Trim(string(req.ID), `"`), 10, 64)
+	return uint(id)
+}
+
+// serveThingService 异步服务调用路由处理, 并回复, 请求解码失败时回复 infra.CodeRequestParamsError
+// response: /sys/{productKey}/{deviceName}/thing/service/{tsl.service.identifier}_reply
+func (sf *Client) serveThingService(srvID, pk, dn string, payload []byte) error {
+	_uri := uri.URI(uri.SysPrefix, uri.ThingServiceResponse, pk, dn, srvID)
+	req, err := decodeServiceRequest(pk, dn, srvID, payload)
+	if err != nil {
+		sf.Log.Warnf("thing.service.%s decode failed, %+v", srvID, err)
+		return sf.Response(_uri, NewServiceResponse(ServiceRequestID(payload), nil, fmt.Errorf("%w, %v", ErrInvalidParameter, err)))
+	}
+	h, ok := sf.router.Lookup(pk, dn, srvID)
+	if !ok {
+		h = sf.router.notFoundHandler()
+	}
+	return sf.Response(_uri, sf.router.serve(sf, h, req))
+}
+
+// serveRRPCService 同步服务调用路由处理, 并回复,未找到处理函数时返回 handled = false
+// response: /sys/{productKey}/{deviceName}/rrpc/response/{messageId}
+func (sf *Client) serveRRPCService(messageID, pk, dn string, payload []byte) (bool, error) {
+	req, err := decodeServiceRequest(pk, dn, "", payload)
+	if err != nil || !strings.HasPrefix(req.Method, serviceMethodPrefix) {
+		return false, nil
+	}
+	h, ok := sf.router.Lookup(pk, dn, req.ServiceID)
+	if !ok {
+		return false, nil
+	}
+	return true, sf.RRPCResponse(pk, dn, messageID, sf.router.serve(sf, h, req))
+}
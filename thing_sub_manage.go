@@ -91,7 +91,9 @@ func ProcThingDelete(c *Client, rawURI string, payload []byte) error {
 		return err
 	}
 
-	c.Delete(pk, dn)
+	if err := c.remove(pk, dn); err != nil {
+		c.Log.Warnf("thing.delete failed, %+v", err)
+	}
 	_uri := uri.ReplyWithRequestURI(rawURI)
 	err := c.Response(_uri, Response{ID: req.ID, Code: infra.CodeSuccess, Data: "{}"})
 	if err != nil {
@@ -5,6 +5,7 @@
 package aiot
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/thinkgos/aliyun-iot/infra"
@@ -33,12 +34,12 @@ type SubRegisterResponse struct {
 // 网关类型的设备,通过上行请求为子设备发起动态注册,返回成功注册的子设备的设备证书
 // request:   /sys/{productKey}/{deviceName}/thing/sub/register
 // response:  /sys/{productKey}/{deviceName}/thing/sub/register_reply
-func (sf *Client) thingSubRegister(pk, dn string) (*Token, error) {
+func (sf *Client) thingSubRegister(ctx context.Context, pk, dn string) (*Token, error) {
 	if !sf.isGateway {
 		return nil, ErrNotSupportFeature
 	}
 	_uri := sf.URIGateway(uri.SysPrefix, uri.ThingSubRegister)
-	return sf.SendRequest(_uri, infra.MethodSubDevRegister, []infra.MetaPair{
+	return sf.SendRequestContext(ctx, _uri, infra.MethodSubDevRegister, []infra.MetaPair{
 		{ProductKey: pk, DeviceName: dn},
 	})
 }
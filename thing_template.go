@@ -5,6 +5,7 @@
 package aiot
 
 import (
+	"context"
 	"encoding/json"
 
 	"github.com/thinkgos/aliyun-iot/infra"
@@ -16,20 +17,30 @@ import (
 // request:   /sys/{productKey}/{deviceName}/thing/dsltemplate/get
 // response:  /sys/{productKey}/{deviceName}/thing/dsltemplate/get_reply
 func (sf *Client) ThingDsltemplateGet(pk, dn string) (*Token, error) {
+	return sf.ThingDsltemplateGetContext(context.Background(), pk, dn)
+}
+
+// ThingDsltemplateGetContext 同 ThingDsltemplateGet, 带ctx
+func (sf *Client) ThingDsltemplateGetContext(ctx context.Context, pk, dn string) (*Token, error) {
 	if !sf.IsActive(pk, dn) {
 		return nil, ErrNotActive
 	}
 	_uri := uri.URI(uri.SysPrefix, uri.ThingDslTemplateGet, pk, dn)
-	return sf.SendRequest(_uri, infra.MethodDslTemplateGet, "{}")
+	return sf.SendRequestContext(ctx, _uri, infra.MethodDslTemplateGet, "{}")
 }
 
 // ThingDynamictslGet 获取动态tsl
 func (sf *Client) ThingDynamictslGet(pk, dn string) (*Token, error) {
+	return sf.ThingDynamictslGetContext(context.Background(), pk, dn)
+}
+
+// ThingDynamictslGetContext 同 ThingDynamictslGet, 带ctx
+func (sf *Client) ThingDynamictslGetContext(ctx context.Context, pk, dn string) (*Token, error) {
 	if !sf.IsActive(pk, dn) {
 		return nil, ErrNotActive
 	}
 	_uri := uri.URI(uri.SysPrefix, uri.ThingDynamicTslGet, pk, dn)
-	return sf.SendRequest(_uri, infra.MethodDynamicTslGet, map[string]interface{}{
+	return sf.SendRequestContext(ctx, _uri, infra.MethodDynamicTslGet, map[string]interface{}{
 		"nodes":      []string{"type", "identifier"},
 		"addDefault": false,
 	})
@@ -0,0 +1,37 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package aiot
+
+// Validator 物模型校验接口,发布前校验属性,事件及服务应答数据,
+// 校验失败时返回详细错误且不发布, tsl.Validator 实现了该接口
+type Validator interface {
+	// ValidateProperties 校验属性上报的参数
+	ValidateProperties(pk string, params interface{}) error
+	// ValidateEvent 校验事件上报的参数
+	ValidateEvent(pk, eventID string, params interface{}) error
+	// ValidateServiceOutput 校验服务应答的输出参数
+	ValidateServiceOutput(pk, serviceID string, data interface{}) error
+}
+
+func (sf *Client) validateProperties(pk string, params interface{}) error {
+	if sf.validator == nil {
+		return nil
+	}
+	return sf.validator.ValidateProperties(pk, params)
+}
+
+func (sf *Client) validateEvent(pk, eventID string, params interface{}) error {
+	if sf.validator == nil {
+		return nil
+	}
+	return sf.validator.ValidateEvent(pk, eventID, params)
+}
+
+func (sf *Client) validateServiceOutput(pk, serviceID string, data interface{}) error {
+	if sf.validator == nil {
+		return nil
+	}
+	return sf.validator.ValidateServiceOutput(pk, serviceID, data)
+}
@@ -0,0 +1,184 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package tsl
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// 数据类型
+const (
+	TypeInt    = "int"
+	TypeFloat  = "float"
+	TypeDouble = "double"
+	TypeEnum   = "enum"
+	TypeBool   = "bool"
+	TypeText   = "text"
+	TypeDate   = "date"
+	TypeStruct = "struct"
+	TypeArray  = "array"
+)
+
+// DataType 数据类型及规格,根据Type不同,仅对应的规格有效
+//
+//	int,float,double: Number
+//	enum,bool:        Enum
+//	text:             Text
+//	struct:           Struct
+//	array:            Array
+//	date:             无规格, UTC时间戳字符串,单位ms
+type DataType struct {
+	Type   string
+	Number *NumberSpecs
+	Enum   map[string]string // 枚举值 -> 描述
+	Text   *TextSpecs
+	Struct []Param
+	Array  *ArraySpecs
+}
+
+// NumberSpecs 数值规格
+type NumberSpecs struct {
+	Min      *float64
+	Max      *float64
+	Step     *float64
+	Unit     string
+	UnitName string
+}
+
+// TextSpecs 文本规格
+type TextSpecs struct {
+	Length int // 最大长度,0表示不限制
+}
+
+// ArraySpecs 数组规格
+type ArraySpecs struct {
+	Size int // 最大元素个数,0表示不限制
+	Item DataType
+}
+
+type numberSpecs struct {
+	Min      json.RawMessage `json:"min,omitempty"`
+	Max      json.RawMessage `json:"max,omitempty"`
+	Step     json.RawMessage `json:"step,omitempty"`
+	Unit     string          `json:"unit,omitempty"`
+	UnitName string          `json:"unitName,omitempty"`
+}
+
+type textSpecs struct {
+	Length json.RawMessage `json:"length,omitempty"`
+}
+
+type arraySpecs struct {
+	Size json.RawMessage `json:"size,omitempty"`
+	Item DataType        `json:"item"`
+}
+
+type dataType struct {
+	Type  string          `json:"type"`
+	Specs json.RawMessage `json:"specs,omitempty"`
+}
+
+// UnmarshalJSON 实现json.Unmarshaler接口,根据type解析specs
+func (sf *DataType) UnmarshalJSON(b []byte) error {
+	dt := dataType{}
+	if err := json.Unmarshal(b, &dt); err != nil {
+		return err
+	}
+	*sf = DataType{Type: dt.Type}
+	hasSpecs := len(dt.Specs) > 0 && string(dt.Specs) != "null"
+
+	switch dt.Type {
+	case TypeInt, TypeFloat, TypeDouble:
+		specs := numberSpecs{}
+		if hasSpecs {
+			if err := json.Unmarshal(dt.Specs, &specs); err != nil {
+				return fmt.Errorf("tsl: %s specs, %w", dt.Type, err)
+			}
+		}
+		sf.Number = &NumberSpecs{Unit: specs.Unit, UnitName: specs.UnitName}
+		if v, ok := parseFloat(specs.Min); ok {
+			sf.Number.Min = &v
+		}
+		if v, ok := parseFloat(specs.Max); ok {
+			sf.Number.Max = &v
+		}
+		if v, ok := parseFloat(specs.Step); ok {
+			sf.Number.Step = &v
+		}
+	case TypeEnum, TypeBool:
+		sf.Enum = make(map[string]string)
+		if hasSpecs {
+			if err := json.Unmarshal(dt.Specs, &sf.Enum); err != nil {
+				return fmt.Errorf("tsl: %s specs, %w", dt.Type, err)
+			}
+		}
+	case TypeText:
+		specs := textSpecs{}
+		if hasSpecs {
+			if err := json.Unmarshal(dt.Specs, &specs); err != nil {
+				return fmt.Errorf("tsl: %s specs, %w", dt.Type, err)
+			}
+		}
+		sf.Text = &TextSpecs{}
+		if v, ok := parseFloat(specs.Length); ok {
+			sf.Text.Length = int(v)
+		}
+	case TypeStruct:
+		if hasSpecs {
+			if err := json.Unmarshal(dt.Specs, &sf.Struct); err != nil {
+				return fmt.Errorf("tsl: %s specs, %w", dt.Type, err)
+			}
+		}
+	case TypeArray:
+		specs := arraySpecs{}
+		if hasSpecs {
+			if err := json.Unmarshal(dt.Specs, &specs); err != nil {
+				return fmt.Errorf("tsl: %s specs, %w", dt.Type, err)
+			}
+		}
+		sf.Array = &ArraySpecs{Item: specs.Item}
+		if v, ok := parseFloat(specs.Size); ok {
+			sf.Array.Size = int(v)
+		}
+	}
+	return nil
+}
+
+// MarshalJSON 实现json.Marshaler接口,输出平台格式
+func (sf DataType) MarshalJSON() ([]byte, error) {
+	var specs interface{}
+
+	switch {
+	case sf.Number != nil:
+		s := numberSpecs{Unit: sf.Number.Unit, UnitName: sf.Number.UnitName}
+		s.Min = formatFloat(sf.Number.Min)
+		s.Max = formatFloat(sf.Number.Max)
+		s.Step = formatFloat(sf.Number.Step)
+		specs = s
+	case sf.Enum != nil:
+		specs = sf.Enum
+	case sf.Text != nil:
+		specs = textSpecs{Length: json.RawMessage(strconv.Quote(strconv.Itoa(sf.Text.Length)))}
+	case sf.Struct != nil:
+		specs = sf.Struct
+	case sf.Array != nil:
+		specs = arraySpecs{json.RawMessage(strconv.Quote(strconv.Itoa(sf.Array.Size))), sf.Array.Item}
+	default:
+		specs = struct{}{}
+	}
+	return json.Marshal(struct {
+		Type  string      `json:"type"`
+		Specs interface{} `json:"specs"`
+	}{sf.Type, specs})
+}
+
+func formatFloat(v *float64) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	return json.RawMessage(strconv.Quote(strconv.FormatFloat(*v, 'f', -1, 64)))
+}
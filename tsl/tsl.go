@@ -0,0 +1,212 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+// Package tsl 物模型(Thing Specification Language)定义及解析
+// see https://help.aliyun.com/document_detail/73727.html
+package tsl
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+)
+
+// 访问模式
+const (
+	AccessModeRead      = "r"
+	AccessModeReadWrite = "rw"
+)
+
+// 事件类型
+const (
+	EventTypeInfo  = "info"
+	EventTypeAlert = "alert"
+	EventTypeError = "error"
+)
+
+// 服务调用方式
+const (
+	CallTypeSync  = "sync"
+	CallTypeAsync = "async"
+)
+
+// 标准事件及服务标识符
+const (
+	IdentifierPropertyPost = "post"
+	IdentifierPropertySet  = "set"
+	IdentifierPropertyGet  = "get"
+)
+
+// Thing 物模型
+type Thing struct {
+	Schema     string     `json:"schema,omitempty"`
+	Profile    Profile    `json:"profile"`
+	Properties []Property `json:"properties"`
+	Events     []Event    `json:"events"`
+	Services   []Service  `json:"services"`
+}
+
+// Profile 产品信息
+type Profile struct {
+	ProductKey string `json:"productKey"`
+	Version    string `json:"version,omitempty"`
+}
+
+// Property 属性
+type Property struct {
+	Identifier string   `json:"identifier"`
+	Name       string   `json:"name"`
+	AccessMode string   `json:"accessMode"` // r: 只读, rw: 读写
+	Required   bool     `json:"required"`
+	Desc       string   `json:"desc,omitempty"`
+	DataType   DataType `json:"dataType"`
+}
+
+// Writable 属性是否可写
+func (sf *Property) Writable() bool { return sf.AccessMode == AccessModeReadWrite }
+
+// Param 服务的输入输出参数,事件的输出参数,结构体的字段
+type Param struct {
+	Identifier string   `json:"identifier"`
+	Name       string   `json:"name"`
+	DataType   DataType `json:"dataType"`
+}
+
+// UnmarshalJSON 实现json.Unmarshaler接口,
+// 属性获取服务(get)的inputData仅为属性标识符字符串
+func (sf *Param) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &sf.Identifier)
+	}
+	type param Param
+	return json.Unmarshal(b, (*param)(sf))
+}
+
+// Event 事件
+type Event struct {
+	Identifier string  `json:"identifier"`
+	Name       string  `json:"name"`
+	Type       string  `json:"type"` // info: 信息, alert: 告警, error: 故障
+	Required   bool    `json:"required"`
+	Desc       string  `json:"desc,omitempty"`
+	Method     string  `json:"method"`
+	OutputData []Param `json:"outputData"`
+}
+
+// Service 服务
+type Service struct {
+	Identifier string  `json:"identifier"`
+	Name       string  `json:"name"`
+	CallType   string  `json:"callType"` // sync: 同步, async: 异步
+	Required   bool    `json:"required"`
+	Desc       string  `json:"desc,omitempty"`
+	Method     string  `json:"method"`
+	InputData  []Param `json:"inputData"`
+	OutputData []Param `json:"outputData"`
+}
+
+// Property 查找属性
+func (sf *Thing) Property(identifier string) (*Property, bool) {
+	for i := range sf.Properties {
+		if sf.Properties[i].Identifier == identifier {
+			return &sf.Properties[i], true
+		}
+	}
+	return nil, false
+}
+
+// Event 查找事件
+func (sf *Thing) Event(identifier string) (*Event, bool) {
+	for i := range sf.Events {
+		if sf.Events[i].Identifier == identifier {
+			return &sf.Events[i], true
+		}
+	}
+	return nil, false
+}
+
+// Service 查找服务
+func (sf *Thing) Service(identifier string) (*Service, bool) {
+	for i := range sf.Services {
+		if sf.Services[i].Identifier == identifier {
+			return &sf.Services[i], true
+		}
+	}
+	return nil, false
+}
+
+// Parse 解析物模型json,支持dsltemplate及dynamicTsl的数据格式
+func Parse(data []byte) (*Thing, error) {
+	// 兼容数据为json字符串的情况
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, err
+		}
+		data = []byte(s)
+	}
+	t := &Thing{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// LoadFile 从本地文件加载物模型
+func LoadFile(path string) (*Thing, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b)
+}
+
+// TemplateGetter 获取设备的TSL模板, *aiot.Client 实现了该接口
+type TemplateGetter interface {
+	LinkThingDsltemplateGetContext(ctx context.Context, pk, dn string) (json.RawMessage, error)
+}
+
+// DynamicGetter 获取设备的动态TSL, *aiot.Client 实现了该接口
+type DynamicGetter interface {
+	LinkThingDynamictslGetContext(ctx context.Context, pk, dn string) (json.RawMessage, error)
+}
+
+// LoadTemplate 从云端获取设备的TSL模板
+func LoadTemplate(ctx context.Context, g TemplateGetter, pk, dn string) (*Thing, error) {
+	data, err := g.LinkThingDsltemplateGetContext(ctx, pk, dn)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// LoadDynamic 从云端获取设备的动态TSL
+func LoadDynamic(ctx context.Context, g DynamicGetter, pk, dn string) (*Thing, error) {
+	data, err := g.LinkThingDynamictslGetContext(ctx, pk, dn)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// parseFloat 解析规格中的数值,平台以字符串表示,兼容数字
+func parseFloat(b json.RawMessage) (float64, bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	var s string
+	if b[0] == '"' {
+		if err := json.Unmarshal(b, &s); err != nil || s == "" {
+			return 0, false
+		}
+	} else {
+		s = string(b)
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
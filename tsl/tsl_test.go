@@ -0,0 +1,145 @@
+package tsl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockGetter struct {
+	data json.RawMessage
+	err  error
+}
+
+func (sf mockGetter) LinkThingDsltemplateGetContext(context.Context, string, string) (json.RawMessage, error) {
+	return sf.data, sf.err
+}
+
+func (sf mockGetter) LinkThingDynamictslGetContext(context.Context, string, string) (json.RawMessage, error) {
+	return sf.data, sf.err
+}
+
+func TestLoadFile(t *testing.T) {
+	thing, err := LoadFile("testdata/thing.json")
+	require.NoError(t, err)
+
+	assert.Equal(t, "a1QR3GD1Db3", thing.Profile.ProductKey)
+	assert.Len(t, thing.Properties, 8)
+	assert.Len(t, thing.Events, 2)
+	assert.Len(t, thing.Services, 3)
+
+	t.Run("number", func(t *testing.T) {
+		p, ok := thing.Property("Temperature")
+		require.True(t, ok)
+		assert.False(t, p.Writable())
+		require.NotNil(t, p.DataType.Number)
+		assert.Equal(t, TypeFloat, p.DataType.Type)
+		assert.Equal(t, -40.0, *p.DataType.Number.Min)
+		assert.Equal(t, 120.0, *p.DataType.Number.Max)
+		assert.Equal(t, 0.1, *p.DataType.Number.Step)
+		assert.Equal(t, "°C", p.DataType.Number.Unit)
+	})
+	t.Run("enum bool", func(t *testing.T) {
+		p, ok := thing.Property("PowerSwitch")
+		require.True(t, ok)
+		assert.True(t, p.Writable())
+		assert.Equal(t, map[string]string{"0": "关闭", "1": "开启"}, p.DataType.Enum)
+
+		p, ok = thing.Property("WorkMode")
+		require.True(t, ok)
+		assert.Len(t, p.DataType.Enum, 3)
+	})
+	t.Run("text date", func(t *testing.T) {
+		p, ok := thing.Property("Label")
+		require.True(t, ok)
+		assert.Equal(t, 32, p.DataType.Text.Length)
+
+		p, ok = thing.Property("LastTime")
+		require.True(t, ok)
+		assert.Equal(t, TypeDate, p.DataType.Type)
+	})
+	t.Run("struct", func(t *testing.T) {
+		p, ok := thing.Property("Location")
+		require.True(t, ok)
+		require.Len(t, p.DataType.Struct, 2)
+		assert.Equal(t, "Longitude", p.DataType.Struct[0].Identifier)
+		assert.Equal(t, TypeDouble, p.DataType.Struct[0].DataType.Type)
+		assert.Equal(t, 180.0, *p.DataType.Struct[0].DataType.Number.Max)
+	})
+	t.Run("array", func(t *testing.T) {
+		p, ok := thing.Property("History")
+		require.True(t, ok)
+		require.NotNil(t, p.DataType.Array)
+		assert.Equal(t, 10, p.DataType.Array.Size)
+		assert.Equal(t, TypeInt, p.DataType.Array.Item.Type)
+		assert.Nil(t, p.DataType.Array.Item.Number.Step)
+	})
+	t.Run("event", func(t *testing.T) {
+		e, ok := thing.Event("Error")
+		require.True(t, ok)
+		assert.Equal(t, EventTypeError, e.Type)
+		assert.Equal(t, "ErrorCode", e.OutputData[0].Identifier)
+	})
+	t.Run("service", func(t *testing.T) {
+		s, ok := thing.Service("get")
+		require.True(t, ok)
+		require.Len(t, s.InputData, 2)
+		assert.Equal(t, "Temperature", s.InputData[0].Identifier)
+
+		s, ok = thing.Service("Reboot")
+		require.True(t, ok)
+		assert.Equal(t, CallTypeSync, s.CallType)
+		assert.Equal(t, "Result", s.OutputData[0].Identifier)
+
+		_, ok = thing.Service("none")
+		assert.False(t, ok)
+	})
+}
+
+func TestMarshal(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/thing.json")
+	require.NoError(t, err)
+	want, err := Parse(b)
+	require.NoError(t, err)
+
+	out, err := json.Marshal(want)
+	require.NoError(t, err)
+	got, err := Parse(out)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+func TestParse(t *testing.T) {
+	t.Run("quoted", func(t *testing.T) {
+		thing, err := Parse([]byte(`"{\"properties\":[{\"identifier\":\"a\",\"dataType\":{\"type\":\"int\",\"specs\":{\"min\":1}}}]}"`))
+		require.NoError(t, err)
+		p, ok := thing.Property("a")
+		require.True(t, ok)
+		assert.Equal(t, 1.0, *p.DataType.Number.Min)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		_, err := Parse([]byte(`{"properties":[{"identifier":"a","dataType":{"type":"struct","specs":{}}}]}`))
+		assert.Error(t, err)
+	})
+}
+
+func TestLoadCloud(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/thing.json")
+	require.NoError(t, err)
+
+	thing, err := LoadTemplate(context.Background(), mockGetter{data: b}, "pk", "dn")
+	require.NoError(t, err)
+	assert.Len(t, thing.Properties, 8)
+
+	thing, err = LoadDynamic(context.Background(), mockGetter{data: b}, "pk", "dn")
+	require.NoError(t, err)
+	assert.Len(t, thing.Services, 3)
+
+	_, err = LoadTemplate(context.Background(), mockGetter{err: errors.New("timeout")}, "pk", "dn")
+	assert.Error(t, err)
+}
@@ -0,0 +1,420 @@
+// Copyright 2020 thinkgos (thinkgo@aliyun.com).  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package tsl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// stepEpsilon 步长校验的误差范围
+const stepEpsilon = 1e-6
+
+// Violation 校验不通过项
+type Violation struct {
+	Path   string // 标识符路径,如 Location.Longitude, History[1]
+	Reason string
+}
+
+// ValidationError 校验错误,包含所有不通过项
+type ValidationError struct {
+	Violations []Violation
+}
+
+// Error 实现error接口
+func (sf *ValidationError) Error() string {
+	s := make([]string, 0, len(sf.Violations))
+	for _, v := range sf.Violations {
+		s = append(s, v.Path+": "+v.Reason)
+	}
+	return "tsl: validate failed, " + strings.Join(s, "; ")
+}
+
+type violations []Violation
+
+func (sf *violations) add(path, format string, v ...interface{}) {
+	*sf = append(*sf, Violation{path, fmt.Sprintf(format, v...)})
+}
+
+func (sf violations) err() error {
+	if len(sf) == 0 {
+		return nil
+	}
+	return &ValidationError{sf}
+}
+
+// ValidateProperties 校验属性上报的参数,
+// 支持 {"id": value} 及 {"id": {"value": value, "time": 1524448722000}} 两种格式
+func (sf *Thing) ValidateProperties(params interface{}) error {
+	m, err := normalizeObject(params)
+	if err != nil {
+		return err
+	}
+	var vs violations
+	for _, id := range sortedKeys(m) {
+		p, ok := sf.Property(id)
+		if !ok {
+			vs.add(id, "undefined property")
+			continue
+		}
+		v := m[id]
+		if tv, ok := v.(map[string]interface{}); ok && isTimeValue(tv, p.DataType.Type) {
+			v = tv["value"]
+		}
+		validateValue(&vs, id, &p.DataType, v)
+	}
+	return vs.err()
+}
+
+// ValidateEvent 校验事件上报的参数
+func (sf *Thing) ValidateEvent(eventID string, params interface{}) error {
+	e, ok := sf.Event(eventID)
+	if !ok {
+		return violations{{eventID, "undefined event"}}.err()
+	}
+	return validateParams(e.OutputData, params)
+}
+
+// ValidateServiceInput 校验服务调用的输入参数
+func (sf *Thing) ValidateServiceInput(serviceID string, params interface{}) error {
+	s, ok := sf.Service(serviceID)
+	if !ok {
+		return violations{{serviceID, "undefined service"}}.err()
+	}
+	return validateParams(s.InputData, params)
+}
+
+// ValidateServiceOutput 校验服务应答的输出参数
+func (sf *Thing) ValidateServiceOutput(serviceID string, data interface{}) error {
+	s, ok := sf.Service(serviceID)
+	if !ok {
+		return violations{{serviceID, "undefined service"}}.err()
+	}
+	return validateParams(s.OutputData, data)
+}
+
+// Validate 校验值是否满足数据类型及规格
+func (sf *DataType) Validate(value interface{}) error {
+	v, err := normalize(value)
+	if err != nil {
+		return err
+	}
+	var vs violations
+	validateValue(&vs, "", sf, v)
+	return vs.err()
+}
+
+// Validator 多产品的物模型校验,协程安全, 实现了 aiot.Validator 接口
+// 未添加物模型的产品不做校验
+type Validator struct {
+	rw     sync.RWMutex
+	things map[string]*Thing
+}
+
+// NewValidator 新建物模型校验
+func NewValidator(things ...*Thing) *Validator {
+	sf := &Validator{things: make(map[string]*Thing)}
+	for _, t := range things {
+		sf.Add(t)
+	}
+	return sf
+}
+
+// Add 添加或替换产品的物模型,以 Profile.ProductKey 区分产品
+func (sf *Validator) Add(t *Thing) {
+	sf.rw.Lock()
+	sf.things[t.Profile.ProductKey] = t
+	sf.rw.Unlock()
+}
+
+// Thing 获取产品的物模型
+func (sf *Validator) Thing(pk string) (*Thing, bool) {
+	sf.rw.RLock()
+	defer sf.rw.RUnlock()
+	t, ok := sf.things[pk]
+	return t, ok
+}
+
+// ValidateProperties 校验属性上报的参数
+func (sf *Validator) ValidateProperties(pk string, params interface{}) error {
+	if t, ok := sf.Thing(pk); ok {
+		return t.ValidateProperties(params)
+	}
+	return nil
+}
+
+// ValidateEvent 校验事件上报的参数
+func (sf *Validator) ValidateEvent(pk, eventID string, params interface{}) error {
+	if t, ok := sf.Thing(pk); ok {
+		return t.ValidateEvent(eventID, params)
+	}
+	return nil
+}
+
+// ValidateServiceOutput 校验服务应答的输出参数
+func (sf *Validator) ValidateServiceOutput(pk, serviceID string, data interface{}) error {
+	if t, ok := sf.Thing(pk); ok {
+		return t.ValidateServiceOutput(serviceID, data)
+	}
+	return nil
+}
+
+func validateParams(params []Param, value interface{}) error {
+	m, err := normalizeObject(value)
+	if err != nil {
+		return err
+	}
+	var vs violations
+	validateFields(&vs, "", params, m)
+	return vs.err()
+}
+
+func validateFields(vs *violations, prefix string, params []Param, m map[string]interface{}) {
+	for _, id := range sortedKeys(m) {
+		path := id
+		if prefix != "" {
+			path = prefix + "." + id
+		}
+		p := findParam(params, id)
+		if p == nil {
+			vs.add(path, "undefined identifier")
+			continue
+		}
+		validateValue(vs, path, &p.DataType, m[id])
+	}
+}
+
+func validateValue(vs *violations, path string, dt *DataType, v interface{}) {
+	switch dt.Type {
+	case TypeInt, TypeFloat, TypeDouble:
+		n, ok := v.(json.Number)
+		if !ok {
+			vs.add(path, "expect %s, got %s", dt.Type, kindOf(v))
+			return
+		}
+		if dt.Type == TypeInt {
+			if _, err := n.Int64(); err != nil {
+				vs.add(path, "expect int, got %s", n)
+				return
+			}
+		}
+		f, err := n.Float64()
+		if err != nil {
+			vs.add(path, "invalid number %s", n)
+			return
+		}
+		validateNumber(vs, path, dt.Number, f)
+	case TypeEnum, TypeBool:
+		// bool类型同时接受 true/false, 分别对应 1/0
+		if b, ok := v.(bool); ok && dt.Type == TypeBool {
+			if b {
+				v = json.Number("1")
+			} else {
+				v = json.Number("0")
+			}
+		}
+		n, ok := v.(json.Number)
+		if !ok {
+			vs.add(path, "expect %s, got %s", dt.Type, kindOf(v))
+			return
+		}
+		i, err := n.Int64()
+		if err != nil {
+			vs.add(path, "expect %s, got %s", dt.Type, n)
+			return
+		}
+		key := strconv.FormatInt(i, 10)
+		if len(dt.Enum) == 0 {
+			if dt.Type == TypeBool && i != 0 && i != 1 {
+				vs.add(path, "value %s not in [0 1]", key)
+			}
+			return
+		}
+		if _, ok = dt.Enum[key]; !ok {
+			vs.add(path, "value %s not in %v", key, sortedKeys(dt.Enum))
+		}
+	case TypeText:
+		s, ok := v.(string)
+		if !ok {
+			vs.add(path, "expect text, got %s", kindOf(v))
+			return
+		}
+		if dt.Text != nil && dt.Text.Length > 0 && utf8.RuneCountInString(s) > dt.Text.Length {
+			vs.add(path, "text length %d exceed %d", utf8.RuneCountInString(s), dt.Text.Length)
+		}
+	case TypeDate:
+		var s string
+		switch vv := v.(type) {
+		case string:
+			s = vv
+		case json.Number:
+			s = vv.String()
+		default:
+			vs.add(path, "expect date, got %s", kindOf(v))
+			return
+		}
+		if _, err := strconv.ParseInt(s, 10, 64); err != nil {
+			vs.add(path, "expect date in millisecond timestamp, got %q", s)
+		}
+	case TypeStruct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			vs.add(path, "expect struct, got %s", kindOf(v))
+			return
+		}
+		validateFields(vs, path, dt.Struct, m)
+	case TypeArray:
+		arr, ok := v.([]interface{})
+		if !ok {
+			vs.add(path, "expect array, got %s", kindOf(v))
+			return
+		}
+		if dt.Array == nil {
+			return
+		}
+		if dt.Array.Size > 0 && len(arr) > dt.Array.Size {
+			vs.add(path, "array size %d exceed %d", len(arr), dt.Array.Size)
+		}
+		for i, item := range arr {
+			validateValue(vs, path+"["+strconv.Itoa(i)+"]", &dt.Array.Item, item)
+		}
+	default:
+		vs.add(path, "unknown data type %q", dt.Type)
+	}
+}
+
+func validateNumber(vs *violations, path string, specs *NumberSpecs, f float64) {
+	if specs == nil {
+		return
+	}
+	if specs.Min != nil && f < *specs.Min {
+		vs.add(path, "value %v less than min %v", f, *specs.Min)
+	}
+	if specs.Max != nil && f > *specs.Max {
+		vs.add(path, "value %v greater than max %v", f, *specs.Max)
+	}
+	if specs.Step != nil && *specs.Step > 0 {
+		base := 0.0
+		if specs.Min != nil {
+			base = *specs.Min
+		}
+		q := (f - base) / *specs.Step
+		if math.Abs(q-math.Round(q)) > stepEpsilon {
+			vs.add(path, "value %v not match step %v", f, *specs.Step)
+		}
+	}
+}
+
+// isTimeValue 是否为带时间戳的属性值 {"value": value, "time": 1524448722000}
+func isTimeValue(m map[string]interface{}, typ string) bool {
+	if _, ok := m["value"]; !ok {
+		return false
+	}
+	if typ != TypeStruct {
+		return true
+	}
+	// 结构体属性本身可能包含value字段, 仅在只有value及time字段时认为带时间戳
+	for k := range m {
+		if k != "value" && k != "time" {
+			return false
+		}
+	}
+	_, ok := m["value"].(map[string]interface{})
+	return ok
+}
+
+func findParam(params []Param, id string) *Param {
+	for i := range params {
+		if params[i].Identifier == id {
+			return &params[i]
+		}
+	}
+	return nil
+}
+
+// normalize 将任意值转换为json通用类型,数值为json.Number
+func normalize(value interface{}) (interface{}, error) {
+	var b []byte
+	var err error
+
+	switch v := value.(type) {
+	case []byte:
+		b = v
+	case json.RawMessage:
+		b = v
+	default:
+		if b, err = json.Marshal(value); err != nil {
+			return nil, err
+		}
+	}
+	var out interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err = dec.Decode(&out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// normalizeObject 将值转换为json对象,字符串视为json文本,如 "{}"
+func normalizeObject(value interface{}) (map[string]interface{}, error) {
+	if s, ok := value.(string); ok {
+		value = json.RawMessage(s)
+	}
+	v, err := normalize(value)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return map[string]interface{}{}, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, violations{{"", "expect object, got " + kindOf(v)}}.err()
+	}
+	return m, nil
+}
+
+func kindOf(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch mm := m.(type) {
+	case map[string]interface{}:
+		for k := range mm {
+			keys = append(keys, k)
+		}
+	case map[string]string:
+		for k := range mm {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,123 @@
+package tsl
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func violationPaths(t *testing.T, err error) []string {
+	var ve *ValidationError
+
+	require.True(t, errors.As(err, &ve), "expect ValidationError, got %v", err)
+	paths := make([]string, 0, len(ve.Violations))
+	for _, v := range ve.Violations {
+		paths = append(paths, v.Path)
+	}
+	return paths
+}
+
+func TestThing_ValidateProperties(t *testing.T) {
+	thing, err := LoadFile("testdata/thing.json")
+	require.NoError(t, err)
+
+	t.Run("valid", func(t *testing.T) {
+		err := thing.ValidateProperties(map[string]interface{}{
+			"Temperature": 25.5,
+			"Brightness":  50,
+			"PowerSwitch": 1,
+			"WorkMode":    2,
+			"Label":       "客厅",
+			"LastTime":    "1524448722000",
+			"Location":    map[string]float64{"Longitude": 120.01, "Latitude": 30.25},
+			"History":     []int{1, 2, 3},
+		})
+		assert.NoError(t, err)
+	})
+	t.Run("time value", func(t *testing.T) {
+		err := thing.ValidateProperties(json.RawMessage(`{"Brightness":{"value":10,"time":1524448722000}}`))
+		assert.NoError(t, err)
+		err = thing.ValidateProperties(json.RawMessage(`{"Brightness":{"value":101,"time":1524448722000}}`))
+		assert.Equal(t, []string{"Brightness"}, violationPaths(t, err))
+	})
+	t.Run("violations", func(t *testing.T) {
+		err := thing.ValidateProperties(map[string]interface{}{
+			"Unknown":     1,
+			"Temperature": 121,
+			"Brightness":  1.5,
+			"PowerSwitch": 2,
+			"WorkMode":    "1",
+			"Label":       "0123456789012345678901234567890123",
+			"LastTime":    "yesterday",
+			"Location":    map[string]interface{}{"Longitude": 181, "Altitude": 1},
+			"History":     []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1001},
+		})
+		assert.Equal(t, []string{
+			"Brightness",
+			"History",
+			"History[10]",
+			"Label",
+			"LastTime",
+			"Location.Altitude",
+			"Location.Longitude",
+			"PowerSwitch",
+			"Temperature",
+			"Unknown",
+			"WorkMode",
+		}, violationPaths(t, err))
+	})
+	t.Run("bool", func(t *testing.T) {
+		assert.NoError(t, thing.ValidateProperties(map[string]interface{}{"PowerSwitch": true}))
+		assert.NoError(t, thing.ValidateProperties(map[string]interface{}{"PowerSwitch": false}))
+		err := thing.ValidateProperties(map[string]interface{}{"WorkMode": true})
+		assert.Equal(t, []string{"WorkMode"}, violationPaths(t, err))
+	})
+	t.Run("step", func(t *testing.T) {
+		assert.NoError(t, thing.ValidateProperties(map[string]float64{"Temperature": 36.6}))
+		err := thing.ValidateProperties(map[string]float64{"Temperature": 36.65})
+		assert.Equal(t, []string{"Temperature"}, violationPaths(t, err))
+	})
+	t.Run("not object", func(t *testing.T) {
+		assert.Error(t, thing.ValidateProperties([]int{1}))
+	})
+}
+
+func TestThing_ValidateEventService(t *testing.T) {
+	thing, err := LoadFile("testdata/thing.json")
+	require.NoError(t, err)
+
+	assert.NoError(t, thing.ValidateEvent("Error", map[string]int{"ErrorCode": 1}))
+	assert.Equal(t, []string{"ErrorCode"}, violationPaths(t, thing.ValidateEvent("Error", map[string]int{"ErrorCode": 3})))
+	assert.Equal(t, []string{"none"}, violationPaths(t, thing.ValidateEvent("none", nil)))
+
+	assert.NoError(t, thing.ValidateServiceInput("Reboot", map[string]int{"Delay": 10}))
+	assert.Equal(t, []string{"Delay"}, violationPaths(t, thing.ValidateServiceInput("Reboot", map[string]int{"Delay": 61})))
+	assert.NoError(t, thing.ValidateServiceOutput("Reboot", map[string]string{"Result": "ok"}))
+	assert.NoError(t, thing.ValidateServiceOutput("set", "{}"))
+	assert.NoError(t, thing.ValidateServiceOutput("set", nil))
+	assert.Equal(t, []string{"Result"}, violationPaths(t, thing.ValidateServiceOutput("Reboot", map[string]int{"Result": 1})))
+}
+
+func TestValidator(t *testing.T) {
+	thing, err := LoadFile("testdata/thing.json")
+	require.NoError(t, err)
+
+	v := NewValidator(thing)
+	assert.NoError(t, v.ValidateProperties("other", map[string]int{"Unknown": 1}))
+	assert.Error(t, v.ValidateProperties("a1QR3GD1Db3", map[string]int{"Unknown": 1}))
+	assert.Error(t, v.ValidateEvent("a1QR3GD1Db3", "Error", map[string]int{"ErrorCode": 3}))
+	assert.Error(t, v.ValidateServiceOutput("a1QR3GD1Db3", "Reboot", map[string]int{"Result": 1}))
+}
+
+func TestDataType_Validate(t *testing.T) {
+	thing, err := LoadFile("testdata/thing.json")
+	require.NoError(t, err)
+
+	p, ok := thing.Property("History")
+	require.True(t, ok)
+	assert.NoError(t, p.DataType.Validate([]int{1, 2}))
+	assert.Error(t, p.DataType.Validate([]string{"1"}))
+}
@@ -46,6 +46,8 @@ const (
 	OtaDeviceProcessPrefix   = "/ota/device/progress/%s/%s"
 	ThingOtaFirmwareGet      = "thing/ota/firmware/get"
 	ThingOtaFirmwareGetReply = "thing/ota/firmware/get_reply"
+	ThingFileDownload        = "thing/file/download"
+	ThingFileDownloadReply   = "thing/file/download_reply"
 )
 
 // 设备URI 定义